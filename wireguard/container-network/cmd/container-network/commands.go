@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"container-network/pkg/admin"
+	"container-network/pkg/client"
+	"container-network/pkg/config"
+	"container-network/pkg/handler"
+	"container-network/pkg/iptables"
+	"container-network/pkg/netlink"
+	"container-network/pkg/routing"
+	"container-network/pkg/setup"
+)
+
+// list prints the managed containers of the admin API, or else of the
+// status file, with their address and DNAT ports.
+func list() int {
+	cfg, err := config.Load()
+	if err != nil {
+		slog.Error("Failed to load configuration", "error", err)
+		return 1
+	}
+	var containers []admin.Container
+	if cfg.AdminListen != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err = admin.Get(ctx, cfg.AdminListen, cfg.AdminToken, "/containers", &containers); err != nil {
+			slog.Warn("Failed to query the admin API", "error", err)
+		}
+	}
+	if cfg.AdminListen == "" || err != nil {
+		if cfg.StatusFile == "" {
+			slog.Error("No admin API or status file, set -admin-listen or -status-file as for the daemon")
+			return 1
+		}
+		status, err := handler.ReadStatus(cfg.StatusFile)
+		if err != nil {
+			slog.Error("Failed to read status file", "error", err)
+			return 1
+		}
+		for _, c := range status.Containers {
+			containers = append(containers, admin.Container{ID: c.ID, Name: c.Name, IP: c.IP, Status: &c})
+		}
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tIP\tPORTS\tSTATE")
+	for _, container := range containers {
+		c := container.Status
+		if c == nil {
+			fmt.Fprintf(w, "%s\t%s\t\tpending\n", container.Name, container.IP)
+			continue
+		}
+		var ports []string
+		for _, p := range c.Ports {
+			port := fmt.Sprintf("%d->%d/%s", p.ExternalPort, p.Port, p.Protocol)
+			if p.ExternalPort == 0 {
+				port = fmt.Sprintf("?->%d/%s", p.Port, p.Protocol)
+			}
+			if p.Source != "label" {
+				port += " (" + p.Source + ")"
+			}
+			ports = append(ports, port)
+		}
+		state := "active"
+		switch {
+		case c.Error != "" && c.RetryAt != nil:
+			state = fmt.Sprintf("failed, retry at %s: %s", c.RetryAt.Format(time.RFC3339), c.Error)
+		case c.Error != "":
+			state = "failed: " + c.Error
+		case c.DrainUntil != nil:
+			state = "draining until " + c.DrainUntil.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", c.Name, c.IP, strings.Join(ports, ", "), state)
+	}
+	w.Flush()
+	return 0
+}
+
+// rules prints the rules of the containers of the admin API, or else the
+// live rules of the containers of the status file.
+func rules() int {
+	cfg, err := config.Load()
+	if err != nil {
+		slog.Error("Failed to load configuration", "error", err)
+		return 1
+	}
+	if cfg.AdminListen != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		var managed admin.Rules
+		if err := admin.Get(ctx, cfg.AdminListen, cfg.AdminToken, "/rules", &managed); err != nil {
+			slog.Warn("Failed to query the admin API, listing the live rules", "error", err)
+		} else {
+			for _, rule := range managed.Rules {
+				fmt.Println(rule.Rule)
+			}
+			return 0
+		}
+	}
+	rules, _, err := ownedRules(cfg)
+	if err != nil {
+		slog.Error("Failed to list rules", "error", err)
+		return 1
+	}
+	for _, rule := range rules {
+		fmt.Println(strings.Join(rule, " "))
+	}
+	return 0
+}
+
+// cleanup removes the rules and routes of the daemon left behind after a
+// crash: the rules of the containers of the status file, the base setup
+// rules, the source routing rules of the containers and the egress routing.
+// With -dry-run, they are printed instead.
+func cleanup() int {
+	cfg, err := config.Load()
+	if err != nil {
+		slog.Error("Failed to load configuration", "error", err)
+		return 1
+	}
+	rules, owned, err := ownedRules(cfg)
+	if err != nil {
+		slog.Error("Failed to list rules", "error", err)
+		return 1
+	}
+	if cfg.BaseSetup {
+		if cfg.InternalSubnet == "" {
+			if c, err := client.NewClient(cfg.RuntimeAPI); err == nil {
+				discoverNetwork(context.Background(), c, cfg)
+			}
+		}
+		detectInterfaces(cfg)
+		base := setup.NewBase(setup.Config{
+			InternalSubnet:  cfg.InternalSubnet,
+			TunnelInterface: cfg.TunnelInterface,
+		})
+		live := make(map[string]bool)
+		for _, table := range []string{"filter", "nat"} {
+			saved, err := iptables.Save(table)
+			if err != nil {
+				slog.Error("Failed to list rules", "table", table, "error", err)
+				return 1
+			}
+			for _, rule := range saved {
+				live[strings.Join(rule, " ")] = true
+			}
+		}
+		for _, rule := range base.Rules() {
+			if rule = iptables.Canonical(rule); live[strings.Join(rule, " ")] {
+				rules = append(rules, rule)
+			}
+		}
+	}
+
+	failed := false
+	tx := iptables.NewTransaction()
+	for _, rule := range rules {
+		tx.Add("-D", rule, func(err error) {
+			switch {
+			case err != nil:
+				slog.Error("Failed to remove rule", "rule", strings.Join(rule, " "), "error", err)
+				failed = true
+			case !cfg.DryRun:
+				slog.Info("Removed rule", "rule", strings.Join(rule, " "))
+			}
+		})
+	}
+	if cfg.DryRun {
+		tx.Plan(os.Stdout)
+	} else {
+		tx.Commit()
+	}
+
+	var routingRules []netlink.Rule
+	var routes []netlink.Route
+	handle, err := netlink.NewHandle()
+	if err != nil {
+		slog.Error("Failed to list routing rules", "error", err)
+		return 1
+	}
+	defer handle.Close()
+	installed, err := handle.RuleList()
+	if err != nil {
+		slog.Error("Failed to list routing rules", "error", err)
+		return 1
+	}
+	for _, r := range installed {
+		// the egress and tunnel rules of the containers
+		if (r.Priority == cfg.EgressRulePriority || r.Priority == cfg.EgressRulePriority+1) && r.Src != nil {
+			if ones, _ := r.Src.Mask.Size(); ones == 32 && owned(r.Src.IP) {
+				routingRules = append(routingRules, r)
+			}
+		}
+	}
+	if manager, err := routing.NewManager(routing.Config{Routes: egressRoutes(cfg)}); err != nil {
+		slog.Error("Failed to list egress routing", "error", err)
+		failed = true
+	} else {
+		egressRules, egressRoutes, err := manager.Installed()
+		manager.Close()
+		if err != nil {
+			slog.Error("Failed to list egress routing", "error", err)
+			failed = true
+		}
+		routingRules = append(routingRules, egressRules...)
+		routes = egressRoutes
+	}
+	for _, r := range routingRules {
+		if cfg.DryRun {
+			fmt.Printf("# ip rule del %s\n", r)
+		} else if err := handle.RuleDel(&r); err != nil {
+			slog.Error("Failed to remove routing rule", "rule", r.String(), "error", err)
+			failed = true
+		} else {
+			slog.Info("Removed routing rule", "rule", r.String())
+		}
+	}
+	for _, r := range routes {
+		if cfg.DryRun {
+			fmt.Printf("# ip route del %s table %d\n", r, r.Table)
+		} else if err := handle.RouteDel(&r); err != nil {
+			slog.Error("Failed to remove route", "route", r.String(), "error", err)
+			failed = true
+		} else {
+			slog.Info("Removed route", "route", r.String())
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// check verifies the privileges, the container runtime socket and the
+// iptables tools needed by the daemon.
+func check() int {
+	cfg, err := config.Load()
+	if err != nil {
+		slog.Error("Failed to load configuration", "error", err)
+		return 1
+	}
+	ok := true
+	report := func(name string, err error, detail string) {
+		if err != nil {
+			ok = false
+			fmt.Printf("FAIL  %s: %v\n", name, err)
+		} else {
+			fmt.Printf("ok    %s: %s\n", name, detail)
+		}
+	}
+
+	detail, err := checkPrivileges()
+	report("privileges", err, detail)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := client.NewClient(cfg.RuntimeAPI)
+	if err == nil {
+		err = c.Ping(ctx)
+	}
+	report("container runtime", err, cfg.RuntimeAPI)
+	if err == nil {
+		_, err = c.InspectNetwork(ctx, cfg.WatchNetwork)
+		report("watched network", err, cfg.WatchNetwork)
+	}
+
+	for _, tool := range []string{"iptables", iptables.RestoreCommand[0], iptables.SaveCommand[0]} {
+		path, err := exec.LookPath(tool)
+		report(tool, err, path)
+	}
+	_, err = iptables.Save("nat")
+	report("iptables access", err, "nat table listed")
+
+	if !ok {
+		return 1
+	}
+	return 0
+}
+
+// checkPrivileges verifies that the process runs as root or with the
+// CAP_NET_ADMIN capability, needed to change the rules and routes.
+func checkPrivileges() (string, error) {
+	if os.Geteuid() == 0 {
+		return "running as root", nil
+	}
+	if runtime.GOOS != "linux" {
+		return "", errors.New("not running as root")
+	}
+	file, err := os.Open("/proc/self/status")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(scanner.Text(), "CapEff:")
+		if !ok {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid effective capabilities %q", value)
+		}
+		// CAP_NET_ADMIN is capability 12
+		if caps&(1<<12) == 0 {
+			return "", errors.New("not running as root and without CAP_NET_ADMIN")
+		}
+		return "CAP_NET_ADMIN", nil
+	}
+	return "", errors.New("not running as root and no capabilities found")
+}
+
+// ownedRules returns the live rules of the containers of the status file
+// and whether an address belongs to one of them. With -cleanup-subnet, the
+// rules of all the addresses of -internal-subnet are included, e.g. when the
+// status file is lost, with the risk of including the rules of other tools
+// for these addresses.
+func ownedRules(cfg *config.Config) ([][]string, func(net.IP) bool, error) {
+	var subnet *net.IPNet
+	if cfg.CleanupSubnet {
+		if cfg.InternalSubnet == "" {
+			return nil, nil, errors.New("-cleanup-subnet needs the -internal-subnet of the watched network")
+		}
+		if _, subnet, _ = net.ParseCIDR(cfg.InternalSubnet); subnet == nil {
+			return nil, nil, fmt.Errorf("invalid internal subnet %s", cfg.InternalSubnet)
+		}
+	} else if cfg.StatusFile == "" {
+		return nil, nil, errors.New("no status file, set -status-file as for the daemon, or -cleanup-subnet with -internal-subnet")
+	}
+	status := &handler.Status{}
+	if cfg.StatusFile != "" {
+		read, err := handler.ReadStatus(cfg.StatusFile)
+		switch {
+		case err == nil:
+			status = read
+		case errors.Is(err, os.ErrNotExist):
+			slog.Warn("No status file, no container rules recorded", "file", cfg.StatusFile)
+		default:
+			return nil, nil, fmt.Errorf("reading status file: %w", err)
+		}
+	}
+	addresses := make(map[string]bool)
+	for _, c := range status.Containers {
+		addresses[c.IP] = true
+	}
+	owned := func(ip net.IP) bool {
+		return addresses[ip.String()] || (subnet != nil && subnet.Contains(ip))
+	}
+	if subnet != nil {
+		rules, err := handler.OwnedRules(owned)
+		return rules, owned, err
+	}
+	rules, err := handler.RecordedRules(status)
+	return rules, owned, err
+}
+
+// egressRoutes returns the routes of the routing manager: the egress routes
+// and the routing tables of the tunnels.
+func egressRoutes(cfg *config.Config) []config.EgressRoute {
+	routes := cfg.EgressRoutes
+	for _, t := range cfg.Tunnels {
+		if t.Table > 0 {
+			routes = append(routes, config.EgressRoute{Name: t.Interface, Table: t.Table, Device: t.Interface})
+		}
+	}
+	return routes
+}
@@ -4,96 +4,480 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"fmt"
 	"log/slog"
+	"net"
 	"os"
 	"os/exec"
 	"os/signal"
-	"sync"
+	"strings"
 	"syscall"
 
+	"container-network/pkg/admin"
 	"container-network/pkg/client"
 	"container-network/pkg/config"
 	"container-network/pkg/handler"
+	"container-network/pkg/natpmp"
+	"container-network/pkg/peers"
+	"container-network/pkg/portpool"
+	"container-network/pkg/routing"
+	"container-network/pkg/setup"
+	"container-network/pkg/tunnel"
 	"container-network/pkg/watcher"
 )
 
+// commands are the subcommands, by name. Without command, the daemon is run.
+var commands = map[string]func() int{
+	"run":     run,
+	"list":    list,
+	"rules":   rules,
+	"cleanup": cleanup,
+	"check":   check,
+	"plan":    plan,
+}
+
 func main() {
+	command := "run"
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		command = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+	fn, ok := commands[command]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q, see %s -help\n", command, config.AppName)
+		os.Exit(2)
+	}
+	os.Exit(fn())
+}
+
+// run runs the daemon until it receives SIGINT or SIGTERM.
+func run() int {
 	cfg, err := config.Load()
 	if err != nil {
 		slog.Error("Failed to load configuration", "error", err)
-		os.Exit(1)
-	}
-	// Run startup script if configured
-	if cfg.StartupScript != "" {
-		slog.Info("Running startup script", "script", cfg.StartupScript)
-		if err := runScript(cfg.StartupScript); err != nil {
-			slog.Error("Startup script failed", "error", err)
-			os.Exit(1)
-		}
-		slog.Info("Startup script completed successfully")
+		return 1
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	var wg sync.WaitGroup
+	// Registered before the setup so that a signal received meanwhile still
+	// restores it: the cleanups are deferred after each step
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	wg.Add(1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
+	defer signal.Stop(sigCh)
+	restoreGateways := make(chan struct{}, 1)
 	go func() {
-		defer wg.Done()
-		sig := <-sigCh
-		slog.Info("Received signal, shutting down...", "signal", sig)
-		cancel()
-		// Run shutdown script if configured
-		if cfg.ShutdownScript != "" {
-			slog.Info("Running shutdown script", "script", cfg.ShutdownScript)
-			if err := runScript(cfg.ShutdownScript); err != nil {
-				slog.Error("Shutdown script failed", "error", err)
-			} else {
-				slog.Info("Shutdown script completed successfully")
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-sigCh:
+				if sig == syscall.SIGUSR1 {
+					select {
+					case restoreGateways <- struct{}{}:
+					default:
+					}
+					continue
+				}
+				slog.Info("Received signal, shutting down...", "signal", sig)
+				cancel()
+				return
 			}
 		}
 	}()
+	defer func() {
+		if ctx.Err() != nil {
+			slog.Info("Shutdown complete")
+		}
+	}()
+
 	dockerClient, err := client.NewClient(cfg.RuntimeAPI)
 	if err != nil {
 		slog.Error("Failed to create container client", "error", err)
-		os.Exit(1)
+		return 1
 	}
 	slog.Info("Connecting to container runtime", "api", cfg.RuntimeAPI)
 	if err := dockerClient.Ping(ctx); err != nil {
 		slog.Error("Failed to connect to container runtime", "error", err)
-		os.Exit(1)
+		return 1
 	}
 	slog.Info("Successfully connected to container runtime")
+
+	// Discover the subnet and gateway of the watched network and the local interfaces
+	scriptEnv := discoverNetwork(ctx, dockerClient, cfg)
+	ifaces, ifacesEnv := detectInterfaces(cfg)
+	scriptEnv = append(scriptEnv, ifacesEnv...)
+
+	if cfg.DryRun {
+		slog.Info("Dry run, the rule changes are printed instead of being applied")
+	}
+
+	// Run startup script if configured
+	if cfg.StartupScript != "" && !cfg.DryRun {
+		slog.Info("Running startup script", "script", cfg.StartupScript)
+		if err := runScript(cfg.StartupScript, scriptEnv); err != nil {
+			slog.Error("Startup script failed", "error", err)
+			return 1
+		}
+		slog.Info("Startup script completed successfully")
+	}
+	if cfg.ShutdownScript != "" && !cfg.DryRun {
+		defer func() {
+			slog.Info("Running shutdown script", "script", cfg.ShutdownScript)
+			if err := runScript(cfg.ShutdownScript, scriptEnv); err != nil {
+				slog.Error("Shutdown script failed", "error", err)
+			} else {
+				slog.Info("Shutdown script completed successfully")
+			}
+		}()
+	}
+
+	// Setup rp_filter, forwarding and masquerade
+	var baseSetup *setup.Base
+	if cfg.BaseSetup {
+		baseSetup = setup.NewBase(setup.Config{
+			InternalSubnet:    cfg.InternalSubnet,
+			InternalInterface: cfg.InternalInterface,
+			TunnelInterface:   cfg.TunnelInterface,
+		})
+	}
+	if baseSetup != nil && cfg.DryRun {
+		baseSetup.Plan(os.Stdout)
+		baseSetup = nil
+	}
+	if baseSetup != nil {
+		if err := baseSetup.Apply(); err != nil {
+			slog.Error("Failed to apply base setup", "error", err)
+			baseSetup.Restore()
+			return 1
+		}
+		if err := baseSetup.Verify(); err != nil {
+			slog.Error("Failed to verify base setup", "error", err)
+			baseSetup.Restore()
+			return 1
+		}
+		slog.Info("Base setup completed successfully")
+		defer func() {
+			if err := baseSetup.Restore(); err != nil {
+				slog.Error("Failed to restore base setup", "error", err)
+			}
+		}()
+	}
+
+	// Setup policy routing for the egress routes and the tunnel tables
+	routes := egressRoutes(cfg)
+	var routingManager *routing.Manager
+	if len(routes) > 0 && !cfg.DryRun {
+		routingManager, err = routing.NewManager(routing.Config{
+			Routes:        routes,
+			CheckInterval: cfg.RoutingCheckInterval,
+		})
+		if err != nil {
+			slog.Error("Failed to create routing manager", "error", err)
+			return 1
+		}
+		defer func() {
+			if err := routingManager.Cleanup(); err != nil {
+				slog.Error("Failed to cleanup egress routing", "error", err)
+			}
+		}()
+		if err := routingManager.Setup(); err != nil {
+			slog.Error("Failed to setup egress routing", "error", err)
+		}
+		go routingManager.Start(ctx)
+	}
+
+	// Allocate the external ports of the auto DNAT ports
+	var portPool *portpool.Pool
+	if cfg.DNATPortPool != "" {
+		first, last, _ := portpool.ParseRange(cfg.DNATPortPool)
+		portPool, err = portpool.NewPool(portpool.Config{Min: first, Max: last, Path: cfg.PortAllocationsFile, Expiry: cfg.PortAllocationExpiry, ReadOnly: cfg.DryRun})
+		if err != nil {
+			slog.Error("Failed to load port allocations", "error", err)
+			return 1
+		}
+		if cfg.PortAllocationsFile == "" {
+			slog.Warn("No port allocations file, allocated ports change after restarts")
+		}
+	}
+
+	// Hairpin NAT needs the public address of the VPN
+	if cfg.Hairpin && cfg.PublicAddress == nil && cfg.NATPMPGateway != nil {
+		address, err := natpmp.NewClient(cfg.NATPMPGateway).ExternalAddress()
+		if err != nil {
+			slog.Warn("Failed to get the public address from the NAT-PMP gateway", "error", err)
+		} else {
+			slog.Info("Discovered public address", "address", address)
+			cfg.PublicAddress = address
+		}
+	}
+	if cfg.Hairpin && (cfg.PublicAddress == nil || cfg.InternalSubnet == "" || cfg.InternalInterface == "") {
+		slog.Warn("Hairpin NAT disabled, unknown public address, internal subnet or interface")
+	}
+
 	watcherConfig := watcher.Config{
 		NetworkName: cfg.WatchNetwork,
 		EnableLabel: cfg.WatchContainerLabel,
 	}
 	w := watcher.NewWatcher(dockerClient, watcherConfig)
-	h := handler.NewHandler(w.Events(), cfg.IptablesMangleMarkPublishedPorts, cfg.IptablesDnatPortsLabel)
+	handlerConfig := newHandlerConfig(cfg, ifaces.InternalAddress, portPool)
+	if cfg.DryRun {
+		handlerConfig.StatusFile = ""
+		handlerConfig.Plan = os.Stdout
+	}
+	h := handler.NewHandler(w.Events(), handlerConfig)
+	if cfg.PeersConfig != "" {
+		peersWatcher := peers.NewWatcher(peers.Config{
+			Path:          cfg.PeersConfig,
+			CheckInterval: cfg.PeersCheckInterval,
+		})
+		peersWatcher.OnChange(h.PeersChanged)
+		go peersWatcher.Start(ctx)
+	}
+	if cfg.DryRun {
+		return dryRun(ctx, cfg, w, h)
+	}
+	defer h.RestoreGateways()
 	go func() {
-		if err := h.Start(ctx); err != nil && err != context.Canceled {
-			slog.Error("Event handler error", "error", err)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-restoreGateways:
+				slog.Info("Received signal, restoring container gateways...", "signal", syscall.SIGUSR1)
+				h.RestoreGateways()
+			}
 		}
 	}()
+
+	for _, t := range cfg.Tunnels {
+		monitor := tunnel.NewMonitor(tunnel.Config{
+			Interface:        t.Interface,
+			HandshakeTimeout: cfg.TunnelHandshakeTimeout,
+			CheckInterval:    cfg.TunnelCheckInterval,
+		})
+		monitor.OnChange(h.TunnelStateChanged)
+		if baseSetup != nil {
+			monitor.OnChange(func(previous, current tunnel.State) {
+				if !current.Up || previous.Up {
+					return
+				}
+				if err := baseSetup.InterfaceUp(current.Interface); err != nil {
+					slog.Error("Failed to apply base setup of the tunnel", "interface", current.Interface, "error", err)
+				}
+			})
+		}
+		go monitor.Start(ctx)
+	}
+
+	if cfg.SNATLabel != "" && cfg.InternalInterface != "" {
+		go h.LogSNATConnections(ctx)
+	}
+
+	if cfg.DriftCheckInterval > 0 {
+		go h.CheckDrift(ctx)
+	}
+
+	var adminServer *admin.Server
+	if cfg.AdminListen != "" {
+		adminServer = admin.NewServer(admin.Config{Listen: cfg.AdminListen, Token: cfg.AdminToken, Handler: h, Watcher: w})
+		go func() {
+			if err := adminServer.Start(ctx); err != nil {
+				slog.Error("Admin API error", "error", err)
+			}
+		}()
+	}
 	if cfg.WatchContainerLabel != "" {
 		slog.Info("Starting container watcher", "network", cfg.WatchNetwork, "label", cfg.WatchContainerLabel)
 	} else {
 		slog.Info("Starting container watcher", "network", cfg.WatchNetwork)
 	}
-	if err := w.Start(ctx); err != nil {
+	// The existing containers are handled before the daemon is reported as
+	// ready by the admin API
+	events, err := discoveryBatch(ctx, w)
+	if ctx.Err() != nil {
+		return 0
+	}
+	if err != nil {
 		slog.Error("Failed to start watcher", "error", err)
-		os.Exit(1)
+		return 1
+	}
+	h.Handle(events)
+	if adminServer != nil {
+		adminServer.SetReady(true)
 	}
+	go func() {
+		if err := h.Start(ctx); err != nil && err != context.Canceled {
+			slog.Error("Event handler error", "error", err)
+		}
+	}()
 	slog.Info("Watching for container events. Press Ctrl+C to stop.")
 	<-ctx.Done()
-	wg.Wait()
-	slog.Info("Shutdown complete")
+	return 0
+}
+
+// newHandlerConfig returns the handler configuration, with the address of
+// this container on the watched network as gateway.
+func newHandlerConfig(cfg *config.Config, gatewayAddress net.IP, portPool *portpool.Pool) handler.Config {
+	return handler.Config{
+		IptablesMangleMarkPublishedPorts: cfg.IptablesMangleMarkPublishedPorts,
+		IptablesDnatPortsLabel:           cfg.IptablesDnatPortsLabel,
+		IptablesMarkLabel:                cfg.IptablesMarkLabel,
+		EgressRoutes:                     cfg.EgressRoutes,
+		GatewayLabel:                     cfg.GatewayLabel,
+		GatewayAddress:                   gatewayAddress,
+		EgressLabel:                      cfg.EgressLabel,
+		EgressRulePriority:               cfg.EgressRulePriority,
+		TunnelInterface:                  cfg.TunnelInterface,
+		Tunnels:                          cfg.Tunnels,
+		TunnelLabel:                      cfg.TunnelLabel,
+		AllowPeersLabel:                  cfg.AllowPeersLabel,
+		NATPMPGateway:                    cfg.NATPMPGateway,
+		NATPMPLifetime:                   cfg.NATPMPLifetime,
+		Hairpin:                          cfg.Hairpin,
+		PublicAddress:                    cfg.PublicAddress,
+		InternalSubnet:                   cfg.InternalSubnet,
+		InternalInterface:                cfg.InternalInterface,
+		SNATLabel:                        cfg.SNATLabel,
+		DrainPeriod:                      cfg.DrainPeriod,
+		DrainLabel:                       cfg.DrainLabel,
+		PortPool:                         portPool,
+		StatusFile:                       cfg.StatusFile,
+		DriftCheckInterval:               cfg.DriftCheckInterval,
+		DriftRepair:                      cfg.DriftRepair,
+		KillSwitch:                       cfg.KillSwitch,
+	}
+}
+
+// dryRun prints the rule changes of the existing containers and, with
+// -dry-run-follow, of the following container events until interrupted.
+func dryRun(ctx context.Context, cfg *config.Config, w *watcher.Watcher, h *handler.Handler) int {
+	events, err := discoveryBatch(ctx, w)
+	if err != nil {
+		slog.Error("Failed to start watcher", "error", err)
+		return 1
+	}
+	slog.Info("Planning the rules of the existing containers", "containers", len(events))
+	h.Handle(events)
+	if !cfg.DryRunFollow {
+		return 0
+	}
+	slog.Info("Watching for container events. Press Ctrl+C to stop.")
+	if err := h.Start(ctx); err != nil && err != context.Canceled {
+		slog.Error("Event handler error", "error", err)
+	}
+	return 0
+}
+
+// discoveryBatch starts the watcher and returns the events of the existing
+// containers, sent as one batch before the following container events.
+func discoveryBatch(ctx context.Context, w *watcher.Watcher) ([]watcher.ContainerEvent, error) {
+	started := make(chan error, 1)
+	go func() {
+		started <- w.Start(ctx)
+	}()
+	var events []watcher.ContainerEvent
+	for {
+		select {
+		case event := <-w.Events():
+			events = append(events, event)
+			if event.Pending == 0 {
+				return events, <-started
+			}
+		case err := <-started:
+			if err != nil {
+				return nil, err
+			}
+			// the whole batch is in the channel
+			for {
+				select {
+				case event := <-w.Events():
+					events = append(events, event)
+					if event.Pending == 0 {
+						return events, nil
+					}
+				default:
+					return events, nil
+				}
+			}
+		}
+	}
+}
+
+// discoverNetwork inspects the watched network to fill in the internal subnet and
+// gateway when not configured. It returns the environment variables describing
+// the network for the startup and shutdown scripts.
+func discoverNetwork(ctx context.Context, c *client.Client, cfg *config.Config) []string {
+	network, err := c.InspectNetwork(ctx, cfg.WatchNetwork)
+	if err != nil {
+		slog.Warn("Failed to inspect watched network", "network", cfg.WatchNetwork, "error", err)
+	} else {
+		for _, ipam := range network.IPAM.Config {
+			// Only IPv4 subnets are managed
+			if ip, _, err := net.ParseCIDR(ipam.Subnet); err != nil || ip.To4() == nil {
+				continue
+			}
+			if cfg.InternalSubnet == "" {
+				cfg.InternalSubnet = ipam.Subnet
+			}
+			if cfg.InternalGateway == "" {
+				cfg.InternalGateway = ipam.Gateway
+			}
+			break
+		}
+		slog.Info("Discovered watched network", "network", network.Name, "driver", network.Driver,
+			"subnet", cfg.InternalSubnet, "gateway", cfg.InternalGateway)
+	}
+	env := []string{
+		"INTERNAL_NET_SUBNET=" + cfg.InternalSubnet,
+		"INTERNAL_NET_GW=" + cfg.InternalGateway,
+	}
+	if network != nil {
+		env = append(env, "INTERNAL_NET_DRIVER="+network.Driver)
+	}
+	return env
+}
+
+// detectInterfaces fills in the internal and tunnel interfaces when not configured.
+// It returns the environment variables with the interface names for the startup
+// and shutdown scripts.
+func detectInterfaces(cfg *config.Config) (*setup.Interfaces, []string) {
+	ifaces, err := setup.DetectInterfaces(cfg.InternalSubnet)
+	if err != nil {
+		slog.Warn("Failed to detect network interfaces", "error", err)
+		ifaces = &setup.Interfaces{}
+	}
+	if cfg.InternalInterface == "" {
+		cfg.InternalInterface = ifaces.Internal
+	}
+	if cfg.TunnelInterface == "" && len(cfg.Tunnels) > 0 {
+		cfg.TunnelInterface = cfg.Tunnels[0].Interface
+	}
+	if cfg.TunnelInterface == "" {
+		cfg.TunnelInterface = ifaces.Tunnel
+		if cfg.TunnelInterface == "" {
+			slog.Warn("No WireGuard interface found, using default", "interface", setup.DefaultTunnelInterface)
+			cfg.TunnelInterface = setup.DefaultTunnelInterface
+		}
+	}
+	if len(cfg.Tunnels) == 0 {
+		cfg.Tunnels = []config.Tunnel{{Interface: cfg.TunnelInterface}}
+	}
+	if cfg.InternalInterface == "" {
+		slog.Warn("No interface found on the watched network", "subnet", cfg.InternalSubnet)
+	}
+	slog.Info("Detected network interfaces", "internal", cfg.InternalInterface, "address", ifaces.InternalAddress, "tunnel", cfg.TunnelInterface)
+	return ifaces, []string{
+		"INTERNAL_NET_INTERFACE=" + cfg.InternalInterface,
+		"TUNNEL_INTERFACE=" + cfg.TunnelInterface,
+	}
 }
 
-// runScript executes the given script and returns any error.
-func runScript(script string) error {
+// runScript executes the given script with the additional environment
+// variables and returns any error.
+func runScript(script string, env []string) error {
 	cmd := exec.Command("/bin/sh", "-c", script)
+	cmd.Env = append(os.Environ(), env...)
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
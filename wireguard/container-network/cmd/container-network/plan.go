@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"container-network/pkg/client"
+	"container-network/pkg/compose"
+	"container-network/pkg/config"
+	"container-network/pkg/handler"
+	"container-network/pkg/portpool"
+	"container-network/pkg/setup"
+	"container-network/pkg/watcher"
+)
+
+// placeholderSubnet is the subnet of the placeholder container addresses
+// when the subnet of the watched network is not known (TEST-NET-1).
+const placeholderSubnet = "192.0.2.0/24"
+
+// plan prints the rules of the services of a compose file, as the handler
+// would apply them, and the label validation errors. It returns the exit
+// status: 1 if the file cannot be read or a label is invalid.
+func plan() int {
+	cfg, err := config.Load()
+	if err != nil {
+		slog.Error("Failed to load configuration", "error", err)
+		return 1
+	}
+	if flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s plan [OPTIONS] COMPOSE_FILE\n", config.AppName)
+		return 1
+	}
+	project, err := compose.Load(flag.Arg(0))
+	if err != nil {
+		slog.Error("Failed to read compose file", "error", err)
+		return 1
+	}
+
+	// The warnings about the containers are printed with their rules, the
+	// other logs go to stderr
+	log := &planLog{out: os.Stdout}
+	slog.SetDefault(slog.New(&planLogHandler{
+		log:  log,
+		next: slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}),
+	}))
+
+	subnet := cfg.InternalSubnet
+	if subnet == "" {
+		subnet = project.Subnets[cfg.WatchNetwork]
+	}
+	if subnet == "" {
+		subnet = placeholderSubnet
+	}
+	var reserved []string
+	for _, service := range project.Services {
+		reserved = append(reserved, service.Networks[cfg.WatchNetwork])
+	}
+	addresses, err := newPlaceholders(subnet, reserved)
+	if err != nil {
+		slog.Error("Invalid subnet of the watched network", "subnet", subnet, "error", err)
+		return 1
+	}
+	// the first address stands for this container, the gateway of the
+	// containers labelled with network.gateway=vpn
+	gatewayAddress := addresses.next()
+	if cfg.TunnelInterface == "" && len(cfg.Tunnels) > 0 {
+		cfg.TunnelInterface = cfg.Tunnels[0].Interface
+	}
+	if cfg.TunnelInterface == "" {
+		cfg.TunnelInterface = setup.DefaultTunnelInterface
+	}
+	if len(cfg.Tunnels) == 0 {
+		cfg.Tunnels = []config.Tunnel{{Interface: cfg.TunnelInterface}}
+	}
+	var portPool *portpool.Pool
+	if cfg.DNATPortPool != "" {
+		first, last, _ := portpool.ParseRange(cfg.DNATPortPool)
+		portPool, err = portpool.NewPool(portpool.Config{Min: first, Max: last, Path: cfg.PortAllocationsFile, Expiry: cfg.PortAllocationExpiry, ReadOnly: true})
+		if err != nil {
+			slog.Error("Failed to load port allocations", "error", err)
+			return 1
+		}
+	}
+
+	handlerConfig := newHandlerConfig(cfg, gatewayAddress, portPool)
+	handlerConfig.StatusFile = ""
+	handlerConfig.Plan = os.Stdout
+	h := handler.NewHandler(nil, handlerConfig)
+	w := watcher.NewWatcher(nil, watcher.Config{
+		NetworkName: cfg.WatchNetwork,
+		EnableLabel: cfg.WatchContainerLabel,
+	})
+	fmt.Fprintf(os.Stdout, "# project %s, network %s (%s), this container %s\n", project.Name, cfg.WatchNetwork, subnet, gatewayAddress)
+	for _, service := range project.Services {
+		container := client.Container{
+			ID:              placeholderID(service.ContainerName),
+			Names:           []string{"/" + service.ContainerName},
+			Labels:          service.Labels,
+			NetworkSettings: &client.NetworkSettings{Networks: make(map[string]*client.NetworkEndpoint)},
+		}
+		for network, address := range service.Networks {
+			if network == cfg.WatchNetwork && address == "" {
+				address = addresses.next().String()
+			}
+			container.NetworkSettings.Networks[network] = &client.NetworkEndpoint{IPAddress: address}
+		}
+		var ephemeral []string
+		for _, p := range service.Ports {
+			if p.HostPort == 0 {
+				ephemeral = append(ephemeral, fmt.Sprintf("%d/%s", p.ContainerPort, p.Protocol))
+				continue
+			}
+			container.Ports = append(container.Ports, client.Port{IP: p.HostIP, PrivatePort: p.ContainerPort, PublicPort: p.HostPort, Type: p.Protocol})
+		}
+		infos := w.Infos([]client.Container{container})
+		if len(infos) == 0 {
+			if _, ok := service.Networks[cfg.WatchNetwork]; !ok {
+				fmt.Fprintf(os.Stdout, "\n# service %s: not on network %s, skipped\n", service.Name, cfg.WatchNetwork)
+			} else {
+				fmt.Fprintf(os.Stdout, "\n# service %s: no %s=true label, skipped\n", service.Name, cfg.WatchContainerLabel)
+			}
+			continue
+		}
+		info := infos[0]
+		fmt.Fprintf(os.Stdout, "\n# service %s: container %s, %s\n", service.Name, info.Name, info.IPAddress)
+		if len(ephemeral) > 0 {
+			fmt.Fprintf(os.Stdout, "# ports %s published on a host port picked by the runtime, not planned\n", strings.Join(ephemeral, ", "))
+		}
+		h.Handle([]watcher.ContainerEvent{{Type: watcher.ContainerStarted, Container: info, Timestamp: time.Now()}})
+	}
+	if log.errors > 0 {
+		fmt.Fprintf(os.Stdout, "\n# %d label error(s)\n", log.errors)
+		return 1
+	}
+	return 0
+}
+
+// placeholders allocates the placeholder addresses of the containers.
+type placeholders struct {
+	subnet   *net.IPNet
+	last     net.IP
+	reserved map[string]bool
+}
+
+// newPlaceholders returns the placeholder addresses of a subnet, skipping
+// the first one (the gateway of the network) and the reserved ones.
+func newPlaceholders(subnet string, reserved []string) (*placeholders, error) {
+	ip, ipnet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("not an IPv4 subnet")
+	}
+	p := &placeholders{subnet: ipnet, last: ipnet.IP.To4(), reserved: make(map[string]bool)}
+	for _, address := range reserved {
+		p.reserved[address] = true
+	}
+	p.reserved[p.next().String()] = true
+	return p, nil
+}
+
+// next returns the next free address of the subnet, or the unspecified
+// address when the subnet is exhausted.
+func (p *placeholders) next() net.IP {
+	for {
+		ip := make(net.IP, 4)
+		copy(ip, p.last)
+		for i := 3; i >= 0; i-- {
+			ip[i]++
+			if ip[i] != 0 {
+				break
+			}
+		}
+		p.last = ip
+		if !p.subnet.Contains(ip) {
+			return net.IPv4zero
+		}
+		if !p.reserved[ip.String()] {
+			return ip
+		}
+	}
+}
+
+// placeholderID returns a container ID derived from the container name.
+func placeholderID(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:])
+}
+
+// planLog counts the problems of the containers printed with the rules.
+type planLog struct {
+	out    io.Writer
+	errors int
+	mu     sync.Mutex
+}
+
+// planLogHandler prints the warnings and errors about a container as
+// comments of the plan and passes the others to the next handler.
+type planLogHandler struct {
+	log   *planLog
+	next  slog.Handler
+	attrs []slog.Attr
+}
+
+func (h *planLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= slog.LevelWarn
+}
+
+func (h *planLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	var container string
+	var details []string
+	add := func(a slog.Attr) bool {
+		switch a.Key {
+		case "container":
+			container = a.Value.String()
+		case "containerID", "timestamp", "ip":
+		default:
+			value := a.Value.String()
+			if strings.ContainsAny(value, " \"=") {
+				value = strconv.Quote(value)
+			}
+			details = append(details, a.Key+"="+value)
+		}
+		return true
+	}
+	for _, a := range h.attrs {
+		add(a)
+	}
+	r.Attrs(add)
+	if container == "" {
+		return h.next.Handle(ctx, r)
+	}
+	h.log.mu.Lock()
+	defer h.log.mu.Unlock()
+	h.log.errors++
+	line := "# " + r.Level.String() + " " + container + ": " + r.Message
+	if len(details) > 0 {
+		line += " (" + strings.Join(details, " ") + ")"
+	}
+	_, err := fmt.Fprintln(h.log.out, line)
+	return err
+}
+
+func (h *planLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &planLogHandler{
+		log:   h.log,
+		next:  h.next.WithAttrs(attrs),
+		attrs: append(append([]slog.Attr{}, h.attrs...), attrs...),
+	}
+}
+
+func (h *planLogHandler) WithGroup(name string) slog.Handler {
+	return &planLogHandler{log: h.log, next: h.next.WithGroup(name), attrs: h.attrs}
+}
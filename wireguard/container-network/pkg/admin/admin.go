@@ -0,0 +1,263 @@
+// Package admin serves the state of the daemon as JSON over HTTP, on a unix
+// socket or a TCP address, and requests it for the commands.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"container-network/pkg/handler"
+	"container-network/pkg/watcher"
+)
+
+// Config contains admin API configuration.
+type Config struct {
+	// Listen is a unix socket path, absolute or with the "unix:" prefix, or a
+	// TCP address (e.g. 127.0.0.1:9180).
+	Listen string
+	// Token is the bearer token required by the endpoints other than
+	// /healthz and /readyz, if set.
+	Token   string
+	Handler *handler.Handler
+	Watcher *watcher.Watcher
+}
+
+// Container is a running watched container with the state of its rules.
+type Container struct {
+	ID      string            `json:"id"`
+	Name    string            `json:"name"`
+	IP      string            `json:"ip"`
+	Network string            `json:"network"`
+	Pid     int               `json:"pid,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	// Published are the ports published on the host.
+	Published []PublishedPort `json:"published,omitempty"`
+	// Status is unset for the containers not handled yet.
+	Status *handler.ContainerStatus `json:"status,omitempty"`
+}
+
+// PublishedPort is a port of a container published on the host.
+type PublishedPort struct {
+	HostIP        string `json:"hostIP,omitempty"`
+	HostPort      uint16 `json:"hostPort"`
+	ContainerPort uint16 `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+}
+
+// Rule is a rule of a container.
+type Rule struct {
+	Container string `json:"container"`
+	ID        string `json:"id"`
+	Kind      string `json:"kind"`
+	// Rule is in the format "-t <table> <chain> <spec>".
+	Rule string `json:"rule"`
+}
+
+// Rules are the rules of the containers and the failed rule changes.
+type Rules struct {
+	Rules   []Rule                `json:"rules"`
+	Retries []handler.RetryStatus `json:"retries,omitempty"`
+}
+
+// Server is the admin API server.
+type Server struct {
+	config Config
+	// ready is set once the rules of the existing containers are applied
+	ready atomic.Bool
+}
+
+// NewServer creates a new admin API server.
+func NewServer(config Config) *Server {
+	return &Server{config: config}
+}
+
+// SetReady sets whether /readyz reports the daemon as ready.
+func (s *Server) SetReady(ready bool) {
+	s.ready.Store(ready)
+}
+
+// ParseListen returns the network ("unix" or "tcp") and the address of a
+// listen value.
+func ParseListen(listen string) (string, string) {
+	if path, ok := strings.CutPrefix(listen, "unix:"); ok {
+		return "unix", path
+	}
+	if strings.HasPrefix(listen, "/") {
+		return "unix", listen
+	}
+	return "tcp", listen
+}
+
+// Start serves the API until the context is done. A unix socket is created
+// with mode 0660, replacing a stale one, and removed on return.
+func (s *Server) Start(ctx context.Context) error {
+	network, address := ParseListen(s.config.Listen)
+	if network == "unix" {
+		if err := os.MkdirAll(filepath.Dir(address), 0o755); err != nil {
+			return err
+		}
+		if err := os.Remove(address); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	if network == "unix" {
+		defer os.Remove(address)
+		if err := os.Chmod(address, 0o660); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !s.ready.Load() {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "not ready"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+	})
+	mux.HandleFunc("GET /containers", s.authorized(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.containers())
+	}))
+	mux.HandleFunc("GET /rules", s.authorized(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.rules())
+	}))
+	mux.HandleFunc("GET /events", s.authorized(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.config.Handler.History())
+	}))
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	slog.Info("Admin API listening", "network", network, "address", address)
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// authorized wraps an endpoint requiring the bearer token of the
+// configuration, if set.
+func (s *Server) authorized(handle http.HandlerFunc) http.HandlerFunc {
+	if s.config.Token == "" {
+		return handle
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.config.Token)) != 1 {
+			slog.Debug("Unauthorized admin API request", "path", r.URL.Path, "remote", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		handle(w, r)
+	}
+}
+
+// containers returns the known containers of the watcher with the state of
+// their rules, sorted by name.
+func (s *Server) containers() []Container {
+	statuses := make(map[string]handler.ContainerStatus)
+	for _, cs := range s.config.Handler.Status().Containers {
+		statuses[cs.ID] = cs
+	}
+	containers := []Container{}
+	for _, info := range s.config.Watcher.KnownContainers() {
+		c := Container{
+			ID:      info.ID,
+			Name:    info.Name,
+			IP:      info.IPAddress,
+			Network: info.NetworkName,
+			Pid:     info.Pid,
+			Labels:  info.Labels,
+		}
+		for _, p := range info.Ports {
+			c.Published = append(c.Published, PublishedPort{HostIP: p.HostIP, HostPort: p.HostPort, ContainerPort: p.ContainerPort, Protocol: p.Protocol})
+		}
+		if cs, ok := statuses[info.ID]; ok {
+			c.Status = &cs
+		}
+		containers = append(containers, c)
+	}
+	sort.Slice(containers, func(i, j int) bool {
+		return containers[i].Name < containers[j].Name
+	})
+	return containers
+}
+
+// rules returns the rules of the containers and the failed rule changes.
+func (s *Server) rules() Rules {
+	status := s.config.Handler.Status()
+	rules := Rules{Rules: []Rule{}, Retries: status.Retries}
+	for _, cs := range status.Containers {
+		for _, r := range cs.Rules {
+			rules.Rules = append(rules.Rules, Rule{Container: cs.Name, ID: cs.ID, Kind: r.Kind, Rule: r.Rule})
+		}
+	}
+	return rules
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		slog.Debug("Failed to write admin API response", "error", err)
+	}
+}
+
+// Get requests an endpoint of the admin API listening on listen, with the
+// bearer token if set, and decodes its JSON response into v.
+func Get(ctx context.Context, listen, token, path string, v any) error {
+	network, address := ParseListen(listen)
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, address)
+			},
+		},
+		Timeout: 10 * time.Second,
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://admin"+path, nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("%s: %s: %s", path, response.Status, strings.Join(strings.Fields(string(body)), " "))
+	}
+	return json.NewDecoder(response.Body).Decode(v)
+}
@@ -111,6 +111,27 @@ type ContainerConfig struct {
 	ExposedPorts map[string]struct{} `json:"ExposedPorts"`
 }
 
+// NetworkInspect contains detailed network information.
+type NetworkInspect struct {
+	ID     string `json:"Id"`
+	Name   string `json:"Name"`
+	Driver string `json:"Driver"`
+	IPAM   IPAM   `json:"IPAM"`
+}
+
+// IPAM contains the IP address management configuration of a network.
+type IPAM struct {
+	Driver string       `json:"Driver"`
+	Config []IPAMConfig `json:"Config"`
+}
+
+// IPAMConfig represents a subnet of a network.
+type IPAMConfig struct {
+	Subnet  string `json:"Subnet"`
+	IPRange string `json:"IPRange,omitempty"`
+	Gateway string `json:"Gateway,omitempty"`
+}
+
 // Option is a functional option for configuring the client.
 type Option func(*Client)
 
@@ -244,6 +265,15 @@ func (c *Client) InspectContainer(ctx context.Context, containerID string) (*Con
 	return &inspect, nil
 }
 
+// InspectNetwork returns detailed information about a network (by name or ID).
+func (c *Client) InspectNetwork(ctx context.Context, networkID string) (*NetworkInspect, error) {
+	var inspect NetworkInspect
+	if err := c.doQuery(ctx, "GET", "/networks/"+url.PathEscape(networkID), nil, &inspect); err != nil {
+		return nil, err
+	}
+	return &inspect, nil
+}
+
 // Events streams container events.
 // Filters can be used to narrow down the events (e.g., by type, event, container).
 func (c *Client) Events(ctx context.Context, filters map[string][]string) (<-chan Event, <-chan error) {
@@ -0,0 +1,296 @@
+// Package compose reads the services of a compose file (labels, published
+// ports and networks) to plan their rules before they are deployed.
+package compose
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Port is a published port of a service.
+type Port struct {
+	HostIP string
+	// HostPort is 0 when the runtime picks the host port
+	HostPort      uint16
+	ContainerPort uint16
+	Protocol      string
+}
+
+// Service is a service of a compose file, as its container is seen by the
+// container runtime.
+type Service struct {
+	Name string
+	// ContainerName is the container_name of the service, by default
+	// <project>-<service>-1
+	ContainerName string
+	Labels        map[string]string
+	Ports         []Port
+	// Networks are the runtime names of the networks of the container, with
+	// their ipv4_address if given
+	Networks map[string]string
+}
+
+// Project is the content of a compose file.
+type Project struct {
+	Name string
+	// Services are sorted by name.
+	Services []Service
+	// Subnets are the IPv4 subnets given in the IPAM configuration of the
+	// networks, by runtime name.
+	Subnets map[string]string
+}
+
+// Load reads a compose file. The project name is the top-level name or the
+// name of the directory of the file. Variables are not interpolated.
+func Load(path string) (*Project, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	project, err := Parse(data, filepath.Base(dir))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return project, nil
+}
+
+// Parse parses the content of a compose file, with name as the default
+// project name.
+func Parse(data []byte, name string) (*Project, error) {
+	document, err := parseYAML(data)
+	if err != nil {
+		return nil, err
+	}
+	root, ok := document.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("not a compose file: expected a mapping")
+	}
+	if value := str(root["name"]); value != "" {
+		name = value
+	}
+	project := &Project{Name: projectName(name), Subnets: make(map[string]string)}
+
+	// runtime names of the networks, by key
+	networks := make(map[string]string)
+	definitions, _ := root["networks"].(map[string]any)
+	for key, value := range definitions {
+		network, _ := value.(map[string]any)
+		networks[key] = project.Name + "_" + key
+		if str(network["external"]) == "true" {
+			networks[key] = key
+		}
+		if value := str(network["name"]); value != "" {
+			networks[key] = value
+		}
+		ipam, _ := network["ipam"].(map[string]any)
+		configs, _ := ipam["config"].([]any)
+		for _, config := range configs {
+			config, _ := config.(map[string]any)
+			if subnet := str(config["subnet"]); strings.Contains(subnet, ".") {
+				project.Subnets[networks[key]] = subnet
+				break
+			}
+		}
+	}
+	networkName := func(key string) string {
+		if name, ok := networks[key]; ok {
+			return name
+		}
+		return project.Name + "_" + key
+	}
+
+	services, ok := root["services"].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("not a compose file: no services")
+	}
+	for serviceName, value := range services {
+		definition, ok := value.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("service %s: expected a mapping", serviceName)
+		}
+		service := Service{
+			Name:          serviceName,
+			ContainerName: str(definition["container_name"]),
+			Networks:      make(map[string]string),
+		}
+		if service.ContainerName == "" {
+			service.ContainerName = project.Name + "-" + serviceName + "-1"
+		}
+		if service.Labels, err = parseLabels(definition["labels"]); err != nil {
+			return nil, fmt.Errorf("service %s: %w", serviceName, err)
+		}
+		if service.Ports, err = parsePorts(definition["ports"]); err != nil {
+			return nil, fmt.Errorf("service %s: %w", serviceName, err)
+		}
+		switch mode := str(definition["network_mode"]); {
+		case strings.HasPrefix(mode, "service:") || strings.HasPrefix(mode, "container:"):
+			// shares the network namespace of another container
+		case mode != "":
+			service.Networks[mode] = ""
+		default:
+			switch list := definition["networks"].(type) {
+			case nil:
+				service.Networks[networkName("default")] = ""
+			case []any:
+				for _, key := range list {
+					service.Networks[networkName(str(key))] = ""
+				}
+			case map[string]any:
+				for key, value := range list {
+					network, _ := value.(map[string]any)
+					service.Networks[networkName(key)] = str(network["ipv4_address"])
+				}
+			default:
+				return nil, fmt.Errorf("service %s: invalid networks", serviceName)
+			}
+		}
+		project.Services = append(project.Services, service)
+	}
+	sort.Slice(project.Services, func(i, j int) bool {
+		return project.Services[i].Name < project.Services[j].Name
+	})
+	return project, nil
+}
+
+// projectName normalizes a project name as the container runtime tools do:
+// lowercase letters, digits, dashes and underscores.
+func projectName(name string) string {
+	var b strings.Builder
+	for _, c := range strings.ToLower(name) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' {
+			b.WriteRune(c)
+		}
+	}
+	return strings.TrimLeft(b.String(), "-_")
+}
+
+// parseLabels parses labels given as a mapping or as a list of key=value.
+func parseLabels(value any) (map[string]string, error) {
+	labels := make(map[string]string)
+	switch list := value.(type) {
+	case nil:
+	case map[string]any:
+		for key, value := range list {
+			labels[key] = str(value)
+		}
+	case []any:
+		for _, item := range list {
+			key, value, _ := strings.Cut(str(item), "=")
+			labels[key] = value
+		}
+	default:
+		return nil, fmt.Errorf("invalid labels")
+	}
+	return labels, nil
+}
+
+// parsePorts parses published ports in the short syntax
+// ([host_ip:][host_port:]container_port[/protocol], with port ranges) or the
+// long syntax (target, published, protocol, host_ip).
+func parsePorts(value any) ([]Port, error) {
+	list, ok := value.([]any)
+	if value != nil && !ok {
+		return nil, fmt.Errorf("invalid ports")
+	}
+	var ports []Port
+	for _, item := range list {
+		var hostIP, published, target, protocol string
+		if long, ok := item.(map[string]any); ok {
+			hostIP, published, target, protocol = str(long["host_ip"]), str(long["published"]), str(long["target"]), str(long["protocol"])
+		} else {
+			var err error
+			if hostIP, published, target, protocol, err = splitPort(str(item)); err != nil {
+				return nil, err
+			}
+		}
+		if protocol == "" {
+			protocol = "tcp"
+		}
+		targetMin, targetMax, err := parsePortRange(target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %v: %w", item, err)
+		}
+		var publishedMin, publishedMax uint16
+		if published != "" {
+			if publishedMin, publishedMax, err = parsePortRange(published); err != nil {
+				return nil, fmt.Errorf("invalid port %v: %w", item, err)
+			}
+		}
+		count := targetMax - targetMin
+		if published != "" && publishedMax-publishedMin != count {
+			if count > 0 {
+				return nil, fmt.Errorf("invalid port %v: port ranges of different sizes", item)
+			}
+			// the runtime picks a port of the published range
+			published = ""
+		}
+		for i := uint16(0); i <= count; i++ {
+			port := Port{HostIP: hostIP, ContainerPort: targetMin + i, Protocol: strings.ToLower(protocol)}
+			if published != "" {
+				port.HostPort = publishedMin + i
+			}
+			ports = append(ports, port)
+		}
+	}
+	return ports, nil
+}
+
+// splitPort splits a port in the short syntax.
+func splitPort(value string) (hostIP, published, target, protocol string, err error) {
+	value, protocol, _ = strings.Cut(value, "/")
+	if strings.HasPrefix(value, "[") {
+		end := strings.Index(value, "]:")
+		if end < 0 {
+			return "", "", "", "", fmt.Errorf("invalid port %s", value)
+		}
+		hostIP, value = value[1:end], value[end+2:]
+	}
+	parts := strings.Split(value, ":")
+	switch {
+	case len(parts) == 1:
+		target = parts[0]
+	case len(parts) == 2:
+		published, target = parts[0], parts[1]
+	case len(parts) == 3 && hostIP == "":
+		hostIP, published, target = parts[0], parts[1], parts[2]
+	default:
+		return "", "", "", "", fmt.Errorf("invalid port %s", value)
+	}
+	return hostIP, published, target, protocol, nil
+}
+
+// parsePortRange parses a port or a port range in the format "min-max".
+func parsePortRange(value string) (uint16, uint16, error) {
+	minValue, maxValue, isRange := strings.Cut(value, "-")
+	first, err := strconv.ParseUint(minValue, 10, 16)
+	if err != nil || first == 0 {
+		return 0, 0, fmt.Errorf("invalid port number %q", minValue)
+	}
+	if !isRange {
+		return uint16(first), uint16(first), nil
+	}
+	last, err := strconv.ParseUint(maxValue, 10, 16)
+	if err != nil || last < first {
+		return 0, 0, fmt.Errorf("invalid port range %q", value)
+	}
+	return uint16(first), uint16(last), nil
+}
+
+// str returns a scalar as a string, null as the empty string.
+func str(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,197 @@
+package compose
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitPort(t *testing.T) {
+	tests := []struct {
+		value                               string
+		hostIP, published, target, protocol string
+		err                                 bool
+	}{
+		{value: "80", target: "80"},
+		{value: "8080:80", published: "8080", target: "80"},
+		{value: "8080:80/udp", published: "8080", target: "80", protocol: "udp"},
+		{value: "127.0.0.1:8080:80", hostIP: "127.0.0.1", published: "8080", target: "80"},
+		{value: "127.0.0.1::80", hostIP: "127.0.0.1", target: "80"},
+		{value: "[::1]:8080:80/tcp", hostIP: "::1", published: "8080", target: "80", protocol: "tcp"},
+		{value: "9000-9001:9000-9001", published: "9000-9001", target: "9000-9001"},
+		{value: "[::1]80", err: true},
+		{value: "[::1]:1:8080:80", err: true},
+		{value: "1.2.3.4:1:8080:80", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			hostIP, published, target, protocol, err := splitPort(tt.value)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("got no error, want one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{hostIP, published, target, protocol}
+			want := []string{tt.hostIP, tt.published, tt.target, tt.protocol}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestParsePorts(t *testing.T) {
+	tests := []struct {
+		name  string
+		value any
+		want  []Port
+		err   string
+	}{
+		{
+			name:  "none",
+			value: nil,
+		},
+		{
+			name:  "short syntax",
+			value: []any{"80", "8443:443/UDP", "127.0.0.1:8080:8080"},
+			want: []Port{
+				{ContainerPort: 80, Protocol: "tcp"},
+				{HostPort: 8443, ContainerPort: 443, Protocol: "udp"},
+				{HostIP: "127.0.0.1", HostPort: 8080, ContainerPort: 8080, Protocol: "tcp"},
+			},
+		},
+		{
+			name:  "ranges",
+			value: []any{"9000-9002:8000-8002"},
+			want: []Port{
+				{HostPort: 9000, ContainerPort: 8000, Protocol: "tcp"},
+				{HostPort: 9001, ContainerPort: 8001, Protocol: "tcp"},
+				{HostPort: 9002, ContainerPort: 8002, Protocol: "tcp"},
+			},
+		},
+		{
+			name:  "published range picked by the runtime",
+			value: []any{"9000-9010:80"},
+			want:  []Port{{ContainerPort: 80, Protocol: "tcp"}},
+		},
+		{
+			name: "long syntax",
+			value: []any{
+				map[string]any{"target": "80", "published": "8080", "protocol": "udp", "host_ip": "10.0.0.1"},
+				map[string]any{"target": "443"},
+			},
+			want: []Port{
+				{HostIP: "10.0.0.1", HostPort: 8080, ContainerPort: 80, Protocol: "udp"},
+				{ContainerPort: 443, Protocol: "tcp"},
+			},
+		},
+		{
+			name:  "ranges of different sizes",
+			value: []any{"9000-9001:8000-8002"},
+			err:   "port ranges of different sizes",
+		},
+		{
+			name:  "invalid target",
+			value: []any{"8080:http"},
+			err:   `invalid port number "http"`,
+		},
+		{
+			name:  "port zero",
+			value: []any{"0"},
+			err:   `invalid port number "0"`,
+		},
+		{
+			name:  "reversed range",
+			value: []any{"8002-8000"},
+			err:   `invalid port range "8002-8000"`,
+		},
+		{
+			name:  "not a list",
+			value: "80:80",
+			err:   "invalid ports",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ports, err := parsePorts(tt.value)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(ports, tt.want) {
+				t.Errorf("got %+v, want %+v", ports, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	data := `
+name: My_App
+networks:
+  front:
+    ipam:
+      config:
+        - subnet: fd00::/64
+        - subnet: 172.30.0.0/24
+  shared:
+    external: true
+services:
+  web:
+    labels:
+      network.dnat.ports: "80,443"
+    ports:
+      - "8080:80"
+    networks:
+      front:
+        ipv4_address: 172.30.0.10
+      shared:
+  worker:
+    container_name: worker
+    labels:
+      - network.egress=vpn
+  sidecar:
+    network_mode: service:web
+`
+	project, err := Parse([]byte(data), "ignored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Project{
+		Name:    "my_app",
+		Subnets: map[string]string{"my_app_front": "172.30.0.0/24"},
+		Services: []Service{
+			{
+				Name:          "sidecar",
+				ContainerName: "my_app-sidecar-1",
+				Labels:        map[string]string{},
+				Networks:      map[string]string{},
+			},
+			{
+				Name:          "web",
+				ContainerName: "my_app-web-1",
+				Labels:        map[string]string{"network.dnat.ports": "80,443"},
+				Ports:         []Port{{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}},
+				Networks:      map[string]string{"my_app_front": "172.30.0.10", "shared": ""},
+			},
+			{
+				Name:          "worker",
+				ContainerName: "worker",
+				Labels:        map[string]string{"network.egress": "vpn"},
+				Networks:      map[string]string{"my_app_default": ""},
+			},
+		},
+	}
+	if !reflect.DeepEqual(project, want) {
+		t.Errorf("got %+v, want %+v", project, want)
+	}
+}
@@ -0,0 +1,506 @@
+package compose
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The subset of YAML used by compose files: block mappings and sequences,
+// single line flow collections, plain and quoted scalars, literal and folded
+// block scalars, anchors, aliases and merge keys. Scalars are returned as
+// strings (null as nil), mappings as map[string]any and sequences as []any.
+
+// yamlLine is a non empty line of a YAML document.
+type yamlLine struct {
+	number int
+	indent int
+	// text is the line without indentation and comment, raw without
+	// indentation only (for block scalars)
+	text string
+	raw  string
+}
+
+type yamlParser struct {
+	lines   []yamlLine
+	pos     int
+	anchors map[string]any
+}
+
+// parseYAML parses the first document of a YAML file.
+func parseYAML(data []byte) (any, error) {
+	p := &yamlParser{anchors: make(map[string]any)}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		text := strings.TrimLeft(line, " ")
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed in indentation", i+1)
+		}
+		if text == "---" {
+			if len(p.lines) > 0 {
+				break
+			}
+			continue
+		}
+		if text == "..." {
+			break
+		}
+		l := yamlLine{number: i + 1, indent: len(line) - len(text), raw: text}
+		l.text = stripComment(text)
+		// blank lines are kept for the block scalars, comment lines are not
+		if l.text == "" && l.raw != "" {
+			continue
+		}
+		p.lines = append(p.lines, l)
+	}
+	if len(p.lines) == 0 {
+		return nil, nil
+	}
+	value, err := p.parseBlock(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.skipBlank(); p.pos < len(p.lines) {
+		return nil, p.errorf("unexpected indentation")
+	}
+	return value, nil
+}
+
+// stripComment removes the comment of a line, outside of quoted scalars.
+func stripComment(text string) string {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && (i == 0 || strings.IndexByte(" [{,:-", text[i-1]) >= 0):
+			quote = c
+		case c == '#' && (i == 0 || text[i-1] == ' '):
+			return strings.TrimRight(text[:i], " ")
+		}
+	}
+	return text
+}
+
+func (p *yamlParser) errorf(format string, args ...any) error {
+	number := 0
+	if p.pos < len(p.lines) {
+		number = p.lines[p.pos].number
+	} else if len(p.lines) > 0 {
+		number = p.lines[len(p.lines)-1].number
+	}
+	return fmt.Errorf("line %d: %s", number, fmt.Sprintf(format, args...))
+}
+
+// skipBlank skips the blank lines outside of block scalars.
+func (p *yamlParser) skipBlank() {
+	for p.pos < len(p.lines) && p.lines[p.pos].text == "" {
+		p.pos++
+	}
+}
+
+// parseBlock parses the mapping or sequence starting at the current line.
+func (p *yamlParser) parseBlock(minIndent int) (any, error) {
+	p.skipBlank()
+	if p.pos >= len(p.lines) || p.lines[p.pos].indent < minIndent {
+		return nil, nil
+	}
+	l := p.lines[p.pos]
+	if isSequenceItem(l.text) {
+		return p.parseSequence(l.indent)
+	}
+	if _, _, ok := splitKey(l.text); ok {
+		return p.parseMapping(l.indent)
+	}
+	// a scalar alone
+	p.pos++
+	return p.parseValue(l.text, l.indent-1)
+}
+
+func (p *yamlParser) parseMapping(indent int) (any, error) {
+	m := make(map[string]any)
+	var merges []any
+	for p.skipBlank(); p.pos < len(p.lines); p.skipBlank() {
+		l := p.lines[p.pos]
+		if l.indent < indent || (l.indent == indent && isSequenceItem(l.text)) {
+			break
+		}
+		if l.indent > indent {
+			return nil, p.errorf("unexpected indentation")
+		}
+		key, rest, ok := splitKey(l.text)
+		if !ok {
+			return nil, p.errorf("expected a mapping key")
+		}
+		p.pos++
+		var value any
+		var err error
+		if rest == "" {
+			// nested block, sequences may have the indentation of the key
+			p.skipBlank()
+			if p.pos < len(p.lines) && (p.lines[p.pos].indent > indent ||
+				(p.lines[p.pos].indent == indent && isSequenceItem(p.lines[p.pos].text))) {
+				value, err = p.parseBlock(indent)
+			}
+		} else {
+			value, err = p.parseValue(rest, indent)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if key == "<<" {
+			merges = append(merges, value)
+			continue
+		}
+		m[key] = value
+	}
+	for _, merge := range merges {
+		list, ok := merge.([]any)
+		if !ok {
+			list = []any{merge}
+		}
+		for _, item := range list {
+			values, ok := item.(map[string]any)
+			if !ok {
+				return nil, p.errorf("merge key value is not a mapping")
+			}
+			for key, value := range values {
+				if _, ok := m[key]; !ok {
+					m[key] = value
+				}
+			}
+		}
+	}
+	return m, nil
+}
+
+func (p *yamlParser) parseSequence(indent int) (any, error) {
+	list := []any{}
+	for p.skipBlank(); p.pos < len(p.lines); p.skipBlank() {
+		l := p.lines[p.pos]
+		if l.indent != indent || !isSequenceItem(l.text) {
+			if l.indent > indent {
+				return nil, p.errorf("unexpected indentation")
+			}
+			break
+		}
+		rest := strings.TrimLeft(l.text[1:], " ")
+		if rest == "" {
+			p.pos++
+			value, err := p.parseBlock(indent + 1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+			continue
+		}
+		if _, _, ok := splitKey(rest); ok || isSequenceItem(rest) {
+			// compact nested block: continue as if it started on its own line
+			offset := len(l.text) - len(rest)
+			p.lines[p.pos] = yamlLine{number: l.number, indent: indent + offset, text: rest, raw: rest}
+			value, err := p.parseBlock(indent + 1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+			continue
+		}
+		p.pos++
+		value, err := p.parseValue(rest, indent)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, value)
+	}
+	return list, nil
+}
+
+// parseValue parses the value following a mapping key or a sequence item
+// indicator on the previous line. Nested blocks are indented more than
+// indent.
+func (p *yamlParser) parseValue(text string, indent int) (any, error) {
+	number := p.lines[p.pos-1].number
+	if strings.HasPrefix(text, "&") {
+		name, rest, _ := strings.Cut(text[1:], " ")
+		rest = strings.TrimSpace(rest)
+		var value any
+		var err error
+		if rest == "" {
+			value, err = p.parseBlock(indent + 1)
+		} else {
+			value, err = p.parseValue(rest, indent)
+		}
+		if err != nil {
+			return nil, err
+		}
+		p.anchors[name] = value
+		return value, nil
+	}
+	if strings.HasPrefix(text, "*") {
+		value, ok := p.anchors[text[1:]]
+		if !ok {
+			return nil, fmt.Errorf("line %d: unknown alias %s", number, text)
+		}
+		return value, nil
+	}
+	if text[0] == '|' || text[0] == '>' {
+		return p.parseBlockScalar(text, indent)
+	}
+	if text[0] == '[' || text[0] == '{' {
+		f := &flowParser{text: text}
+		value, err := f.parseValue()
+		if err == nil {
+			if f.skipSpaces(); f.pos < len(f.text) {
+				err = fmt.Errorf("unexpected %q after flow collection", f.text[f.pos:])
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", number, err)
+		}
+		return value, nil
+	}
+	value, err := parseScalar(text)
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %v", number, err)
+	}
+	return value, nil
+}
+
+// parseBlockScalar parses a literal (|) or folded (>) block scalar whose
+// lines are indented more than indent.
+func (p *yamlParser) parseBlockScalar(header string, indent int) (any, error) {
+	chomping := strings.TrimLeft(header[1:], "0123456789")
+	var lines []string
+	content := -1
+	for ; p.pos < len(p.lines); p.pos++ {
+		l := p.lines[p.pos]
+		if l.raw == "" {
+			lines = append(lines, "")
+			continue
+		}
+		if l.indent <= indent {
+			break
+		}
+		if content < 0 {
+			content = l.indent
+		}
+		if l.indent < content {
+			break
+		}
+		lines = append(lines, strings.Repeat(" ", l.indent-content)+l.raw)
+	}
+	// trailing blank lines belong to the following block
+	trailing := 0
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+		trailing++
+	}
+	p.pos -= trailing
+	var value string
+	if header[0] == '|' {
+		value = strings.Join(lines, "\n")
+	} else {
+		for i, line := range lines {
+			switch {
+			case i == 0:
+			case line == "":
+				value += "\n"
+			case lines[i-1] == "":
+				// the line break before blank lines is dropped
+			default:
+				value += " "
+			}
+			value += line
+		}
+	}
+	switch {
+	case strings.HasPrefix(chomping, "-") || value == "":
+	case strings.HasPrefix(chomping, "+"):
+		value += strings.Repeat("\n", trailing+1)
+	default:
+		value += "\n"
+	}
+	return value, nil
+}
+
+// isSequenceItem returns true if a line starts with a sequence item
+// indicator.
+func isSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// splitKey splits a mapping entry into its key and value.
+func splitKey(text string) (string, string, bool) {
+	if text == "" || strings.IndexByte("[{&*|>", text[0]) >= 0 {
+		return "", "", false
+	}
+	if text[0] == '"' || text[0] == '\'' {
+		end := quotedEnd(text)
+		if end < 0 || end >= len(text) || text[end] != ':' || (end+1 < len(text) && text[end+1] != ' ') {
+			return "", "", false
+		}
+		key, err := parseScalar(text[:end])
+		if err != nil {
+			return "", "", false
+		}
+		s, _ := key.(string)
+		return s, strings.TrimSpace(text[end+1:]), true
+	}
+	for i := 0; i < len(text); i++ {
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+			return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// quotedEnd returns the position following the quoted scalar at the start of
+// text, or -1 if it is not terminated.
+func quotedEnd(text string) int {
+	quote := text[0]
+	for i := 1; i < len(text); i++ {
+		switch {
+		case quote == '"' && text[i] == '\\':
+			i++
+		case text[i] == quote && quote == '\'' && i+1 < len(text) && text[i+1] == '\'':
+			i++
+		case text[i] == quote:
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// parseScalar parses a plain or quoted scalar.
+func parseScalar(text string) (any, error) {
+	text = strings.TrimSpace(text)
+	if text == "" || text == "~" || text == "null" || text == "Null" || text == "NULL" {
+		return nil, nil
+	}
+	switch text[0] {
+	case '"':
+		if quotedEnd(text) != len(text) {
+			return nil, fmt.Errorf("invalid quoted scalar %s", text)
+		}
+		value, err := strconv.Unquote(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quoted scalar %s", text)
+		}
+		return value, nil
+	case '\'':
+		if quotedEnd(text) != len(text) {
+			return nil, fmt.Errorf("invalid quoted scalar %s", text)
+		}
+		return strings.ReplaceAll(text[1:len(text)-1], "''", "'"), nil
+	}
+	return text, nil
+}
+
+// flowParser parses a flow collection ([a, b] or {a: b}) on a single line.
+type flowParser struct {
+	text string
+	pos  int
+}
+
+func (f *flowParser) skipSpaces() {
+	for f.pos < len(f.text) && f.text[f.pos] == ' ' {
+		f.pos++
+	}
+}
+
+func (f *flowParser) parseValue() (any, error) {
+	f.skipSpaces()
+	if f.pos >= len(f.text) {
+		return nil, fmt.Errorf("unterminated flow collection")
+	}
+	switch f.text[f.pos] {
+	case '[':
+		return f.parseCollection(']')
+	case '{':
+		return f.parseCollection('}')
+	}
+	return f.parseScalar(",]}")
+}
+
+// parseCollection parses a flow sequence or mapping ending with end.
+func (f *flowParser) parseCollection(end byte) (any, error) {
+	f.pos++
+	list := []any{}
+	m := make(map[string]any)
+	for {
+		f.skipSpaces()
+		if f.pos < len(f.text) && f.text[f.pos] == end {
+			f.pos++
+			break
+		}
+		if end == ']' {
+			value, err := f.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		} else {
+			key, err := f.parseScalar(",:}")
+			if err != nil {
+				return nil, err
+			}
+			var value any
+			if f.skipSpaces(); f.pos < len(f.text) && f.text[f.pos] == ':' {
+				f.pos++
+				if value, err = f.parseValue(); err != nil {
+					return nil, err
+				}
+			}
+			s, _ := key.(string)
+			m[s] = value
+		}
+		f.skipSpaces()
+		if f.pos >= len(f.text) {
+			return nil, fmt.Errorf("unterminated flow collection")
+		}
+		switch f.text[f.pos] {
+		case ',':
+			f.pos++
+		case end:
+		default:
+			return nil, fmt.Errorf("expected , or %c in flow collection", end)
+		}
+	}
+	if end == ']' {
+		return list, nil
+	}
+	return m, nil
+}
+
+// parseScalar parses a scalar of a flow collection, ending before one of
+// the stop characters when plain.
+func (f *flowParser) parseScalar(stop string) (any, error) {
+	f.skipSpaces()
+	start := f.pos
+	if f.pos < len(f.text) && (f.text[f.pos] == '"' || f.text[f.pos] == '\'') {
+		end := quotedEnd(f.text[f.pos:])
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated quoted scalar")
+		}
+		f.pos += end
+		return parseScalar(f.text[start:f.pos])
+	}
+	for f.pos < len(f.text) {
+		c := f.text[f.pos]
+		// a colon only ends a plain key when followed by a space or the end
+		if c == ':' && strings.IndexByte(stop, ':') >= 0 {
+			if f.pos+1 == len(f.text) || strings.IndexByte(" ,}", f.text[f.pos+1]) >= 0 {
+				break
+			}
+		} else if strings.IndexByte(stop, c) >= 0 {
+			break
+		}
+		f.pos++
+	}
+	return parseScalar(f.text[start:f.pos])
+}
@@ -0,0 +1,166 @@
+package compose
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want any
+		err  string
+	}{
+		{
+			name: "empty",
+			data: "# only a comment\n",
+			want: nil,
+		},
+		{
+			name: "nested mappings and sequences",
+			data: `
+a:
+  b: 1
+  c:
+    - x
+    - y: 2
+      z: 3
+  -  # not a key
+d: ~
+`,
+			err: "line 8",
+		},
+		{
+			name: "block mapping",
+			data: `
+a:
+  b: 1   # comment
+  c:
+    - x
+    - y: 2
+      z: 3
+d: ~
+e:
+`,
+			want: map[string]any{
+				"a": map[string]any{
+					"b": "1",
+					"c": []any{"x", map[string]any{"y": "2", "z": "3"}},
+				},
+				"d": nil,
+				"e": nil,
+			},
+		},
+		{
+			name: "sequence at the indentation of its key",
+			data: "ports:\n- \"80:80\"\n- 443\n",
+			want: map[string]any{"ports": []any{"80:80", "443"}},
+		},
+		{
+			name: "quoted scalars",
+			data: `a: "x # not a comment"
+b: 'it''s'
+"c d": "tab\t"
+e: x#y
+`,
+			want: map[string]any{"a": "x # not a comment", "b": "it's", "c d": "tab\t", "e": "x#y"},
+		},
+		{
+			name: "flow collections",
+			data: `a: [1, "2, 3", [4]]
+b: {x: 1, "y": [a, b], z}
+c: {url: http://host:80}
+`,
+			want: map[string]any{
+				"a": []any{"1", "2, 3", []any{"4"}},
+				"b": map[string]any{"x": "1", "y": []any{"a", "b"}, "z": nil},
+				"c": map[string]any{"url": "http://host:80"},
+			},
+		},
+		{
+			name: "block scalars",
+			data: `literal: |
+  one
+    two
+
+folded: >-
+  one
+  two
+
+  three
+keep: |+
+  x
+
+end: 1
+`,
+			want: map[string]any{
+				"literal": "one\n  two\n",
+				"folded":  "one two\nthree",
+				"keep":    "x\n\n",
+				"end":     "1",
+			},
+		},
+		{
+			name: "anchors, aliases and merge keys",
+			data: `base: &base
+  a: 1
+  b: 2
+list: &list [x]
+other:
+  <<: *base
+  b: 3
+copy: *list
+`,
+			want: map[string]any{
+				"base":  map[string]any{"a": "1", "b": "2"},
+				"list":  []any{"x"},
+				"other": map[string]any{"a": "1", "b": "3"},
+				"copy":  []any{"x"},
+			},
+		},
+		{
+			name: "first document only",
+			data: "---\na: 1\n---\nb: 2\n",
+			want: map[string]any{"a": "1"},
+		},
+		{
+			name: "tab indentation",
+			data: "a:\n\tb: 1\n",
+			err:  "line 2: tabs are not allowed",
+		},
+		{
+			name: "unknown alias",
+			data: "a: *missing\n",
+			err:  "line 1: unknown alias *missing",
+		},
+		{
+			name: "unterminated flow collection",
+			data: "a: [1, 2\n",
+			err:  "line 1: unterminated flow collection",
+		},
+		{
+			name: "unterminated quoted scalar",
+			data: "a: \"x\n",
+			err:  "line 1: invalid quoted scalar",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, err := parseYAML([]byte(tt.data))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(value, tt.want) {
+				t.Errorf("got %#v, want %#v", value, tt.want)
+			}
+		})
+	}
+}
@@ -5,7 +5,13 @@ package config
 import (
 	"flag"
 	"fmt"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"container-network/pkg/portpool"
 )
 
 // AppName is the name of the application.
@@ -21,10 +27,66 @@ type Config struct {
 	WatchContainerLabel              string
 	IptablesMangleMarkPublishedPorts string
 	IptablesDnatPortsLabel           string
+	IptablesMarkLabel                string
+	EgressRoutes                     []EgressRoute
+	RoutingCheckInterval             time.Duration
+	BaseSetup                        bool
+	InternalSubnet                   string
+	InternalGateway                  string
+	InternalInterface                string
+	TunnelInterface                  string
+	Tunnels                          []Tunnel
+	TunnelLabel                      string
+	GatewayLabel                     string
+	EgressLabel                      string
+	EgressRulePriority               int
+	KillSwitch                       bool
+	AllowPeersLabel                  string
+	PeersConfig                      string
+	PeersCheckInterval               time.Duration
+	TunnelHandshakeTimeout           time.Duration
+	TunnelCheckInterval              time.Duration
+	NATPMPGateway                    net.IP
+	NATPMPLifetime                   time.Duration
+	StatusFile                       string
+	CleanupSubnet                    bool
+	AdminListen                      string
+	AdminToken                       string
+	DriftCheckInterval               time.Duration
+	DriftRepair                      bool
+	DryRun                           bool
+	DryRunFollow                     bool
+	Hairpin                          bool
+	PublicAddress                    net.IP
+	SNATLabel                        string
+	DrainPeriod                      time.Duration
+	DrainLabel                       string
+	DNATPortPool                     string
+	PortAllocationsFile              string
+	PortAllocationExpiry             time.Duration
 	StartupScript                    string
 	ShutdownScript                   string
 }
 
+// EgressRoute maps an egress name to the packet mark and routing table used
+// to send traffic through a specific uplink. If Gateway and/or Device are set,
+// the default route of the table is managed by the daemon.
+type EgressRoute struct {
+	Name    string
+	Mark    uint32
+	Table   int
+	Gateway net.IP
+	Device  string
+}
+
+// Tunnel is a WireGuard interface of the failover order. If Table is set, the
+// default route through the interface is managed in that routing table and
+// containers using the tunnel are routed with it.
+type Tunnel struct {
+	Interface string
+	Table     int
+}
+
 // Default socket paths for Docker and Podman
 const (
 	DefaultDockerSocket     = "/var/run/docker.sock"
@@ -39,6 +101,20 @@ func DefaultConfig() *Config {
 		WatchNetwork:           "bridge",
 		WatchContainerLabel:    "network.enable",
 		IptablesDnatPortsLabel: "network.dnat.ports",
+		IptablesMarkLabel:      "network.mark",
+		TunnelLabel:            "network.tunnel",
+		GatewayLabel:           "network.gateway",
+		EgressLabel:            "network.egress",
+		EgressRulePriority:     100,
+		RoutingCheckInterval:   30 * time.Second,
+		AllowPeersLabel:        "network.allow.peers",
+		PeersCheckInterval:     10 * time.Second,
+		TunnelHandshakeTimeout: 3 * time.Minute,
+		TunnelCheckInterval:    10 * time.Second,
+		NATPMPLifetime:         60 * time.Second,
+		SNATLabel:              "network.dnat.snat",
+		DrainLabel:             "network.dnat.drain",
+		PortAllocationExpiry:   30 * 24 * time.Hour,
 	}
 }
 
@@ -54,6 +130,65 @@ func getStringFlag(flagVal *string, envKey, defaultVal string) string {
 	return defaultVal
 }
 
+// boolFlag is a boolean option given without value (e.g. -dry-run) or as
+// -name=false. It keeps the value as a string, empty when not given, so
+// that getBoolFlag falls back to the environment variable.
+type boolFlag string
+
+// newBoolFlag defines a boolean option.
+func newBoolFlag(name, usage string) *string {
+	value := new(string)
+	flag.Var((*boolFlag)(value), name, usage)
+	return value
+}
+
+func (f *boolFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return string(*f)
+}
+
+func (f *boolFlag) Set(value string) error {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	*f = boolFlag(strconv.FormatBool(b))
+	return nil
+}
+
+// IsBoolFlag lets the flag package accept the option without value.
+func (f *boolFlag) IsBoolFlag() bool {
+	return true
+}
+
+// getBoolFlag is like getStringFlag for boolean values.
+func getBoolFlag(flagVal *string, envKey string, defaultVal bool) (bool, error) {
+	value := getStringFlag(flagVal, envKey, "")
+	if value == "" {
+		return defaultVal, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid boolean for %s: %w", envKey, err)
+	}
+	return b, nil
+}
+
+// getDurationFlag is like getStringFlag for time.Duration values.
+func getDurationFlag(flagVal *string, envKey string, defaultVal time.Duration) (time.Duration, error) {
+	value := getStringFlag(flagVal, envKey, "")
+	if value == "" {
+		return defaultVal, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration for %s: %w", envKey, err)
+	}
+	return d, nil
+}
+
 func detectDefaultSocket() string {
 	if _, err := os.Stat(DefaultDockerSocket); err == nil {
 		return DefaultDockerSocket
@@ -76,6 +211,87 @@ func detectDefaultSocket() string {
 	return DefaultDockerSocket
 }
 
+// ParseEgressRoutes parses a comma-separated list of egress routes in the
+// format "name=mark:table[:gateway[:device]]".
+// Example: "provider=2:200:192.168.1.1,provider2=3:201::eth2"
+func ParseEgressRoutes(routesStr string) ([]EgressRoute, error) {
+	var routes []EgressRoute
+	seen := make(map[string]bool)
+	for _, r := range strings.Split(routesStr, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(r, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid egress route %q: expected name=mark:table[:gateway[:device]]", r)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate egress route %q", name)
+		}
+		parts := strings.Split(value, ":")
+		if len(parts) < 2 || len(parts) > 4 {
+			return nil, fmt.Errorf("invalid egress route %q: expected name=mark:table[:gateway[:device]]", r)
+		}
+		mark, err := strconv.ParseUint(parts[0], 0, 32)
+		if err != nil || mark == 0 {
+			return nil, fmt.Errorf("invalid mark in egress route %q", r)
+		}
+		table, err := strconv.Atoi(parts[1])
+		if err != nil || table <= 0 {
+			return nil, fmt.Errorf("invalid table in egress route %q", r)
+		}
+		route := EgressRoute{Name: name, Mark: uint32(mark), Table: table}
+		if len(parts) > 2 && parts[2] != "" {
+			if route.Gateway = net.ParseIP(parts[2]).To4(); route.Gateway == nil {
+				return nil, fmt.Errorf("invalid gateway in egress route %q", r)
+			}
+		}
+		if len(parts) > 3 {
+			route.Device = parts[3]
+		}
+		seen[name] = true
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// ParseTunnels parses a comma-separated failover order of tunnels in the
+// format "interface[:table]". Only the first one may use the main routing
+// table, the backup tunnels need their own.
+// Example: "wg0,wg1:201" -> [{wg0 0} {wg1 201}]
+func ParseTunnels(value string) ([]Tunnel, error) {
+	var tunnels []Tunnel
+	seen := make(map[string]bool)
+	for _, t := range strings.Split(value, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		name, tableValue, hasTable := strings.Cut(t, ":")
+		if name == "" {
+			return nil, fmt.Errorf("invalid tunnel %q: expected interface[:table]", t)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate tunnel %q", name)
+		}
+		tunnel := Tunnel{Interface: name}
+		if hasTable {
+			table, err := strconv.Atoi(tableValue)
+			if err != nil || table <= 0 {
+				return nil, fmt.Errorf("invalid table in tunnel %q", t)
+			}
+			tunnel.Table = table
+		} else if len(tunnels) > 0 {
+			return nil, fmt.Errorf("invalid tunnel %q: backup tunnels need a routing table", t)
+		}
+		seen[name] = true
+		tunnels = append(tunnels, tunnel)
+	}
+	return tunnels, nil
+}
+
 // Load loads configuration from flags and environment variables.
 func Load() (*Config, error) {
 	cfg := DefaultConfig()
@@ -84,6 +300,43 @@ func Load() (*Config, error) {
 	watchContainerLabel := flag.String("watch-container-label", "", "Label name to enable watching (env: WATCH_CONTAINER_LABEL)")
 	iptablesMangleMark := flag.String("iptables-mangle-mark-published-ports", "", "iptables mark value for published ports (env: IPTABLES_MANGLE_MARK_PUBLISHED_PORTS)")
 	iptablesDnatPortsLabel := flag.String("iptables-dnat-ports-label", "", "Label name for DNAT ports (env: IPTABLES_DNAT_PORTS_LABEL, default: network.dnat.ports)")
+	iptablesMarkLabel := flag.String("iptables-mark-label", "", "Label name selecting the egress (or mark) for published ports (env: IPTABLES_MARK_LABEL, default: network.mark)")
+	egressRoutes := flag.String("egress-routes", "", "Comma-separated egress routes as name=mark:table[:gateway[:device]] (env: EGRESS_ROUTES)")
+	routingCheckInterval := flag.String("routing-check-interval", "", "Interval to verify the egress routing rules and routes (env: ROUTING_CHECK_INTERVAL, default: 30s)")
+	baseSetup := newBoolFlag("base-setup", "Setup rp_filter, forwarding and masquerade for the internal subnet (env: BASE_SETUP)")
+	internalSubnet := flag.String("internal-subnet", "", "Subnet of the watched network (env: INTERNAL_NET_SUBNET, default: auto-detect)")
+	internalGateway := flag.String("internal-gateway", "", "Gateway of the watched network (env: INTERNAL_NET_GW, default: auto-detect)")
+	internalInterface := flag.String("internal-interface", "", "Interface attached to the watched network (env: INTERNAL_INTERFACE, default: auto-detect)")
+	tunnelInterface := flag.String("tunnel-interface", "", "WireGuard tunnel interface (env: TUNNEL_INTERFACE, default: auto-detect or wg0)")
+	tunnels := flag.String("tunnels", "", "Comma-separated failover order of WireGuard tunnels as interface[:table] (env: TUNNELS, default: the tunnel interface)")
+	tunnelLabel := flag.String("tunnel-label", "", "Label name selecting the preferred tunnel of a container (env: TUNNEL_LABEL, default: network.tunnel)")
+	gatewayLabel := flag.String("gateway-label", "", "Label name to route a container through this container, value: vpn, restored on SIGUSR1 and on shutdown (env: GATEWAY_LABEL, default: network.gateway)")
+	egressLabel := flag.String("egress-label", "", "Label name selecting the egress of all outbound traffic: route name, vpn or blocked (env: EGRESS_LABEL, default: network.egress)")
+	egressRulePriority := flag.String("egress-rule-priority", "", "Priority of the per-container source routing rules (env: EGRESS_RULE_PRIORITY, default: 100)")
+	killSwitch := newBoolFlag("kill-switch", "Reject traffic of containers with vpn egress while the tunnel is down (env: KILL_SWITCH)")
+	allowPeersLabel := flag.String("allow-peers-label", "", "Label name with the WireGuard peers allowed to reach a container (env: ALLOW_PEERS_LABEL, default: network.allow.peers)")
+	peersConfig := flag.String("peers-config", "", "WireGuard server configuration with the peers for the allow peers label (env: PEERS_CONFIG)")
+	peersCheckInterval := flag.String("peers-check-interval", "", "Interval to check the WireGuard server configuration for changes (env: PEERS_CHECK_INTERVAL, default: 10s)")
+	tunnelHandshakeTimeout := flag.String("tunnel-handshake-timeout", "", "Maximum age of the latest peer handshake of a healthy tunnel, 0 disables the check (env: TUNNEL_HANDSHAKE_TIMEOUT, default: 3m)")
+	tunnelCheckInterval := flag.String("tunnel-check-interval", "", "Interval to check the tunnel peer handshakes (env: TUNNEL_CHECK_INTERVAL, default: 10s)")
+	natpmpGateway := flag.String("natpmp-gateway", "", "NAT-PMP gateway of the VPN provider to map the DNAT ports (env: NATPMP_GATEWAY)")
+	natpmpLifetime := flag.String("natpmp-lifetime", "", "Lifetime of the NAT-PMP port mappings, renewed at half of it (env: NATPMP_LIFETIME, default: 60s)")
+	hairpin := newBoolFlag("hairpin", "Let internal clients reach the DNAT ports through the public VPN address (env: HAIRPIN)")
+	publicAddress := flag.String("public-address", "", "Public address of the VPN for hairpin NAT (env: PUBLIC_ADDRESS, default: NAT-PMP external address)")
+	snatLabel := flag.String("snat-label", "", "Label name to masquerade the DNATed connections of a container on the internal interface (env: SNAT_LABEL, default: network.dnat.snat)")
+	drainPeriod := flag.String("drain-period", "", "Time the established connections to the DNAT ports of a stopped container are still forwarded (env: DRAIN_PERIOD, default: 0, disabled)")
+	drainLabel := flag.String("drain-label", "", "Label name overriding the drain period of a container (env: DRAIN_LABEL, default: network.dnat.drain)")
+	dnatPortPool := flag.String("dnat-port-pool", "", "Port range as min-max to allocate the external ports of auto:<port> DNAT ports (env: DNAT_PORT_POOL)")
+	portAllocationsFile := flag.String("port-allocations-file", "", "State file keeping the allocated external ports across restarts (env: PORT_ALLOCATIONS_FILE)")
+	portAllocationExpiry := flag.String("port-allocation-expiry", "", "Time the allocated external ports of a stopped container are kept, 0 to keep them forever (env: PORT_ALLOCATION_EXPIRY, default: 720h)")
+	driftCheckInterval := flag.String("drift-check-interval", "", "Interval to compare the live rules with the rules of the managed containers (env: DRIFT_CHECK_INTERVAL, default: 0, disabled)")
+	driftRepair := newBoolFlag("drift-repair", "Install the missing rules and remove the unexpected ones found by the drift check (env: DRIFT_REPAIR)")
+	dryRun := newBoolFlag("dry-run", "Print the rule changes of the existing containers instead of applying them, then exit (env: DRY_RUN)")
+	dryRunFollow := newBoolFlag("dry-run-follow", "With -dry-run, keep printing the rule changes of the container events instead of exiting (env: DRY_RUN_FOLLOW)")
+	statusFile := flag.String("status-file", "", "File to write the status of the managed containers as JSON (env: STATUS_FILE)")
+	cleanupSubnet := newBoolFlag("cleanup-subnet", "With the rules and cleanup commands, include all the rules of the -internal-subnet addresses, not only the rules of the status file (env: CLEANUP_SUBNET)")
+	adminListen := flag.String("admin-listen", "", "Unix socket path or TCP address (host:port) of the HTTP admin API (env: ADMIN_LISTEN)")
+	adminToken := flag.String("admin-token", "", "Bearer token required by the admin API endpoints other than /healthz and /readyz, needed on a non-loopback TCP address (env: ADMIN_TOKEN)")
 	startupScript := flag.String("startup-script", "", "Script to run before starting - exit non-zero to abort (env: STARTUP_SCRIPT)")
 	shutdownScript := flag.String("shutdown-script", "", "Script to run before shutdown (env: SHUTDOWN_SCRIPT)")
 	showHelp := flag.Bool("help", false, "Show help message")
@@ -98,20 +351,172 @@ func Load() (*Config, error) {
 		fmt.Printf("%s %s\n", AppName, Version)
 		os.Exit(0)
 	}
+	if arg := flag.Arg(0); arg == "true" || arg == "false" {
+		// the remaining options would be silently ignored
+		return nil, fmt.Errorf("unexpected argument %q, boolean options are given as -option or -option=%s", arg, arg)
+	}
 	cfg.RuntimeAPI = getStringFlag(runtimeAPI, "RUNTIME_API", cfg.RuntimeAPI)
 	cfg.WatchNetwork = getStringFlag(watchNetwork, "WATCH_NETWORK", cfg.WatchNetwork)
 	cfg.WatchContainerLabel = getStringFlag(watchContainerLabel, "WATCH_CONTAINER_LABEL", cfg.WatchContainerLabel)
 	cfg.IptablesMangleMarkPublishedPorts = getStringFlag(iptablesMangleMark, "IPTABLES_MANGLE_MARK_PUBLISHED_PORTS", cfg.IptablesMangleMarkPublishedPorts)
 	cfg.IptablesDnatPortsLabel = getStringFlag(iptablesDnatPortsLabel, "IPTABLES_DNAT_PORTS_LABEL", cfg.IptablesDnatPortsLabel)
+	cfg.IptablesMarkLabel = getStringFlag(iptablesMarkLabel, "IPTABLES_MARK_LABEL", cfg.IptablesMarkLabel)
+	routes, err := ParseEgressRoutes(getStringFlag(egressRoutes, "EGRESS_ROUTES", ""))
+	if err != nil {
+		return nil, err
+	}
+	cfg.EgressRoutes = routes
+	if cfg.RoutingCheckInterval, err = getDurationFlag(routingCheckInterval, "ROUTING_CHECK_INTERVAL", cfg.RoutingCheckInterval); err != nil {
+		return nil, err
+	}
+	if cfg.BaseSetup, err = getBoolFlag(baseSetup, "BASE_SETUP", cfg.BaseSetup); err != nil {
+		return nil, err
+	}
+	cfg.InternalSubnet = getStringFlag(internalSubnet, "INTERNAL_NET_SUBNET", cfg.InternalSubnet)
+	if cfg.InternalSubnet != "" {
+		if _, _, err := net.ParseCIDR(cfg.InternalSubnet); err != nil {
+			return nil, fmt.Errorf("invalid internal subnet: %w", err)
+		}
+	}
+	cfg.InternalGateway = getStringFlag(internalGateway, "INTERNAL_NET_GW", cfg.InternalGateway)
+	cfg.InternalInterface = getStringFlag(internalInterface, "INTERNAL_INTERFACE", cfg.InternalInterface)
+	cfg.TunnelInterface = getStringFlag(tunnelInterface, "TUNNEL_INTERFACE", cfg.TunnelInterface)
+	if cfg.Tunnels, err = ParseTunnels(getStringFlag(tunnels, "TUNNELS", "")); err != nil {
+		return nil, err
+	}
+	for _, t := range cfg.Tunnels {
+		if cfg.TunnelInterface != "" && t.Interface != cfg.TunnelInterface && t.Table == 0 {
+			return nil, fmt.Errorf("invalid tunnel %q: only the tunnel interface %s uses the main routing table", t.Interface, cfg.TunnelInterface)
+		}
+	}
+	cfg.TunnelLabel = getStringFlag(tunnelLabel, "TUNNEL_LABEL", cfg.TunnelLabel)
+	cfg.GatewayLabel = getStringFlag(gatewayLabel, "GATEWAY_LABEL", cfg.GatewayLabel)
+	cfg.EgressLabel = getStringFlag(egressLabel, "EGRESS_LABEL", cfg.EgressLabel)
+	if value := getStringFlag(egressRulePriority, "EGRESS_RULE_PRIORITY", ""); value != "" {
+		if cfg.EgressRulePriority, err = strconv.Atoi(value); err != nil || cfg.EgressRulePriority <= 0 {
+			return nil, fmt.Errorf("invalid egress rule priority %q", value)
+		}
+	}
+	if cfg.KillSwitch, err = getBoolFlag(killSwitch, "KILL_SWITCH", cfg.KillSwitch); err != nil {
+		return nil, err
+	}
+	cfg.AllowPeersLabel = getStringFlag(allowPeersLabel, "ALLOW_PEERS_LABEL", cfg.AllowPeersLabel)
+	cfg.PeersConfig = getStringFlag(peersConfig, "PEERS_CONFIG", cfg.PeersConfig)
+	if cfg.PeersCheckInterval, err = getDurationFlag(peersCheckInterval, "PEERS_CHECK_INTERVAL", cfg.PeersCheckInterval); err != nil {
+		return nil, err
+	}
+	if cfg.TunnelHandshakeTimeout, err = getDurationFlag(tunnelHandshakeTimeout, "TUNNEL_HANDSHAKE_TIMEOUT", cfg.TunnelHandshakeTimeout); err != nil {
+		return nil, err
+	}
+	if cfg.TunnelCheckInterval, err = getDurationFlag(tunnelCheckInterval, "TUNNEL_CHECK_INTERVAL", cfg.TunnelCheckInterval); err != nil {
+		return nil, err
+	}
+	if value := getStringFlag(natpmpGateway, "NATPMP_GATEWAY", ""); value != "" {
+		if cfg.NATPMPGateway = net.ParseIP(value).To4(); cfg.NATPMPGateway == nil {
+			return nil, fmt.Errorf("invalid NAT-PMP gateway %q", value)
+		}
+	}
+	if cfg.NATPMPLifetime, err = getDurationFlag(natpmpLifetime, "NATPMP_LIFETIME", cfg.NATPMPLifetime); err != nil {
+		return nil, err
+	}
+	if cfg.NATPMPLifetime < time.Second {
+		return nil, fmt.Errorf("invalid NAT-PMP lifetime %s", cfg.NATPMPLifetime)
+	}
+	if cfg.Hairpin, err = getBoolFlag(hairpin, "HAIRPIN", cfg.Hairpin); err != nil {
+		return nil, err
+	}
+	cfg.SNATLabel = getStringFlag(snatLabel, "SNAT_LABEL", cfg.SNATLabel)
+	if cfg.DrainPeriod, err = getDurationFlag(drainPeriod, "DRAIN_PERIOD", cfg.DrainPeriod); err != nil {
+		return nil, err
+	}
+	if cfg.DrainPeriod < 0 {
+		return nil, fmt.Errorf("invalid drain period %s", cfg.DrainPeriod)
+	}
+	cfg.DrainLabel = getStringFlag(drainLabel, "DRAIN_LABEL", cfg.DrainLabel)
+	if value := getStringFlag(publicAddress, "PUBLIC_ADDRESS", ""); value != "" {
+		if cfg.PublicAddress = net.ParseIP(value).To4(); cfg.PublicAddress == nil {
+			return nil, fmt.Errorf("invalid public address %q", value)
+		}
+	}
+	cfg.DNATPortPool = getStringFlag(dnatPortPool, "DNAT_PORT_POOL", cfg.DNATPortPool)
+	if cfg.DNATPortPool != "" {
+		if _, _, err := portpool.ParseRange(cfg.DNATPortPool); err != nil {
+			return nil, err
+		}
+	}
+	cfg.PortAllocationsFile = getStringFlag(portAllocationsFile, "PORT_ALLOCATIONS_FILE", cfg.PortAllocationsFile)
+	if cfg.PortAllocationExpiry, err = getDurationFlag(portAllocationExpiry, "PORT_ALLOCATION_EXPIRY", cfg.PortAllocationExpiry); err != nil {
+		return nil, err
+	}
+	if cfg.PortAllocationExpiry < 0 {
+		return nil, fmt.Errorf("invalid port allocation expiry %s", cfg.PortAllocationExpiry)
+	}
+	cfg.StatusFile = getStringFlag(statusFile, "STATUS_FILE", cfg.StatusFile)
+	if cfg.CleanupSubnet, err = getBoolFlag(cleanupSubnet, "CLEANUP_SUBNET", cfg.CleanupSubnet); err != nil {
+		return nil, err
+	}
+	cfg.AdminListen = getStringFlag(adminListen, "ADMIN_LISTEN", cfg.AdminListen)
+	cfg.AdminToken = getStringFlag(adminToken, "ADMIN_TOKEN", cfg.AdminToken)
+	if cfg.AdminToken == "" && !localAdminListen(cfg.AdminListen) {
+		return nil, fmt.Errorf("admin API on %s needs an admin token, use a unix socket or a loopback address otherwise", cfg.AdminListen)
+	}
+	if cfg.DriftCheckInterval, err = getDurationFlag(driftCheckInterval, "DRIFT_CHECK_INTERVAL", cfg.DriftCheckInterval); err != nil {
+		return nil, err
+	}
+	if cfg.DriftCheckInterval < 0 {
+		return nil, fmt.Errorf("invalid drift check interval %s", cfg.DriftCheckInterval)
+	}
+	if cfg.DriftRepair, err = getBoolFlag(driftRepair, "DRIFT_REPAIR", cfg.DriftRepair); err != nil {
+		return nil, err
+	}
+	if cfg.DryRun, err = getBoolFlag(dryRun, "DRY_RUN", cfg.DryRun); err != nil {
+		return nil, err
+	}
+	if cfg.DryRunFollow, err = getBoolFlag(dryRunFollow, "DRY_RUN_FOLLOW", cfg.DryRunFollow); err != nil {
+		return nil, err
+	}
+	cfg.DryRun = cfg.DryRun || cfg.DryRunFollow
 	cfg.StartupScript = getStringFlag(startupScript, "STARTUP_SCRIPT", cfg.StartupScript)
 	cfg.ShutdownScript = getStringFlag(shutdownScript, "SHUTDOWN_SCRIPT", cfg.ShutdownScript)
 	return cfg, nil
 }
 
+// localAdminListen returns true if the admin API listen value is unset, a
+// unix socket or a loopback TCP address, only reachable from the host.
+func localAdminListen(listen string) bool {
+	if listen == "" || strings.HasPrefix(listen, "unix:") || strings.HasPrefix(listen, "/") {
+		return true
+	}
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		// reported by the listen
+		return true
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
 func printUsage() {
 	w := flag.CommandLine.Output()
 	fmt.Fprintf(w, "%s - Watch Docker/Podman containers on a network\n\n", AppName)
-	fmt.Fprintf(w, "Usage: %s [OPTIONS]\n\n", AppName)
+	fmt.Fprintf(w, "Usage: %s [COMMAND] [OPTIONS]\n", AppName)
+	fmt.Fprintf(w, "       %s plan [OPTIONS] COMPOSE_FILE\n\n", AppName)
+	fmt.Fprint(w, `Commands:
+  run      Run the daemon (default)
+  list     List the managed containers of the -admin-listen API or the
+           -status-file
+  rules    List the rules of the containers of the -admin-listen API or the
+           live rules of the containers of the -status-file
+  cleanup  Remove the rules and routes left behind by the daemon
+  check    Verify the privileges, the container runtime and the iptables tools
+  plan     Print the rules of the services of a compose file
+
+All the commands take the options of the daemon.
+
+`)
 	fmt.Fprintln(w, "Options:")
 	flag.PrintDefaults()
 	fmt.Fprintf(w, `
@@ -119,8 +524,10 @@ Description:
   This daemon watches for Docker or Podman containers that are attached to a
   specific network and optionally have a specific label set to "true".
 
-  When a matching container starts, it can execute iptables rules for DNAT
-  and/or mark published ports. When a container stops, the rules are removed.
+  When a matching container starts, the iptables rules selected by its
+  labels (DNAT, published ports mark, egress, tunnel, allowed peers) are
+  applied, and they are removed when the container stops. The options are
+  described above and in the README.
 
 Examples:
   # Watch containers on the default bridge network
@@ -134,5 +541,29 @@ Examples:
 
   # Use environment variables
   WATCH_NETWORK=my-network %[1]s
+
+  # Send published ports of containers labelled network.mark=provider2
+  # through routing table 201 instead of the default mark
+  %[1]s -iptables-mangle-mark-published-ports 2 -egress-routes provider=2:200:192.168.1.1,provider2=3:201:10.0.0.1
+
+  # Fail over between two tunnels, wg1 routed with table 201
+  %[1]s -tunnels wg0,wg1:201
+
+  # Print the rules of the running containers without applying them
+  %[1]s -dry-run -watch-network my-network
+
+  # Review the rules of the services of a compose file
+  %[1]s plan -watch-network myapp_default compose.yaml
+
+  # Print the rules and routes left behind by the daemon, then remove them
+  %[1]s cleanup -dry-run -status-file /run/container-network/status.json
+  %[1]s cleanup -status-file /run/container-network/status.json
+
+  # Serve the admin API and list the managed containers through it
+  %[1]s -admin-listen /run/container-network/admin.sock
+  %[1]s list -admin-listen /run/container-network/admin.sock
+
+  # Serve the admin API on all the addresses, with a token
+  %[1]s -admin-listen :9180 -admin-token "$(cat /run/secrets/admin-token)"
 `, AppName)
 }
@@ -0,0 +1,159 @@
+package config
+
+import (
+	"flag"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseEgressRoutes(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []EgressRoute
+		err   string
+	}{
+		{value: "", want: nil},
+		{
+			value: "provider=2:200:192.168.1.1,provider2=0x3:201::eth2",
+			want: []EgressRoute{
+				{Name: "provider", Mark: 2, Table: 200, Gateway: net.IPv4(192, 168, 1, 1).To4()},
+				{Name: "provider2", Mark: 3, Table: 201, Device: "eth2"},
+			},
+		},
+		{
+			value: " vpn=4:202 , ",
+			want:  []EgressRoute{{Name: "vpn", Mark: 4, Table: 202}},
+		},
+		{value: "provider", err: "expected name=mark:table"},
+		{value: "=2:200", err: "expected name=mark:table"},
+		{value: "provider=2", err: "expected name=mark:table"},
+		{value: "provider=2:200:1.2.3.4:eth0:x", err: "expected name=mark:table"},
+		{value: "provider=0:200", err: "invalid mark"},
+		{value: "provider=x:200", err: "invalid mark"},
+		{value: "provider=2:0", err: "invalid table"},
+		{value: "provider=2:200:gateway", err: "invalid gateway"},
+		{value: "provider=2:200:fd00::1", err: "expected name=mark:table"},
+		{value: "provider=2:200,provider=3:201", err: `duplicate egress route "provider"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			routes, err := ParseEgressRoutes(tt.value)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(routes, tt.want) {
+				t.Errorf("got %+v, want %+v", routes, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTunnels(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []Tunnel
+		err   string
+	}{
+		{value: "", want: nil},
+		{value: "wg0,wg1:201", want: []Tunnel{{Interface: "wg0"}, {Interface: "wg1", Table: 201}}},
+		{value: ":201", err: "expected interface[:table]"},
+		{value: "wg1:main", err: "invalid table"},
+		{value: "wg0,wg0:201", err: `duplicate tunnel "wg0"`},
+		{value: "wg0,wg1", err: "backup tunnels need a routing table"},
+		{value: "wg0:200,wg1:201", want: []Tunnel{{Interface: "wg0", Table: 200}, {Interface: "wg1", Table: 201}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			tunnels, err := ParseTunnels(tt.value)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tunnels, tt.want) {
+				t.Errorf("got %+v, want %+v", tunnels, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetBoolFlag(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		env        string
+		defaultVal bool
+		want       bool
+		err        bool
+	}{
+		{name: "default", defaultVal: true, want: true},
+		{name: "without value", args: []string{"-base-setup"}, want: true},
+		{name: "with value", args: []string{"-base-setup=false"}, env: "true", defaultVal: true, want: false},
+		{name: "environment", env: "1", want: true},
+		{name: "environment false", env: "false", defaultVal: true, want: false},
+		{name: "invalid environment", env: "yes", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TEST_BASE_SETUP", tt.env)
+			flags := flag.NewFlagSet("test", flag.ContinueOnError)
+			value := new(string)
+			flags.Var((*boolFlag)(value), "base-setup", "")
+			// the option without value does not take the next argument
+			if err := flags.Parse(append(tt.args, "rest")); err != nil {
+				t.Fatal(err)
+			}
+			if args := flags.Args(); len(args) != 1 || args[0] != "rest" {
+				t.Fatalf("got arguments %q, want [rest]", args)
+			}
+			got, err := getBoolFlag(value, "TEST_BASE_SETUP", tt.defaultVal)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("got %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalAdminListen(t *testing.T) {
+	tests := []struct {
+		listen string
+		want   bool
+	}{
+		{listen: "", want: true},
+		{listen: "/run/container-network/admin.sock", want: true},
+		{listen: "unix:admin.sock", want: true},
+		{listen: "127.0.0.1:9180", want: true},
+		{listen: "[::1]:9180", want: true},
+		{listen: "localhost:9180", want: true},
+		{listen: ":9180", want: false},
+		{listen: "0.0.0.0:9180", want: false},
+		{listen: "192.168.1.10:9180", want: false},
+		{listen: "[::]:9180", want: false},
+	}
+	for _, tt := range tests {
+		if got := localAdminListen(tt.listen); got != tt.want {
+			t.Errorf("localAdminListen(%q) = %v, want %v", tt.listen, got, tt.want)
+		}
+	}
+}
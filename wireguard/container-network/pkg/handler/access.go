@@ -0,0 +1,167 @@
+package handler
+
+import (
+	"log/slog"
+	"strings"
+
+	"container-network/pkg/iptables"
+	"container-network/pkg/peers"
+	"container-network/pkg/watcher"
+)
+
+// appliedAccess is the peer access control installed for a container.
+type appliedAccess struct {
+	containerName string
+	ip            string
+	patterns      []string
+	rules         [][]string
+}
+
+// applyContainerAccess installs the FORWARD rules allowing only the peers
+// selected by the allow peers label to reach a container through the tunnel.
+func (h *Handler) applyContainerAccess(tx *iptables.Transaction, logger *slog.Logger, c watcher.ContainerInfo) {
+	if h.config.AllowPeersLabel == "" || c.IPAddress == "" {
+		return
+	}
+	value, ok := c.Labels[h.config.AllowPeersLabel]
+	if !ok {
+		return
+	}
+	var patterns []string
+	for _, p := range strings.Split(value, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	applied := &appliedAccess{containerName: c.Name, ip: c.IPAddress, patterns: patterns}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.updateAccess(tx, logger.With("peers", strings.Join(patterns, ",")), applied)
+	h.access[c.ID] = applied
+}
+
+// removeContainerAccess removes the peer access control rules of a container.
+func (h *Handler) removeContainerAccess(tx *iptables.Transaction, logger *slog.Logger, c watcher.ContainerInfo) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	applied, ok := h.access[c.ID]
+	if !ok {
+		return
+	}
+	delete(h.access, c.ID)
+	for _, rule := range applied.rules {
+		h.queueRule(tx, logger, "peer access", "-D", rule)
+	}
+}
+
+// PeersChanged updates the peer access control rules of all the containers
+// with the new peers of the WireGuard server configuration.
+func (h *Handler) PeersChanged(p []peers.Peer) {
+	h.applyRules(func(tx *iptables.Transaction) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.peers = p
+		for _, applied := range h.access {
+			logger := slog.With("container", applied.containerName, "ip", applied.ip, "peers", strings.Join(applied.patterns, ","))
+			h.updateAccess(tx, logger, applied)
+		}
+	})
+}
+
+// updateAccess installs the rules for the current peers, then removes the
+// previous ones, so the container is never left unprotected. Unknown peers
+// are not allowed. Must be called with h.mu held.
+func (h *Handler) updateAccess(tx *iptables.Transaction, logger *slog.Logger, applied *appliedAccess) {
+	allowed := peers.Match(h.peers, applied.patterns)
+	// rules are inserted at the top of FORWARD: the reject of new connections
+	// first, so the accept rules end above it
+	rules := [][]string{
+		{"-t", "filter", "FORWARD", "-i", h.config.TunnelInterface, "-d", applied.ip, "-m", "conntrack", "--ctstate", "NEW", "-j", "REJECT"},
+	}
+	var names []string
+	for _, p := range allowed {
+		names = append(names, p.Name)
+		for _, ipNet := range p.AllowedIPs {
+			if ipNet.IP.To4() == nil {
+				continue
+			}
+			rules = append(rules, []string{"-t", "filter", "FORWARD", "-i", h.config.TunnelInterface, "-s", ipNet.String(), "-d", applied.ip, "-j", "ACCEPT"})
+		}
+	}
+	if equalRules(rules, applied.rules) {
+		return
+	}
+	for _, rule := range rules {
+		h.queueChange(tx, logger, "peer access", "-I", rule, func(err error) {
+			if err != nil {
+				logger.Error("Failed to add peer access rule", "rule", strings.Join(rule, " "), "error", err)
+			}
+		})
+	}
+	for _, rule := range applied.rules {
+		h.queueChange(tx, logger, "peer access", "-D", rule, func(err error) {
+			if err != nil {
+				logger.Error("Failed to remove peer access rule", "rule", strings.Join(rule, " "), "error", err)
+			}
+		})
+	}
+	applied.rules = rules
+	if len(allowed) == 0 {
+		logger.Warn("No peer matches the allowed peers, container is not reachable through the tunnel")
+	} else {
+		logger.Info("Updated peer access rules", "allowed", strings.Join(names, ","))
+	}
+}
+
+// recheckAccess installs again the peer access rules of a container if any is
+// missing, keeping their order. The rules are checked without h.mu held.
+func (h *Handler) recheckAccess(tx *iptables.Transaction, logger *slog.Logger, id string) {
+	h.mu.Lock()
+	applied, ok := h.access[id]
+	var rules [][]string
+	if ok {
+		rules = applied.rules
+	}
+	h.mu.Unlock()
+	if !ok {
+		return
+	}
+	var present [][]string
+	for _, rule := range rules {
+		if err := iptablesCheck(logger, rule); err == nil {
+			present = append(present, rule)
+		}
+	}
+	if len(present) == len(rules) {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.access[id] != applied || !equalRules(applied.rules, rules) {
+		// removed or updated meanwhile
+		return
+	}
+	for _, rule := range present {
+		h.queueChange(tx, logger, "peer access", "-D", rule, func(err error) {
+			if err != nil {
+				logger.Error("Failed to remove peer access rule", "rule", strings.Join(rule, " "), "error", err)
+			}
+		})
+	}
+	applied.rules = nil
+	logger.Warn("Peer access rules were missing, restoring them")
+	h.updateAccess(tx, logger, applied)
+}
+
+// equalRules returns true if both rule lists are the same.
+func equalRules(a, b [][]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if strings.Join(a[i], " ") != strings.Join(b[i], " ") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"errors"
+	"log/slog"
+
+	"container-network/pkg/netlink"
+)
+
+// conntrackProtocols are the IP protocol numbers of the DNAT port protocols.
+var conntrackProtocols = map[string]uint8{"tcp": 6, "udp": 17}
+
+// flushConntrack deletes the conntrack entries of the connections DNATed to
+// the ports of a container through their external ports. Established flows
+// (e.g. long-lived UDP ones) keep their translation until they expire, so
+// they must be deleted when the DNAT rules are removed or moved.
+func (h *Handler) flushConntrack(logger *slog.Logger, containerIP string, ports []port) {
+	if containerIP == "" || len(ports) == 0 {
+		return
+	}
+	if h.planning() {
+		for _, p := range ports {
+			h.planNote("conntrack -D -p %s --reply-src %s --reply-port-src %d --orig-port-dst %d", p.protocol, containerIP, p.port, p.external)
+		}
+		return
+	}
+	deleted, err := netlink.ConntrackDelete(func(flow netlink.ConntrackFlow) bool {
+		// only translated connections, direct ones to the container are kept
+		if flow.Reply.Src.String() != containerIP || flow.Original.Dst.Equal(flow.Reply.Src) {
+			return false
+		}
+		for _, p := range ports {
+			if flow.Protocol == conntrackProtocols[p.protocol] && flow.Reply.SrcPort == p.port && flow.Original.DstPort == p.external {
+				return true
+			}
+		}
+		return false
+	})
+	switch {
+	case errors.Is(err, netlink.ErrNotSupported):
+		logger.Debug("Conntrack cleanup not supported on this platform")
+	case err != nil:
+		logger.Warn("Failed to delete conntrack entries", "deleted", deleted, "error", err)
+	case deleted > 0:
+		logger.Info("Deleted conntrack entries", "deleted", deleted)
+	}
+}
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"container-network/pkg/iptables"
+	"container-network/pkg/watcher"
+)
+
+// drain is a stopped container whose established DNAT connections are
+// still forwarded until the drain period ends or the container dies.
+type drain struct {
+	container watcher.ContainerInfo
+	logger    *slog.Logger
+	until     time.Time
+	timer     *time.Timer
+	rules     [][]string
+}
+
+// drainPeriod returns the drain period of a container: the drain label value
+// if set, otherwise the default drain period.
+func (h *Handler) drainPeriod(logger *slog.Logger, c watcher.ContainerInfo) time.Duration {
+	if h.config.DrainLabel == "" {
+		return h.config.DrainPeriod
+	}
+	value, ok := c.Labels[h.config.DrainLabel]
+	if !ok {
+		return h.config.DrainPeriod
+	}
+	period, err := time.ParseDuration(strings.TrimSpace(value))
+	if err != nil || period < 0 {
+		logger.Warn("Invalid drain period in drain label, using default", "label", h.config.DrainLabel, "value", value, "period", h.config.DrainPeriod)
+		return h.config.DrainPeriod
+	}
+	return period
+}
+
+// startDrain refuses the new connections to the DNAT ports of a stopped
+// container while its established ones are still forwarded. Its rules are
+// removed by finishDrain when the drain period ends or the container dies.
+// Returns false if the container is not drained.
+func (h *Handler) startDrain(tx *iptables.Transaction, logger *slog.Logger, event watcher.ContainerEvent) bool {
+	c := event.Container
+	period := h.drainPeriod(logger, c)
+	if period <= 0 || c.IPAddress == "" {
+		return false
+	}
+	dnatPorts := h.containerDNATPorts(logger, c, false)
+	if len(dnatPorts) == 0 {
+		return false
+	}
+	logger = logger.With("ip", c.IPAddress)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.containers[c.ID]; !ok {
+		return false
+	}
+	if _, ok := h.failed[c.ID]; ok {
+		// no DNAT rules to drain, they were rolled back
+		return false
+	}
+	if _, ok := h.draining[c.ID]; ok {
+		return true
+	}
+	d := &drain{container: c, logger: logger, until: time.Now().Add(period)}
+	for _, p := range dnatPorts {
+		// both are inserted at the top of FORWARD, they match disjoint states
+		d.rules = append(d.rules,
+			[]string{"-t", "filter", "FORWARD", "-d", c.IPAddress, "-p", p.protocol, "--dport", fmt.Sprintf("%d", p.port), "-m", "conntrack", "--ctstate", "NEW", "-j", "REJECT"},
+			[]string{"-t", "filter", "FORWARD", "-d", c.IPAddress, "-p", p.protocol, "--dport", fmt.Sprintf("%d", p.port), "-m", "conntrack", "--ctstate", "ESTABLISHED", "-j", "ACCEPT"},
+		)
+	}
+	for _, rule := range d.rules {
+		h.queueRule(tx, logger, "drain", "-I", rule)
+	}
+	d.timer = time.AfterFunc(period, func() {
+		h.applyRules(func(tx *iptables.Transaction) {
+			h.finishDrain(tx, c.ID, "drain period ended")
+		})
+		h.writeStatus()
+	})
+	h.draining[c.ID] = d
+	logger.Info("Draining container connections", "period", period)
+	return true
+}
+
+// finishDrain removes the drain rules and all the rules of a drained
+// container. Returns false if the container was not draining.
+func (h *Handler) finishDrain(tx *iptables.Transaction, id, reason string) bool {
+	h.mu.Lock()
+	d, ok := h.draining[id]
+	delete(h.draining, id)
+	h.mu.Unlock()
+	if !ok {
+		return false
+	}
+	d.timer.Stop()
+	for _, rule := range d.rules {
+		h.queueRule(tx, d.logger, "drain", "-D", rule)
+	}
+	d.logger.Info("Finished draining container connections", "reason", reason)
+	h.removeContainer(tx, d.logger, d.container)
+	return true
+}
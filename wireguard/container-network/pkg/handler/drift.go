@@ -0,0 +1,249 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"container-network/pkg/iptables"
+	"container-network/pkg/watcher"
+)
+
+// driftChains are the chains the rules of the containers are added to, by
+// table. Their rules referencing a container address must be known rules.
+var driftChains = map[string][]string{
+	"nat":    {"PREROUTING", "OUTPUT", "POSTROUTING"},
+	"filter": {"FORWARD"},
+	"mangle": {"PREROUTING"},
+}
+
+// DriftStatus is the result of the last drift check.
+type DriftStatus struct {
+	CheckedAt time.Time `json:"checkedAt"`
+	// Missing are the rules of the containers not found in the live rules.
+	Missing []string `json:"missing,omitempty"`
+	// Unexpected are the live rules referencing a container address that
+	// are not rules of the containers, e.g. added by hand.
+	Unexpected []string `json:"unexpected,omitempty"`
+	// Repaired is set if the differences were repaired.
+	Repaired bool   `json:"repaired,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// CheckDrift compares the live rules with the rules of the known containers
+// every DriftCheckInterval until the context is done.
+func (h *Handler) CheckDrift(ctx context.Context) {
+	if h.config.DriftCheckInterval <= 0 {
+		return
+	}
+	slog.Info("Drift check started", "interval", h.config.DriftCheckInterval, "repair", h.config.DriftRepair)
+	ticker := time.NewTicker(h.config.DriftCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.checkDrift()
+		}
+	}
+}
+
+// checkDrift reads the live rules with iptables-save and reports the rules
+// of the known containers that are missing and the unexpected ones, e.g.
+// after a flush of the nat or mangle table. With DriftRepair the differences
+// are repaired in the same transaction.
+func (h *Handler) checkDrift() {
+	h.applyRules(func(tx *iptables.Transaction) {
+		status := &DriftStatus{CheckedAt: time.Now()}
+		defer func() {
+			h.mu.Lock()
+			h.drift = status
+			h.mu.Unlock()
+		}()
+		h.mu.Lock()
+		var containers []watcher.ContainerInfo
+		var addresses []string
+		for id, c := range h.containers {
+			if c.IPAddress == "" {
+				continue
+			}
+			addresses = append(addresses, c.IPAddress)
+			// preparing and failed containers have no rules yet
+			if _, ok := h.failed[id]; !ok && !h.preparing[id] {
+				containers = append(containers, c)
+			}
+		}
+		h.mu.Unlock()
+
+		// desired rules by canonical form, with their count
+		type desired struct {
+			c     watcher.ContainerInfo
+			rule  desiredRule
+			count int
+		}
+		wanted := make(map[string]*desired)
+		var order []string
+		for _, c := range containers {
+			logger := slog.New(slog.DiscardHandler)
+			for _, r := range h.desiredRules(logger, c) {
+				key := strings.Join(iptables.Canonical(r.rule), " ")
+				if d, ok := wanted[key]; ok {
+					d.count++
+					continue
+				}
+				wanted[key] = &desired{c: c, rule: r, count: 1}
+				order = append(order, key)
+			}
+		}
+
+		var unexpected [][]string
+		for table, chains := range driftChains {
+			rules, err := iptables.Save(table)
+			if err != nil {
+				slog.Error("Failed to read the live rules", "table", table, "error", err)
+				status.Error = err.Error()
+				return
+			}
+			for _, rule := range rules {
+				if !contains(chains, rule[2]) {
+					continue
+				}
+				if d, ok := wanted[strings.Join(rule, " ")]; ok && d.count > 0 {
+					d.count--
+					continue
+				}
+				if referencesAddress(rule, addresses) {
+					unexpected = append(unexpected, rule)
+				}
+			}
+		}
+
+		repairedAccess := make(map[string]bool)
+		for _, key := range order {
+			d := wanted[key]
+			logger := slog.With("container", d.c.Name, "containerID", d.c.ID[:12], "ip", d.c.IPAddress)
+			for ; d.count > 0; d.count-- {
+				status.Missing = append(status.Missing, key)
+				logger.Warn("Drift: missing "+d.rule.kind+" rule", "rule", strings.Join(d.rule.rule, " "))
+				if !h.config.DriftRepair {
+					continue
+				}
+				if d.rule.kind == "peer access" {
+					// restored in order
+					if !repairedAccess[d.c.ID] {
+						repairedAccess[d.c.ID] = true
+						h.recheckAccess(tx, logger, d.c.ID)
+					}
+					continue
+				}
+				h.queueRule(tx, logger, d.rule.kind, d.rule.action, d.rule.rule)
+			}
+		}
+		for _, rule := range unexpected {
+			text := strings.Join(rule, " ")
+			status.Unexpected = append(status.Unexpected, text)
+			slog.Warn("Drift: unexpected rule", "rule", text)
+			if h.config.DriftRepair {
+				h.queueRule(tx, slog.Default(), "unexpected", "-D", rule)
+			}
+		}
+		if len(status.Missing) == 0 && len(status.Unexpected) == 0 {
+			slog.Debug("Drift check found no differences")
+		} else {
+			status.Repaired = h.config.DriftRepair
+		}
+	})
+	h.writeStatus()
+}
+
+// OwnedRules returns the live rules of the chains used for the containers
+// that match or target an owned address, e.g. an address of the watched
+// network. They are listed by iptables-save, sorted by table.
+func OwnedRules(owned func(ip net.IP) bool) ([][]string, error) {
+	return liveRules(func(rule []string) bool {
+		for _, arg := range rule[3:] {
+			if ip := ruleAddress(arg); ip != nil && owned(ip) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// RecordedRules returns the live rules of the containers of a status file,
+// listed by iptables-save, sorted by table. Unlike OwnedRules, the other
+// rules of the container addresses are left out.
+func RecordedRules(status *Status) ([][]string, error) {
+	recorded := make(map[string]bool)
+	for _, c := range status.Containers {
+		for _, r := range c.Rules {
+			recorded[strings.Join(iptables.Canonical(strings.Fields(r.Rule)), " ")] = true
+		}
+	}
+	return liveRules(func(rule []string) bool {
+		return recorded[strings.Join(rule, " ")]
+	})
+}
+
+// liveRules returns the live rules of the chains used for the containers
+// selected by match.
+func liveRules(match func(rule []string) bool) ([][]string, error) {
+	tables := make([]string, 0, len(driftChains))
+	for table := range driftChains {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	var rules [][]string
+	for _, table := range tables {
+		saved, err := iptables.Save(table)
+		if err != nil {
+			return nil, fmt.Errorf("listing %s rules: %w", table, err)
+		}
+		for _, rule := range saved {
+			if contains(driftChains[table], rule[2]) && match(rule) {
+				rules = append(rules, rule)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// ruleAddress returns the address of a host match (address/32) or of a
+// destination (address:port) of a rule listed by iptables-save.
+func ruleAddress(arg string) net.IP {
+	if address, ok := strings.CutSuffix(arg, "/32"); ok {
+		return net.ParseIP(address).To4()
+	}
+	if address, _, ok := strings.Cut(arg, ":"); ok {
+		return net.ParseIP(address).To4()
+	}
+	return nil
+}
+
+// referencesAddress returns true if a rule listed by iptables-save matches
+// or targets one of the addresses.
+func referencesAddress(rule []string, addresses []string) bool {
+	for _, arg := range rule[3:] {
+		for _, address := range addresses {
+			if arg == address+"/32" || strings.HasPrefix(arg, address+":") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// contains returns true if the list contains the value.
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
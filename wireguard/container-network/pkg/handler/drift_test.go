@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"container-network/pkg/iptables"
+)
+
+func TestRuleAddress(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want net.IP
+	}{
+		{arg: "172.20.0.5/32", want: net.IPv4(172, 20, 0, 5).To4()},
+		{arg: "172.20.0.5:80", want: net.IPv4(172, 20, 0, 5).To4()},
+		{arg: "172.20.0.5:80-81", want: net.IPv4(172, 20, 0, 5).To4()},
+		{arg: "172.20.0.0/16", want: nil},
+		{arg: "172.20.0.5", want: nil},
+		{arg: "wg0", want: nil},
+		{arg: "0x2/0xffffffff", want: nil},
+		{arg: "fd00::5/32", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.arg, func(t *testing.T) {
+			if got := ruleAddress(tt.arg); !got.Equal(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReferencesAddress(t *testing.T) {
+	addresses := []string{"172.20.0.5", "172.20.0.6"}
+	tests := []struct {
+		rule string
+		want bool
+	}{
+		{rule: "-t filter FORWARD -d 172.20.0.5/32 -j ACCEPT", want: true},
+		{rule: "-t nat PREROUTING -p tcp -m tcp --dport 80 -j DNAT --to-destination 172.20.0.6:80", want: true},
+		{rule: "-t filter FORWARD -d 172.20.0.50/32 -j ACCEPT", want: false},
+		{rule: "-t nat POSTROUTING -s 172.20.0.0/16 -o wg0 -j MASQUERADE", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			if got := referencesAddress(strings.Fields(tt.rule), addresses); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOwnedAndRecordedRules(t *testing.T) {
+	command := iptables.SaveCommand
+	t.Cleanup(func() { iptables.SaveCommand = command })
+	// the table is the last argument
+	iptables.SaveCommand = []string{"sh", "-c", `case "$2" in
+nat) printf '%s\n' '*nat' \
+	'-A PREROUTING -p tcp -m tcp --dport 80 -j DNAT --to-destination 172.20.0.5:80' \
+	'-A PREROUTING -p tcp -m tcp --dport 81 -j DNAT --to-destination 172.20.0.5:81' \
+	'-A POSTROUTING -s 172.20.0.0/16 -o wg0 -j MASQUERADE' \
+	'-A DOCKER -d 172.20.0.5/32 -j RETURN' 'COMMIT' ;;
+filter) printf '%s\n' '*filter' \
+	'-A FORWARD -d 172.20.0.5/32 -p tcp -m tcp --dport 80 -j ACCEPT' \
+	'-A FORWARD -d 172.20.1.9/32 -j ACCEPT' 'COMMIT' ;;
+esac`, "iptables-save"}
+
+	_, subnet, _ := net.ParseCIDR("172.20.0.0/24")
+	owned, err := OwnedRules(subnet.Contains)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"-t filter FORWARD -d 172.20.0.5/32 -p tcp -m tcp --dport 80 -j ACCEPT",
+		"-t nat PREROUTING -p tcp -m tcp --dport 80 -j DNAT --to-destination 172.20.0.5:80",
+		"-t nat PREROUTING -p tcp -m tcp --dport 81 -j DNAT --to-destination 172.20.0.5:81",
+	}
+	if got := joinRules(owned); !reflect.DeepEqual(got, want) {
+		t.Errorf("got owned rules %q, want %q", got, want)
+	}
+
+	status := &Status{Containers: []ContainerStatus{{
+		ID: "abc",
+		IP: "172.20.0.5",
+		Rules: []RuleStatus{
+			{Kind: "DNAT", Rule: "-t nat PREROUTING -p tcp --dport 80 -j DNAT --to-destination 172.20.0.5:80"},
+			{Kind: "FORWARD", Rule: "-t filter FORWARD -p tcp -d 172.20.0.5 --dport 80 -j ACCEPT"},
+			{Kind: "DNAT", Rule: "-t nat PREROUTING -p tcp --dport 82 -j DNAT --to-destination 172.20.0.5:82"},
+		},
+	}}}
+	recorded, err := RecordedRules(status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{
+		"-t filter FORWARD -d 172.20.0.5/32 -p tcp -m tcp --dport 80 -j ACCEPT",
+		"-t nat PREROUTING -p tcp -m tcp --dport 80 -j DNAT --to-destination 172.20.0.5:80",
+	}
+	if got := joinRules(recorded); !reflect.DeepEqual(got, want) {
+		t.Errorf("got recorded rules %q, want %q", got, want)
+	}
+}
+
+func joinRules(rules [][]string) []string {
+	var joined []string
+	for _, rule := range rules {
+		joined = append(joined, strings.Join(rule, " "))
+	}
+	return joined
+}
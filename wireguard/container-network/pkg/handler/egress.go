@@ -0,0 +1,233 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"syscall"
+
+	"container-network/pkg/config"
+	"container-network/pkg/iptables"
+	"container-network/pkg/netlink"
+	"container-network/pkg/watcher"
+)
+
+// Egress label values not referring to an egress route.
+const (
+	// egressVPN sends the container traffic through the tunnel (main routing table).
+	egressVPN = "vpn"
+	// egressBlocked rejects new outbound connections of the container.
+	egressBlocked = "blocked"
+)
+
+// appliedEgress is the egress policy installed for a container.
+type appliedEgress struct {
+	containerName string
+	name          string
+	ip            string
+	rule          *netlink.Rule
+	rules         [][]string
+	// blocked is set while the kill switch rule is installed
+	blocked bool
+}
+
+// applyContainerEgress installs the source based routing rule and FORWARD rules
+// selected by the egress label of a container.
+func (h *Handler) applyContainerEgress(tx *iptables.Transaction, logger *slog.Logger, c watcher.ContainerInfo) {
+	if h.config.EgressLabel == "" || c.IPAddress == "" {
+		return
+	}
+	value, ok := c.Labels[h.config.EgressLabel]
+	if !ok {
+		return
+	}
+	name := strings.TrimSpace(value)
+	logger = logger.With("egress", name)
+	applied := &appliedEgress{containerName: c.Name, name: name, ip: c.IPAddress}
+	switch name {
+	case egressVPN:
+		applied.rules = [][]string{
+			{"-t", "filter", "FORWARD", "-s", c.IPAddress, "-o", h.config.TunnelInterface, "-j", "ACCEPT"},
+		}
+	case egressBlocked:
+		applied.rules = [][]string{
+			{"-t", "filter", "FORWARD", "-s", c.IPAddress, "-m", "conntrack", "--ctstate", "NEW", "-j", "REJECT"},
+		}
+	default:
+		route, ok := h.egressRoute(name)
+		if !ok {
+			logger.Warn("Unknown egress route in egress label", "label", h.config.EgressLabel)
+			return
+		}
+		applied.rule = &netlink.Rule{
+			Priority: h.config.EgressRulePriority,
+			Src:      &net.IPNet{IP: net.ParseIP(c.IPAddress).To4(), Mask: net.CIDRMask(32, 32)},
+			Table:    route.Table,
+		}
+		device, err := h.egressDevice(route)
+		if err != nil {
+			logger.Error("Failed to find the interface of the egress route", "error", err)
+			tx.Fail(fmt.Errorf("egress route %s: %w", name, err))
+			return
+		}
+		applied.rules = [][]string{
+			{"-t", "filter", "FORWARD", "-s", c.IPAddress, "-o", device, "-j", "ACCEPT"},
+			{"-t", "nat", "POSTROUTING", "-s", c.IPAddress, "-o", device, "-j", "MASQUERADE"},
+		}
+	}
+	if applied.rule != nil {
+		h.addRoutingRule(tx, logger, "egress", applied.rule)
+	}
+	for _, rule := range applied.rules {
+		h.queueRule(tx, logger, "egress", "-I", rule)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.egress[c.ID] = applied
+	if h.config.KillSwitch && name == egressVPN && h.tunnelDown {
+		h.engageKillSwitch(tx, applied)
+	}
+}
+
+// removeContainerEgress removes the egress policy installed for a container.
+func (h *Handler) removeContainerEgress(tx *iptables.Transaction, logger *slog.Logger, c watcher.ContainerInfo) {
+	h.mu.Lock()
+	applied, ok := h.egress[c.ID]
+	delete(h.egress, c.ID)
+	if ok {
+		h.liftKillSwitch(tx, applied)
+	}
+	h.mu.Unlock()
+	if !ok {
+		return
+	}
+	logger = logger.With("egress", applied.name)
+	if applied.rule != nil {
+		h.removeRoutingRule(logger, "egress", applied.rule)
+	}
+	for _, rule := range applied.rules {
+		h.queueRule(tx, logger, "egress", "-D", rule)
+	}
+}
+
+// egressRoute returns the egress route with the given name.
+func (h *Handler) egressRoute(name string) (config.EgressRoute, bool) {
+	for _, route := range h.config.EgressRoutes {
+		if route.Name == name {
+			return route, true
+		}
+	}
+	return config.EgressRoute{}, false
+}
+
+// egressDevice returns the interface of an egress route: its device, or the
+// interface of the default route of its table, e.g. the one the kernel found
+// for its gateway. In dry run, a placeholder is used if it is not found.
+func (h *Handler) egressDevice(route config.EgressRoute) (string, error) {
+	if route.Device != "" {
+		return route.Device, nil
+	}
+	device, err := tableDevice(route.Table)
+	if err != nil && h.planning() {
+		h.planNote("interface of table %d not found: %v", route.Table, err)
+		return fmt.Sprintf("<table-%d-device>", route.Table), nil
+	}
+	return device, err
+}
+
+// tableDevice returns the interface of the default route of a routing table.
+func tableDevice(table int) (string, error) {
+	handle, err := netlink.NewHandle()
+	if err != nil {
+		return "", err
+	}
+	defer handle.Close()
+	routes, err := handle.RouteList(table)
+	if err != nil {
+		return "", fmt.Errorf("listing routes of table %d: %w", table, err)
+	}
+	for _, route := range routes {
+		if route.Dst != nil || route.LinkIndex == 0 {
+			continue
+		}
+		links, err := handle.LinkList()
+		if err != nil {
+			return "", fmt.Errorf("listing links: %w", err)
+		}
+		for _, link := range links {
+			if link.Index == route.LinkIndex {
+				return link.Name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no default route with an interface in table %d", table)
+}
+
+// egressRule adds or deletes a policy routing rule.
+func egressRule(rule *netlink.Rule, add bool) error {
+	handle, err := netlink.NewHandle()
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	if add {
+		return handle.RuleAdd(rule)
+	}
+	return handle.RuleDel(rule)
+}
+
+// addRoutingRule adds a routing rule of a container. In a unit, a failure
+// fails the unit, which is retried as a whole, and the rule is removed when
+// the unit is rolled back. Otherwise a failure is retried with backoff.
+func (h *Handler) addRoutingRule(tx *iptables.Transaction, logger *slog.Logger, kind string, rule *netlink.Rule) {
+	key := routingRetryRule(rule)
+	if h.supersedeRetry(logger, "-A", key) {
+		// its removal failed, the rule is still there
+		return
+	}
+	if err := h.routingRule(rule, true); err != nil {
+		logger.Error("Failed to add "+kind+" routing rule", "rule", rule.String(), "error", err)
+		if !tx.Fail(fmt.Errorf("adding %s routing rule %s: %w", kind, rule, err)) {
+			h.retryRule(&ruleRetry{logger: logger, kind: kind + " routing", action: "-A", rule: key, routing: rule}, err)
+		}
+		return
+	}
+	logger.Info("Added "+kind+" routing rule", "rule", rule.String())
+	tx.Undo(func() {
+		if err := h.routingRule(rule, false); err != nil {
+			logger.Error("Failed to remove "+kind+" routing rule of the rolled back rules", "rule", rule.String(), "error", err)
+			return
+		}
+		logger.Info("Removed "+kind+" routing rule of the rolled back rules", "rule", rule.String())
+	})
+}
+
+// removeRoutingRule removes a routing rule of a container, a failure is
+// retried with backoff. A pending retry of its addition is dropped instead.
+func (h *Handler) removeRoutingRule(logger *slog.Logger, kind string, rule *netlink.Rule) {
+	key := routingRetryRule(rule)
+	if h.supersedeRetry(logger, "-D", key) {
+		// its addition failed, the rule is not there
+		return
+	}
+	if err := h.routingRule(rule, false); err != nil && !routingRuleGone("-D", err) {
+		logger.Error("Failed to remove "+kind+" routing rule", "rule", rule.String(), "error", err)
+		h.retryRule(&ruleRetry{logger: logger, kind: kind + " routing", action: "-D", rule: key, routing: rule}, err)
+		return
+	}
+	logger.Info("Removed "+kind+" routing rule", "rule", rule.String())
+}
+
+// routingRetryRule returns the description of a routing rule identifying
+// its retries, as listed in the status.
+func routingRetryRule(rule *netlink.Rule) []string {
+	return []string{"ip", "rule", rule.String()}
+}
+
+// routingRuleGone returns true if the removal of a routing rule failed
+// because it does not exist.
+func routingRuleGone(action string, err error) bool {
+	return action == "-D" && errors.Is(err, syscall.ENOENT)
+}
@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"container-network/pkg/netlink"
+	"container-network/pkg/watcher"
+)
+
+// gatewayVPN is the gateway label value routing the container through this daemon's container.
+const gatewayVPN = "vpn"
+
+// mainTable is the main routing table of a network namespace.
+const mainTable = 254
+
+// savedGateway is the original default route of a container whose gateway was replaced.
+type savedGateway struct {
+	name  string
+	pid   int
+	route netlink.Route
+}
+
+// setContainerGateway replaces the default route of a container with the VPN
+// container address when the container has the gateway label.
+func (h *Handler) setContainerGateway(logger *slog.Logger, c watcher.ContainerInfo) {
+	if h.config.GatewayLabel == "" {
+		return
+	}
+	value, ok := c.Labels[h.config.GatewayLabel]
+	if !ok {
+		return
+	}
+	if !strings.EqualFold(strings.TrimSpace(value), gatewayVPN) {
+		logger.Warn("Unsupported gateway label value", "label", h.config.GatewayLabel, "value", value)
+		return
+	}
+	if h.config.GatewayAddress == nil {
+		logger.Warn("Unknown VPN container address on the watched network, not setting gateway")
+		return
+	}
+	if h.planning() {
+		h.planNote("ip route replace default via %s, in the network namespace of %s", h.config.GatewayAddress, c.Name)
+		return
+	}
+	if c.Pid <= 0 {
+		logger.Warn("Unknown container process, not setting gateway")
+		return
+	}
+	logger = logger.With("gateway", h.config.GatewayAddress.String(), "pid", c.Pid)
+	original, err := replaceDefaultRoute(c.Pid, netlink.Route{Gateway: h.config.GatewayAddress, Table: mainTable})
+	if err != nil {
+		logger.Error("Failed to set container default gateway", "error", err)
+		return
+	}
+	h.mu.Lock()
+	h.gateways[c.ID] = savedGateway{name: c.Name, pid: c.Pid, route: *original}
+	h.mu.Unlock()
+	logger.Info("Set container default gateway", "previous", original.String())
+}
+
+// forgetContainerGateway drops the saved default route of a stopped container,
+// its network namespace is already gone.
+func (h *Handler) forgetContainerGateway(c watcher.ContainerInfo) {
+	h.mu.Lock()
+	delete(h.gateways, c.ID)
+	h.mu.Unlock()
+}
+
+// RestoreGateways puts back the original default route of all containers whose
+// gateway was replaced.
+func (h *Handler) RestoreGateways() {
+	h.mu.Lock()
+	gateways := h.gateways
+	h.gateways = make(map[string]savedGateway)
+	h.mu.Unlock()
+	for id, saved := range gateways {
+		logger := slog.With("container", saved.name, "containerID", id[:12], "pid", saved.pid)
+		if _, err := replaceDefaultRoute(saved.pid, saved.route); err != nil {
+			logger.Error("Failed to restore container default gateway", "error", err)
+		} else {
+			logger.Info("Restored container default gateway", "route", saved.route.String())
+		}
+	}
+}
+
+// replaceDefaultRoute replaces the default route in the network namespace of
+// the process and returns the previous one.
+func replaceDefaultRoute(pid int, route netlink.Route) (*netlink.Route, error) {
+	handle, err := netlink.NewHandleAt(fmt.Sprintf("/proc/%d/ns/net", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+	routes, err := handle.RouteList(mainTable)
+	if err != nil {
+		return nil, fmt.Errorf("listing routes: %w", err)
+	}
+	var original *netlink.Route
+	for _, r := range routes {
+		if r.Dst == nil {
+			original = &r
+			break
+		}
+	}
+	if original == nil {
+		return nil, fmt.Errorf("no default route found")
+	}
+	if err := handle.RouteReplace(&route); err != nil {
+		return nil, fmt.Errorf("replacing default route: %w", err)
+	}
+	return original, nil
+}
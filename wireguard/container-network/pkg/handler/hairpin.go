@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"fmt"
+	"log/slog"
+
+	"container-network/pkg/iptables"
+	"container-network/pkg/watcher"
+)
+
+// hairpinEnabled returns true if internal clients can reach the DNAT ports
+// through the public VPN address.
+func (h *Handler) hairpinEnabled() bool {
+	return h.config.Hairpin && h.config.PublicAddress != nil && h.config.InternalSubnet != "" && h.config.InternalInterface != ""
+}
+
+// hairpinRules returns the rules redirecting the connections of internal
+// clients (and of this container) to the public address and external port
+// of a DNAT port, masquerading them so the replies come back through here.
+func (h *Handler) hairpinRules(containerIP string, p port, externalPort uint16) [][]string {
+	if !h.hairpinEnabled() {
+		return nil
+	}
+	publicAddress := h.config.PublicAddress.String()
+	destination := fmt.Sprintf("%s:%d", containerIP, p.port)
+	return [][]string{
+		{"-t", "nat", "PREROUTING", "-i", h.config.InternalInterface, "-s", h.config.InternalSubnet, "-d", publicAddress, "-p", p.protocol, "--dport", fmt.Sprintf("%d", externalPort), "-j", "DNAT", "--to-destination", destination},
+		{"-t", "nat", "OUTPUT", "-d", publicAddress, "-p", p.protocol, "--dport", fmt.Sprintf("%d", externalPort), "-j", "DNAT", "--to-destination", destination},
+		{"-t", "filter", "FORWARD", "-i", h.config.InternalInterface, "-s", h.config.InternalSubnet, "-d", containerIP, "-p", p.protocol, "--dport", fmt.Sprintf("%d", p.port), "-j", "ACCEPT"},
+		{"-t", "nat", "POSTROUTING", "-o", h.config.InternalInterface, "-s", h.config.InternalSubnet, "-d", containerIP, "-p", p.protocol, "--dport", fmt.Sprintf("%d", p.port), "-j", "MASQUERADE"},
+	}
+}
+
+// applyContainerHairpin installs the hairpin rules of the DNAT ports of a
+// container. Ports mapped with NAT-PMP get them with the mapping rules.
+func (h *Handler) applyContainerHairpin(tx *iptables.Transaction, logger *slog.Logger, c watcher.ContainerInfo, ports []port) {
+	if !h.hairpinEnabled() || c.IPAddress == "" || len(ports) == 0 {
+		return
+	}
+	var rules [][]string
+	for _, p := range ports {
+		rules = append(rules, h.hairpinRules(c.IPAddress, p, p.external)...)
+	}
+	for _, rule := range rules {
+		h.queueRule(tx, logger, "hairpin", "-A", rule)
+	}
+	h.mu.Lock()
+	h.hairpin[c.ID] = rules
+	h.mu.Unlock()
+}
+
+// removeContainerHairpin removes the hairpin rules of a container.
+func (h *Handler) removeContainerHairpin(tx *iptables.Transaction, logger *slog.Logger, c watcher.ContainerInfo) {
+	h.mu.Lock()
+	rules, ok := h.hairpin[c.ID]
+	delete(h.hairpin, c.ID)
+	h.mu.Unlock()
+	if !ok {
+		return
+	}
+	for _, rule := range rules {
+		h.queueRule(tx, logger, "hairpin", "-D", rule)
+	}
+}
@@ -4,44 +4,183 @@ package handler
 import (
 	"context"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
 	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"container-network/pkg/config"
+	"container-network/pkg/iptables"
+	"container-network/pkg/peers"
+	"container-network/pkg/portpool"
 	"container-network/pkg/watcher"
 )
 
+// Config contains handler configuration.
+type Config struct {
+	// IptablesMangleMarkPublishedPorts is the default iptables mark value for
+	// published ports. If empty, only containers selecting a mark by label are marked.
+	IptablesMangleMarkPublishedPorts string
+	// IptablesDnatPortsLabel is the label name containing DNAT port mappings.
+	IptablesDnatPortsLabel string
+	// IptablesMarkLabel is the label name selecting an egress route (or a raw
+	// mark value) for the published ports of a container.
+	IptablesMarkLabel string
+	// EgressRoutes maps egress names to marks and routing tables.
+	EgressRoutes []config.EgressRoute
+	// GatewayLabel is the label name to replace the default route of a container.
+	GatewayLabel string
+	// GatewayAddress is the address of this container on the watched network,
+	// used as default gateway of the labelled containers.
+	GatewayAddress net.IP
+	// EgressLabel is the label name selecting the egress policy of all the
+	// outbound traffic of a container: an egress route name, "vpn" or "blocked".
+	EgressLabel string
+	// EgressRulePriority is the priority of the source based routing rules.
+	EgressRulePriority int
+	// TunnelInterface is the primary WireGuard interface.
+	TunnelInterface string
+	// Tunnels is the failover order of the WireGuard interfaces. With more
+	// than one, DNAT ports and egress are bound to the selected tunnel.
+	Tunnels []config.Tunnel
+	// TunnelLabel is the label name selecting the preferred tunnel of a container.
+	TunnelLabel string
+	// AllowPeersLabel is the label name restricting the WireGuard peers
+	// allowed to reach a container through the tunnel.
+	AllowPeersLabel string
+	// NATPMPGateway is the NAT-PMP server of the VPN provider. If set, the
+	// DNAT ports are mapped with NAT-PMP and bound to the granted external ports.
+	NATPMPGateway net.IP
+	// NATPMPLifetime is the requested lifetime of the NAT-PMP mappings.
+	NATPMPLifetime time.Duration
+	// Hairpin lets internal clients reach the DNAT ports through PublicAddress.
+	Hairpin bool
+	// PublicAddress is the public address of the VPN.
+	PublicAddress net.IP
+	// InternalSubnet is the subnet of the watched network.
+	InternalSubnet string
+	// InternalInterface is the interface attached to the watched network.
+	InternalInterface string
+	// SNATLabel is the label name enabling the masquerading of the DNATed
+	// connections of a container on InternalInterface.
+	SNATLabel string
+	// PortPool allocates the external ports of the "auto:" DNAT ports.
+	PortPool *portpool.Pool
+	// DrainPeriod is the time the established connections to the DNAT ports
+	// of a stopped container are still forwarded, zero disables draining.
+	DrainPeriod time.Duration
+	// DrainLabel is the label name overriding the drain period of a container.
+	DrainLabel string
+	// DriftCheckInterval is the interval to compare the live rules with the
+	// rules of the known containers, zero disables the check.
+	DriftCheckInterval time.Duration
+	// DriftRepair installs the missing rules and removes the unexpected
+	// ones found by the drift check.
+	DriftRepair bool
+	// Plan, if set, receives the rule changes as iptables commands instead
+	// of applying them (dry run). Nothing else is changed.
+	Plan io.Writer
+	// StatusFile is the file where the status of the containers is written as JSON.
+	StatusFile string
+	// KillSwitch rejects the traffic of containers with "vpn" egress while
+	// the tunnel interface is down or missing.
+	KillSwitch bool
+}
+
 // Handler processes container events.
 type Handler struct {
-	events                           <-chan watcher.ContainerEvent
-	iptablesMangleMarkPublishedPorts string
-	iptablesDnatPortsLabel           string
+	events   <-chan watcher.ContainerEvent
+	config   Config
+	gateways map[string]savedGateway
+	egress   map[string]*appliedEgress
+	// containers are the known running containers by ID
+	containers map[string]watcher.ContainerInfo
+	// preparing are the started containers without rules applied yet by ID
+	preparing map[string]bool
+	tunnels   map[string]*appliedTunnel
+	access    map[string]*appliedAccess
+	mappings  map[string]*portMappings
+	hairpin   map[string][][]string
+	snat      map[string]*appliedSNAT
+	// draining are the stopped containers draining their connections by ID
+	draining map[string]*drain
+	// failed are the running containers with rules to apply again by ID
+	failed map[string]*failedContainer
+	// retries are the failed rule changes to apply again by rule
+	retries map[string]*ruleRetry
+	// drift is the result of the last drift check
+	drift *DriftStatus
+	// history are the recent container events, the oldest first
+	history []EventStatus
+	// peers are the peers of the WireGuard server configuration
+	peers []peers.Peer
+	// tunnelHealth is the last reported health of each tunnel interface,
+	// tunnels without reported health are considered healthy
+	tunnelHealth map[string]bool
+	// tunnelDown is set while the tunnel interface is down or missing
+	tunnelDown bool
+	mu         sync.Mutex
+	// applyMu serializes the transactions of the rule changes
+	applyMu sync.Mutex
+	// retryMu guards retries, it may be locked with h.mu held
+	retryMu  sync.Mutex
+	statusMu sync.Mutex
+	// snatPorts are the masqueraded DNAT ports, guarded by snatMu so the
+	// conntrack events are filtered without h.mu
+	snatPorts map[snatPort]snatContainer
+	// snatChanged wakes LogSNATConnections when the first masqueraded port
+	// is added or the last one removed
+	snatChanged chan struct{}
+	snatMu      sync.RWMutex
 }
 
 // port represents a port with protocol for iptables rules.
 type port struct {
 	port     uint16
 	protocol string
+	// external is the DNAT port reachable through the tunnel, the same as
+	// port unless allocated from the pool
+	external uint16
+	// auto is set for ports with the external port allocated from the pool
+	auto bool
 }
 
 const (
 	warmUpMaxAttempts = 60
 	warmUpTimeout     = 1 * time.Second
 	warmUpInterval    = 1 * time.Second
+	// warmUpBatchTimeout is how long a batch waits for the warm-ups of its
+	// started containers, the later ones get their rules applied on their own
+	warmUpBatchTimeout = 5 * time.Second
 )
 
 // NewHandler creates a new event handler.
-// iptablesMangleMarkPublishedPorts is the iptables mark value to use for published ports.
-// If empty, iptables rules are not created.
-// iptablesDnatPortsLabel is the label name containing DNAT port mappings.
-func NewHandler(events <-chan watcher.ContainerEvent, iptablesMangleMarkPublishedPorts, iptablesDnatPortsLabel string) *Handler {
+func NewHandler(events <-chan watcher.ContainerEvent, config Config) *Handler {
+	if config.Plan != nil {
+		config.Plan = &planWriter{w: config.Plan}
+	}
 	return &Handler{
-		events:                           events,
-		iptablesMangleMarkPublishedPorts: iptablesMangleMarkPublishedPorts,
-		iptablesDnatPortsLabel:           iptablesDnatPortsLabel,
+		events:       events,
+		config:       config,
+		gateways:     make(map[string]savedGateway),
+		egress:       make(map[string]*appliedEgress),
+		containers:   make(map[string]watcher.ContainerInfo),
+		preparing:    make(map[string]bool),
+		tunnels:      make(map[string]*appliedTunnel),
+		access:       make(map[string]*appliedAccess),
+		mappings:     make(map[string]*portMappings),
+		hairpin:      make(map[string][][]string),
+		snat:         make(map[string]*appliedSNAT),
+		draining:     make(map[string]*drain),
+		failed:       make(map[string]*failedContainer),
+		retries:      make(map[string]*ruleRetry),
+		tunnelHealth: make(map[string]bool),
+		snatPorts:    make(map[snatPort]snatContainer),
+		snatChanged:  make(chan struct{}, 1),
 	}
 }
 
@@ -58,71 +197,281 @@ func (h *Handler) Start(ctx context.Context) error {
 				slog.Info("Event channel closed")
 				return nil
 			}
+			// events of the same batch (e.g. the initial discovery) are
+			// applied with one transaction
+			events := []watcher.ContainerEvent{event}
+			for event.Pending > 0 && ok {
+				select {
+				case <-ctx.Done():
+					slog.Info("Event handler stopping...")
+					return ctx.Err()
+				case event, ok = <-h.events:
+					if ok {
+						events = append(events, event)
+					}
+				}
+			}
+			go h.handleEvents(events)
+		}
+	}
+}
+
+// Handle applies a batch of events synchronously, like Start does for the
+// batches received from the events channel.
+func (h *Handler) Handle(events []watcher.ContainerEvent) {
+	h.handleEvents(events)
+}
+
+// handleEvents handles a batch of container events. The gateways of the
+// started containers are set and their reverse paths warmed up concurrently,
+// then the rules of all the events are changed in one transaction. A started
+// container still warming up after warmUpBatchTimeout does not hold back the
+// batch: its rules are applied in their own transaction once it is done.
+func (h *Handler) handleEvents(events []watcher.ContainerEvent) {
+	prepared := make([]chan struct{}, len(events))
+	for i, event := range events {
+		if event.Type == watcher.ContainerStarted {
+			done := make(chan struct{})
+			prepared[i] = done
+			go func() {
+				defer close(done)
+				h.prepareContainer(event)
+			}()
+		}
+	}
+	timeout := time.NewTimer(warmUpBatchTimeout)
+	defer timeout.Stop()
+	expired := false
+	var batch []watcher.ContainerEvent
+	for i, event := range events {
+		if prepared[i] != nil && !expired {
+			select {
+			case <-prepared[i]:
+			case <-timeout.C:
+				expired = true
+			}
+		}
+		if prepared[i] != nil && expired {
+			select {
+			case <-prepared[i]:
+			default:
+				go h.handleLateContainer(event, prepared[i])
+				continue
+			}
+		}
+		batch = append(batch, event)
+	}
+	h.applyRules(func(tx *iptables.Transaction) {
+		for _, event := range batch {
 			switch event.Type {
 			case watcher.ContainerStarted:
-				go h.handleContainerStarted(event)
+				h.handleContainerStarted(tx, event)
 			case watcher.ContainerStopped:
-				go h.handleContainerStopped(event)
+				h.handleContainerStopped(tx, event)
+			case watcher.ContainerDied:
+				h.handleContainerDied(tx, event)
 			}
 		}
-	}
+	})
+	h.recordEvents(batch)
+	h.writeStatus()
+}
+
+// handleLateContainer applies the rules of a started container left out of
+// its batch once its warm-up is done.
+func (h *Handler) handleLateContainer(event watcher.ContainerEvent, prepared <-chan struct{}) {
+	eventLogger(event).Info("Reverse path still warming up, applying the rules of the container later")
+	<-prepared
+	h.applyRules(func(tx *iptables.Transaction) {
+		h.handleContainerStarted(tx, event)
+	})
+	h.recordEvents([]watcher.ContainerEvent{event})
+	h.writeStatus()
+}
+
+// eventLogger returns the logger of a container event.
+func eventLogger(event watcher.ContainerEvent) *slog.Logger {
+	c := event.Container
+	return slog.With("container", c.Name, "containerID", c.ID[:12], "timestamp", event.Timestamp.Format("2006-01-02 15:04:05"))
 }
 
-func (h *Handler) handleContainerStarted(event watcher.ContainerEvent) {
+// prepareContainer registers a started container, sets its gateway and warms
+// up its reverse path before its rules are applied.
+func (h *Handler) prepareContainer(event watcher.ContainerEvent) {
 	c := event.Container
-	logger := slog.With("container", c.Name, "containerID", c.ID[:12], "timestamp", event.Timestamp.Format("2006-01-02 15:04:05"))
+	logger := eventLogger(event)
 	logger.Info("Handling container started")
+	// a stop not followed by the container death, its rules are replaced
+	h.applyRules(func(tx *iptables.Transaction) {
+		h.finishDrain(tx, c.ID, "container started")
+	})
+	h.mu.Lock()
+	h.containers[c.ID] = c
+	h.preparing[c.ID] = true
+	h.mu.Unlock()
+	h.setContainerGateway(logger, c)
 	if c.IPAddress != "" {
-		logger = logger.With("ip", c.IPAddress)
 		var cPort uint16
 		var cProtocol string
-		var dnatPorts []port
-
 		if len(c.Ports) > 0 {
 			// Use the first published port for warm-up
 			cPort = c.Ports[0].ContainerPort
 			cProtocol = c.Ports[0].Protocol
 		}
-		h.warmupReversePath(logger, c.IPAddress, cPort, cProtocol)
-		// Get DNAT ports from label (if any)
-		if h.iptablesDnatPortsLabel != "" {
-			if portsValue, ok := c.Labels[h.iptablesDnatPortsLabel]; ok {
-				dnatPorts = parsePorts(logger, portsValue)
-				h.addIptablesDNATRules(logger, c.IPAddress, dnatPorts)
-			}
-		}
-		// Add iptables mangle rules for published ports (excluding DNAT ports)
-		if h.iptablesMangleMarkPublishedPorts != "" {
-			portsToMark := filterPublishedPorts(c.Ports, dnatPorts)
-			h.addIptablesMarkRules(logger, portsToMark)
-		}
+		h.warmupReversePath(logger.With("ip", c.IPAddress), c.IPAddress, cPort, cProtocol)
 	}
 }
 
-func (h *Handler) handleContainerStopped(event watcher.ContainerEvent) {
+func (h *Handler) handleContainerStarted(tx *iptables.Transaction, event watcher.ContainerEvent) {
 	c := event.Container
-	logger := slog.With("container", c.Name, "containerID", c.ID[:12], "timestamp", event.Timestamp.Format("2006-01-02 15:04:05"))
+	h.mu.Lock()
+	_, ok := h.containers[c.ID]
+	delete(h.preparing, c.ID)
+	h.mu.Unlock()
+	if !ok || c.IPAddress == "" {
+		// stopped while preparing
+		return
+	}
+	logger := eventLogger(event).With("ip", c.IPAddress)
+	// the rules of the container are applied all or none
+	tx.Unit(func() {
+		h.applyContainerRules(tx, logger, c)
+	}, func(err error) {
+		h.containerFailed(logger, event, err)
+	})
+}
+
+// applyContainerRules applies the rules and state of a started container.
+func (h *Handler) applyContainerRules(tx *iptables.Transaction, logger *slog.Logger, c watcher.ContainerInfo) {
+	h.applyContainerEgress(tx, logger, c)
+	h.applyContainerAccess(tx, logger, c)
+	var dnatPorts []port
+	// Get DNAT ports from label (if any), allocating the "auto" ones
+	if dnatPorts = h.containerDNATPorts(logger, c, true); len(dnatPorts) > 0 {
+		if h.natpmpEnabled() {
+			h.startPortMappings(logger, c, dnatPorts)
+		} else if !h.multiTunnel() {
+			h.addIptablesDNATRules(tx, logger, c.IPAddress, dnatPorts)
+		}
+	}
+	// Ports mapped with NAT-PMP get their rules with the mapping
+	labelPorts := dnatPorts
+	if h.natpmpEnabled() {
+		labelPorts = nil
+	}
+	// With several tunnels, DNAT ports and egress are bound to the selected one
+	h.applyContainerTunnel(tx, logger, c, labelPorts)
+	h.applyContainerHairpin(tx, logger, c, labelPorts)
+	h.applyContainerSNAT(tx, logger, c, dnatPorts)
+	// Add iptables mangle rules for published ports (excluding DNAT ports)
+	if mark := h.publishedPortsMark(logger, c.Labels); mark != "" {
+		portsToMark := filterPublishedPorts(c.Ports, dnatPorts)
+		h.addIptablesMarkRules(tx, logger.With("mark", mark), mark, c.IPAddress, portsToMark)
+	}
+}
+
+func (h *Handler) handleContainerStopped(tx *iptables.Transaction, event watcher.ContainerEvent) {
+	logger := eventLogger(event)
 	logger.Info("Handling container stopped")
-	if c.IPAddress != "" {
-		logger = logger.With("ip", c.IPAddress)
-		var dnatPorts []port
-		// Get DNAT ports from label (if any)
-		if h.iptablesDnatPortsLabel != "" {
-			if portsValue, ok := c.Labels[h.iptablesDnatPortsLabel]; ok {
-				dnatPorts = parsePorts(logger, portsValue)
-				h.removeIptablesDNATRules(logger, c.IPAddress, dnatPorts)
-			}
+	if h.startDrain(tx, logger, event) {
+		return
+	}
+	h.removeContainer(tx, logger, event.Container)
+}
+
+func (h *Handler) handleContainerDied(tx *iptables.Transaction, event watcher.ContainerEvent) {
+	c := event.Container
+	if h.finishDrain(tx, c.ID, "container died") {
+		return
+	}
+	h.mu.Lock()
+	_, ok := h.containers[c.ID]
+	h.mu.Unlock()
+	if !ok {
+		// already removed when it was stopped
+		return
+	}
+	logger := eventLogger(event)
+	logger.Info("Handling container died")
+	h.removeContainer(tx, logger, c)
+}
+
+// removeContainer removes all the rules and state of a container.
+func (h *Handler) removeContainer(tx *iptables.Transaction, logger *slog.Logger, c watcher.ContainerInfo) {
+	h.mu.Lock()
+	_, ok := h.containers[c.ID]
+	delete(h.containers, c.ID)
+	delete(h.preparing, c.ID)
+	h.mu.Unlock()
+	if !ok {
+		return
+	}
+	h.forgetContainerGateway(c)
+	h.releasePorts(c)
+	if c.IPAddress == "" || h.cancelRetry(c.ID) {
+		// the rules of a failed container were rolled back
+		return
+	}
+	h.removeContainerRules(tx, logger.With("ip", c.IPAddress), c)
+}
+
+// removeContainerRules removes the rules and state of a container applied by
+// applyContainerRules.
+func (h *Handler) removeContainerRules(tx *iptables.Transaction, logger *slog.Logger, c watcher.ContainerInfo) {
+	h.removeContainerEgress(tx, logger, c)
+	h.removeContainerTunnel(tx, logger, c)
+	h.removeContainerAccess(tx, logger, c)
+	h.removeContainerHairpin(tx, logger, c)
+	h.removeContainerSNAT(tx, logger, c)
+	var dnatPorts []port
+	// Get DNAT ports from label (if any)
+	if dnatPorts = h.containerDNATPorts(logger, c, false); len(dnatPorts) > 0 {
+		if h.natpmpEnabled() {
+			h.stopPortMappings(c)
+		} else if !h.multiTunnel() {
+			h.removeIptablesDNATRules(tx, logger, c.IPAddress, dnatPorts)
+		}
+		// NAT-PMP mappings flush their connections when their rules are removed
+		if !h.natpmpEnabled() {
+			tx.Defer(func() {
+				h.flushConntrack(logger, c.IPAddress, dnatPorts)
+			})
 		}
-		// Remove iptables mangle rules for published ports (excluding DNAT ports)
-		if h.iptablesMangleMarkPublishedPorts != "" {
-			portsToUnmark := filterPublishedPorts(c.Ports, dnatPorts)
-			h.removeIptablesMarkRules(logger, portsToUnmark)
+	}
+	// Remove iptables mangle rules for published ports (excluding DNAT ports)
+	if mark := h.publishedPortsMark(logger, c.Labels); mark != "" {
+		portsToUnmark := filterPublishedPorts(c.Ports, dnatPorts)
+		h.removeIptablesMarkRules(tx, logger.With("mark", mark), mark, c.IPAddress, portsToUnmark)
+	}
+}
+
+// publishedPortsMark returns the iptables mark for the published ports of a container.
+// The mark label may reference an egress route by name or contain a raw mark value.
+// Without label (or with an invalid one) the default published ports mark is returned.
+func (h *Handler) publishedPortsMark(logger *slog.Logger, labels map[string]string) string {
+	if h.config.IptablesMarkLabel == "" {
+		return h.config.IptablesMangleMarkPublishedPorts
+	}
+	value, ok := labels[h.config.IptablesMarkLabel]
+	if !ok {
+		return h.config.IptablesMangleMarkPublishedPorts
+	}
+	value = strings.TrimSpace(value)
+	for _, route := range h.config.EgressRoutes {
+		if route.Name == value {
+			return strconv.FormatUint(uint64(route.Mark), 10)
 		}
 	}
+	if mark, err := strconv.ParseUint(value, 0, 32); err == nil && mark > 0 {
+		return value
+	}
+	logger.Warn("Unknown egress route in mark label, using default mark", "label", h.config.IptablesMarkLabel, "value", value)
+	return h.config.IptablesMangleMarkPublishedPorts
 }
 
-// parsePorts parses a comma-separated list of ports in the format "port[/protocol]".
-// If no protocol is specified, defaults to "tcp".
+// parsePorts parses a comma-separated list of ports in the format "[auto:]port[/protocol]".
+// If no protocol is specified, defaults to "tcp". With the "auto:" prefix the
+// external port is allocated from the port pool (see resolvePorts).
 // Example: "80,443/tcp,53/udp" -> [{80, "tcp"}, {443, "tcp"}, {53, "udp"}]
 func parsePorts(logger *slog.Logger, portsStr string) []port {
 	var ports []port
@@ -131,7 +480,8 @@ func parsePorts(logger *slog.Logger, portsStr string) []port {
 		if p == "" {
 			continue
 		}
-		parts := strings.SplitN(p, "/", 2)
+		value, auto := strings.CutPrefix(p, "auto:")
+		parts := strings.SplitN(value, "/", 2)
 		portNum, err := strconv.ParseUint(parts[0], 10, 16)
 		if err != nil {
 			logger.Warn("Invalid port number", "port", parts[0])
@@ -141,7 +491,7 @@ func parsePorts(logger *slog.Logger, portsStr string) []port {
 		if len(parts) == 2 {
 			protocol = strings.ToLower(parts[1])
 		}
-		ports = append(ports, port{port: uint16(portNum), protocol: protocol})
+		ports = append(ports, port{port: uint16(portNum), protocol: protocol, external: uint16(portNum), auto: auto})
 	}
 	return ports
 }
@@ -152,7 +502,7 @@ func filterPublishedPorts(publishedPorts []watcher.PortMapping, dnatPorts []port
 	var filtered []port
 	dnatSet := make(map[uint16]string)
 	for _, p := range dnatPorts {
-		dnatSet[p.port] = p.protocol
+		dnatSet[p.external] = p.protocol
 	}
 	for _, p := range publishedPorts {
 		if protocol, ok := dnatSet[p.HostPort]; ok {
@@ -169,6 +519,9 @@ func filterPublishedPorts(publishedPorts []watcher.PortMapping, dnatPorts []port
 // If port is provided, first tries TCP/UDP connection to the specified port. If that fails after all attempts, falls back to ICMP.
 // If port is 0, uses ICMP ping directly.
 func (h *Handler) warmupReversePath(logger *slog.Logger, ip string, port uint16, protocol string) bool {
+	if h.planning() {
+		return true
+	}
 	// Try with port first if provided
 	if port > 0 {
 		portLogger := logger.With("port", port, "protocol", protocol)
@@ -198,111 +551,112 @@ func (h *Handler) tryConnect(logger *slog.Logger, protocol, address string) bool
 	return false
 }
 
-// addIptablesMarkRules adds iptables mangle PREROUTING rules to mark packets from published ports with mark 2.
-func (h *Handler) addIptablesMarkRules(logger *slog.Logger, ports []port) {
+// addIptablesMarkRules adds iptables mangle PREROUTING rules to mark packets from published ports of a container.
+func (h *Handler) addIptablesMarkRules(tx *iptables.Transaction, logger *slog.Logger, mark, containerIP string, ports []port) {
 	for _, p := range ports {
-		if err := h.iptablesMarkRule(logger, "-A", p.protocol, p.port); err != nil {
-			logger.Error("Failed to add iptables mark rule", "port", p.port, "protocol", p.protocol, "error", err)
-		} else {
-			logger.Info("Added iptables mark rule", "port", p.port, "protocol", p.protocol)
-		}
+		h.queueRule(tx, logger, "iptables mark", "-A", markRule(p.protocol, p.port, containerIP, mark))
 	}
 }
 
 // removeIptablesMarkRules removes iptables mangle PREROUTING rules for the specified published ports.
-func (h *Handler) removeIptablesMarkRules(logger *slog.Logger, ports []port) {
+func (h *Handler) removeIptablesMarkRules(tx *iptables.Transaction, logger *slog.Logger, mark, containerIP string, ports []port) {
 	for _, p := range ports {
-		if err := h.iptablesMarkRule(logger, "-D", p.protocol, p.port); err != nil {
-			logger.Error("Failed to remove iptables mark rule", "port", p.port, "protocol", p.protocol, "error", err)
-		} else {
-			logger.Info("Removed iptables mark rule", "port", p.port, "protocol", p.protocol)
-		}
+		h.queueRule(tx, logger, "iptables mark", "-D", markRule(p.protocol, p.port, containerIP, mark))
 	}
 }
 
-// iptablesMarkRule executes an iptables command to add (-A) or delete (-D) a
-// mangle PREROUTING rule that marks packets with --sport <port>.
-func (h *Handler) iptablesMarkRule(logger *slog.Logger, action, protocol string, port uint16) error {
-	// iptables -t mangle -A PREROUTING -p <protocol> --sport <port> -j MARK --set-mark <value>
-	args := []string{
-		"-t", "mangle",
-		action, "PREROUTING",
+// markRule returns the mangle PREROUTING rule that marks packets from
+// <containerIP> with --sport <port>.
+func markRule(protocol string, port uint16, containerIP, mark string) []string {
+	// iptables -t mangle -A PREROUTING -p <protocol> -s <containerip> --sport <port> -j MARK --set-mark <value>
+	return []string{
+		"-t", "mangle", "PREROUTING",
 		"-p", protocol,
+		"-s", containerIP,
 		"--sport", fmt.Sprintf("%d", port),
 		"-j", "MARK",
-		"--set-mark", h.iptablesMangleMarkPublishedPorts,
-	}
-	logger.Debug("Executing iptables", "args", strings.Join(args, " "))
-	cmd := exec.Command("iptables", args...)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("%v: %s", err, string(output))
+		"--set-mark", mark,
 	}
-	return nil
 }
 
 // addIptablesDNATRules adds DNAT and FORWARD rules for the specified ports.
-func (h *Handler) addIptablesDNATRules(logger *slog.Logger, containerIP string, ports []port) {
+func (h *Handler) addIptablesDNATRules(tx *iptables.Transaction, logger *slog.Logger, containerIP string, ports []port) {
 	for _, p := range ports {
-		if err := h.iptablesDNATRule(logger, "-A", p.protocol, p.port, containerIP); err != nil {
-			logger.Error("Failed to add DNAT rule", "port", p.port, "protocol", p.protocol, "error", err)
-		} else {
-			logger.Info("Added DNAT rule", "port", p.port, "protocol", p.protocol)
-		}
-		if err := h.iptablesForwardRule(logger, "-A", p.protocol, p.port, containerIP); err != nil {
-			logger.Error("Failed to add FORWARD rule", "port", p.port, "protocol", p.protocol, "error", err)
-		} else {
-			logger.Info("Added FORWARD rule", "port", p.port, "protocol", p.protocol)
-		}
+		h.queueRule(tx, logger, "DNAT", "-A", dnatRule(p.protocol, p.external, p.port, containerIP))
+		h.queueRule(tx, logger, "FORWARD", "-A", forwardRule(p.protocol, p.port, containerIP))
 	}
 }
 
 // removeIptablesDNATRules removes DNAT and FORWARD rules for the specified ports.
-func (h *Handler) removeIptablesDNATRules(logger *slog.Logger, containerIP string, ports []port) {
+func (h *Handler) removeIptablesDNATRules(tx *iptables.Transaction, logger *slog.Logger, containerIP string, ports []port) {
 	for _, p := range ports {
-		if err := h.iptablesDNATRule(logger, "-D", p.protocol, p.port, containerIP); err != nil {
-			logger.Error("Failed to remove DNAT rule", "port", p.port, "protocol", p.protocol, "error", err)
-		} else {
-			logger.Info("Removed DNAT rule", "port", p.port, "protocol", p.protocol)
-		}
-		if err := h.iptablesForwardRule(logger, "-D", p.protocol, p.port, containerIP); err != nil {
-			logger.Error("Failed to remove FORWARD rule", "port", p.port, "protocol", p.protocol, "error", err)
-		} else {
-			logger.Info("Removed FORWARD rule", "port", p.port, "protocol", p.protocol)
-		}
+		h.queueRule(tx, logger, "DNAT", "-D", dnatRule(p.protocol, p.external, p.port, containerIP))
+		h.queueRule(tx, logger, "FORWARD", "-D", forwardRule(p.protocol, p.port, containerIP))
 	}
 }
 
-// iptablesDNATRule executes a nat PREROUTING DNAT rule.
-func (h *Handler) iptablesDNATRule(logger *slog.Logger, action, protocol string, port uint16, containerIP string) error {
-	// iptables -t nat -A PREROUTING -p <protocol> --dport <port> -j DNAT --to-destination <containerip>:<port>
-	args := []string{
-		"-t", "nat",
-		action, "PREROUTING",
+// dnatRule returns the nat PREROUTING rule redirecting an external port to a container.
+func dnatRule(protocol string, externalPort, port uint16, containerIP string) []string {
+	// iptables -t nat -A PREROUTING -p <protocol> --dport <externalport> -j DNAT --to-destination <containerip>:<port>
+	return []string{
+		"-t", "nat", "PREROUTING",
 		"-p", protocol,
-		"--dport", fmt.Sprintf("%d", port),
+		"--dport", fmt.Sprintf("%d", externalPort),
 		"-j", "DNAT",
 		"--to-destination", fmt.Sprintf("%s:%d", containerIP, port),
 	}
-	logger.Debug("Executing iptables", "args", strings.Join(args, " "))
-	cmd := exec.Command("iptables", args...)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("%v: %s", err, string(output))
-	}
-	return nil
 }
 
-// iptablesForwardRule executes a FORWARD rule to accept traffic to a container.
-func (h *Handler) iptablesForwardRule(logger *slog.Logger, action, protocol string, port uint16, containerIP string) error {
+// forwardRule returns the FORWARD rule to accept traffic to a container.
+func forwardRule(protocol string, port uint16, containerIP string) []string {
 	// iptables -A FORWARD -p <protocol> -d <containerip> --dport <port> -j ACCEPT
-	args := []string{
-		action, "FORWARD",
+	return []string{
+		"-t", "filter", "FORWARD",
 		"-p", protocol,
 		"-d", containerIP,
 		"--dport", fmt.Sprintf("%d", port),
 		"-j", "ACCEPT",
 	}
+}
+
+// queueRule adds a rule change to the transaction, its outcome is logged
+// when the transaction is committed and a failed change is retried.
+func (h *Handler) queueRule(tx *iptables.Transaction, logger *slog.Logger, kind, action string, rule []string) {
+	h.queueChange(tx, logger, kind, action, rule, func(err error) {
+		text := strings.Join(rule, " ")
+		switch {
+		case err != nil && action == "-D":
+			logger.Error("Failed to remove "+kind+" rule", "rule", text, "error", err)
+		case err != nil:
+			logger.Error("Failed to add "+kind+" rule", "rule", text, "error", err)
+		case action == "-D":
+			logger.Info("Removed "+kind+" rule", "rule", text)
+		default:
+			logger.Info("Added "+kind+" rule", "rule", text)
+		}
+	})
+}
+
+// applyRules queues the rule changes of fn in a transaction and commits it.
+// Transactions are serialized, so the rules are changed in the same order
+// the handler state is updated. fn must release h.mu before returning: the
+// outcome of the changes is reported on commit.
+func (h *Handler) applyRules(fn func(tx *iptables.Transaction)) {
+	h.applyMu.Lock()
+	defer h.applyMu.Unlock()
+	tx := iptables.NewTransaction()
+	fn(tx)
+	if h.planning() {
+		tx.Plan(h.config.Plan)
+		return
+	}
+	tx.Commit()
+}
+
+// iptablesCheck checks with iptables -C if a rule in the format
+// {"-t", table, chain, spec...} exists.
+func iptablesCheck(logger *slog.Logger, rule []string) error {
+	args := append([]string{rule[0], rule[1], "-C", rule[2]}, rule[3:]...)
 	logger.Debug("Executing iptables", "args", strings.Join(args, " "))
 	cmd := exec.Command("iptables", args...)
 	output, err := cmd.CombinedOutput()
@@ -311,3 +665,19 @@ func (h *Handler) iptablesForwardRule(logger *slog.Logger, action, protocol stri
 	}
 	return nil
 }
+
+// iptablesRuleMissing returns true if an iptables error reports that the
+// rule does not exist, as -C and -D do.
+func iptablesRuleMissing(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "does a matching rule exist")
+}
+
+// iptablesRuleGone returns true if the removal of a rule failed because it
+// does not exist, e.g. after a flush of its table. The rule is checked with
+// -C when iptables-restore does not tell the reason.
+func iptablesRuleGone(logger *slog.Logger, action string, rule []string, err error) bool {
+	if action != "-D" {
+		return false
+	}
+	return iptablesRuleMissing(err) || iptablesRuleMissing(iptablesCheck(logger, rule))
+}
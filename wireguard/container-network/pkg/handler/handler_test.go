@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIptablesRuleGone(t *testing.T) {
+	rule := []string{"-t", "nat", "PREROUTING", "-p", "tcp", "--dport", "80", "-j", "DNAT", "--to-destination", "172.20.0.5:80"}
+	restoreErr := errors.New("exit status 1: iptables-restore: line 2 failed")
+	tests := []struct {
+		name   string
+		action string
+		err    error
+		// check is the script run as iptables -C
+		check string
+		want  bool
+	}{
+		{
+			name:   "reported by iptables-restore",
+			action: "-D",
+			err:    errors.New("exit status 1: iptables-restore: line 2 failed: Bad rule (does a matching rule exist in that chain?)."),
+			check:  "exit 0",
+			want:   true,
+		},
+		{
+			name:   "missing for iptables -C",
+			action: "-D",
+			err:    restoreErr,
+			check:  `echo "iptables: Bad rule (does a matching rule exist in that chain?)." >&2; exit 1`,
+			want:   true,
+		},
+		{
+			name:   "still there",
+			action: "-D",
+			err:    restoreErr,
+			check:  "exit 0",
+			want:   false,
+		},
+		{
+			name:   "check failed",
+			action: "-D",
+			err:    restoreErr,
+			check:  `echo "iptables: Permission denied (you must be root)." >&2; exit 4`,
+			want:   false,
+		},
+		{
+			name:   "addition",
+			action: "-A",
+			err:    errors.New("Bad rule (does a matching rule exist in that chain?)"),
+			check:  "exit 1",
+			want:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "iptables"), []byte("#!/bin/sh\n"+tt.check+"\n"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("PATH", dir)
+			if got := iptablesRuleGone(slog.Default(), tt.action, rule, tt.err); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
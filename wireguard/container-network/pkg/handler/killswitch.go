@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"log/slog"
+	"strings"
+
+	"container-network/pkg/iptables"
+	"container-network/pkg/tunnel"
+)
+
+// killSwitchRule returns the FORWARD rule blocking all the traffic of a container.
+func killSwitchRule(containerIP string) []string {
+	return []string{"-t", "filter", "FORWARD", "-s", containerIP, "-j", "REJECT"}
+}
+
+// TunnelStateChanged blocks the traffic of the containers with "vpn" egress when
+// the primary tunnel goes down, and lifts the block when it is back. With
+// several tunnels, containers are moved to the best healthy one. When a tunnel
+// recovers, the rules of all the known containers are checked again.
+func (h *Handler) TunnelStateChanged(previous, current tunnel.State) {
+	if current.Interface == h.config.TunnelInterface && (previous.Since.IsZero() || previous.Up != current.Up) {
+		h.tunnelLinkChanged(current.Up)
+	}
+	h.mu.Lock()
+	h.tunnelHealth[current.Interface] = current.Healthy
+	h.mu.Unlock()
+	if h.multiTunnel() {
+		h.failoverTunnels()
+	}
+	if previous.Since.IsZero() || previous.Healthy || !current.Healthy {
+		return
+	}
+	go h.RecheckContainers()
+}
+
+// tunnelLinkChanged engages or lifts the kill switch of the containers with "vpn" egress.
+func (h *Handler) tunnelLinkChanged(up bool) {
+	h.applyRules(func(tx *iptables.Transaction) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.tunnelDown = !up
+		if !h.config.KillSwitch {
+			return
+		}
+		for _, applied := range h.egress {
+			if applied.name != egressVPN {
+				continue
+			}
+			if up {
+				h.liftKillSwitch(tx, applied)
+			} else {
+				h.engageKillSwitch(tx, applied)
+			}
+		}
+	})
+}
+
+// engageKillSwitch rejects all the traffic of a container leaving through the
+// tunnel. Must be called with h.mu held.
+func (h *Handler) engageKillSwitch(tx *iptables.Transaction, applied *appliedEgress) {
+	if applied.blocked {
+		return
+	}
+	logger := slog.With("container", applied.containerName, "ip", applied.ip)
+	rule := killSwitchRule(applied.ip)
+	// set now so the rule is removed even if the container stops before the
+	// transaction is committed, a failed change is retried
+	applied.blocked = true
+	h.queueChange(tx, logger, "kill switch", "-I", rule, func(err error) {
+		if err != nil {
+			logger.Error("Failed to engage kill switch", "rule", strings.Join(rule, " "), "error", err)
+			return
+		}
+		logger.Warn("Kill switch engaged")
+	})
+}
+
+// liftKillSwitch removes the kill switch rule of a container. Must be called
+// with h.mu held.
+func (h *Handler) liftKillSwitch(tx *iptables.Transaction, applied *appliedEgress) {
+	if !applied.blocked {
+		return
+	}
+	logger := slog.With("container", applied.containerName, "ip", applied.ip)
+	rule := killSwitchRule(applied.ip)
+	applied.blocked = false
+	h.queueChange(tx, logger, "kill switch", "-D", rule, func(err error) {
+		if err != nil {
+			logger.Error("Failed to lift kill switch", "rule", strings.Join(rule, " "), "error", err)
+			return
+		}
+		logger.Info("Kill switch lifted")
+	})
+}
@@ -0,0 +1,181 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"container-network/pkg/iptables"
+	"container-network/pkg/natpmp"
+	"container-network/pkg/watcher"
+)
+
+// natpmpRetryInterval is the interval to retry a failed port mapping request.
+const natpmpRetryInterval = 15 * time.Second
+
+// portMappings are the NAT-PMP port mappings of a container.
+type portMappings struct {
+	containerName string
+	cancel        context.CancelFunc
+	ports         map[port]*portMapping
+}
+
+// portMapping is the state of the NAT-PMP mapping of a DNAT port.
+type portMapping struct {
+	externalPort uint16
+	rules        [][]string
+	err          string
+	// skipped is set for a port already mapped for another container
+	skipped bool
+}
+
+// natpmpEnabled returns true if the DNAT ports are mapped with NAT-PMP.
+func (h *Handler) natpmpEnabled() bool {
+	return h.config.NATPMPGateway != nil
+}
+
+// startPortMappings requests and keeps renewing a NAT-PMP mapping for each
+// DNAT port of a container, installing the DNAT rules for the granted ports.
+// The gateway maps the internal ports of this container, so a port already
+// mapped for another container is not mapped.
+func (h *Handler) startPortMappings(logger *slog.Logger, c watcher.ContainerInfo, ports []port) {
+	if !h.natpmpEnabled() || c.IPAddress == "" || len(ports) == 0 {
+		return
+	}
+	if h.planning() {
+		for _, p := range ports {
+			h.planNote("NAT-PMP mapping of %d/%s requested from %s for %s, its rules follow the granted port", p.port, p.protocol, h.config.NATPMPGateway, c.IPAddress)
+		}
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	mappings := &portMappings{containerName: c.Name, cancel: cancel, ports: make(map[port]*portMapping)}
+	var mapped []port
+	h.mu.Lock()
+	for _, p := range ports {
+		if owner := h.portMappingOwner(p); owner != "" {
+			logger.Error("DNAT port already mapped with NAT-PMP for another container, not mapped", "port", p.port, "protocol", p.protocol, "owner", owner)
+			mappings.ports[p] = &portMapping{err: fmt.Sprintf("port already mapped for container %s", owner), skipped: true}
+			continue
+		}
+		mappings.ports[p] = &portMapping{}
+		mapped = append(mapped, p)
+	}
+	h.mappings[c.ID] = mappings
+	h.mu.Unlock()
+	for _, p := range mapped {
+		go h.keepPortMapping(ctx, logger.With("port", p.port, "protocol", p.protocol, "gateway", h.config.NATPMPGateway.String()), c.IPAddress, p, mappings.ports[p])
+	}
+}
+
+// portMappingOwner returns the name of the container whose NAT-PMP mapping
+// uses the internal port and protocol of p, if any. Must be called with h.mu
+// held.
+func (h *Handler) portMappingOwner(p port) string {
+	for _, mappings := range h.mappings {
+		for other, mapping := range mappings.ports {
+			if other.port == p.port && other.protocol == p.protocol && !mapping.skipped {
+				return mappings.containerName
+			}
+		}
+	}
+	return ""
+}
+
+// stopPortMappings stops renewing the NAT-PMP mappings of a container, its
+// rules are removed and the mappings deleted from the gateway.
+func (h *Handler) stopPortMappings(c watcher.ContainerInfo) {
+	h.mu.Lock()
+	mappings, ok := h.mappings[c.ID]
+	delete(h.mappings, c.ID)
+	h.mu.Unlock()
+	if ok {
+		mappings.cancel()
+	}
+}
+
+// keepPortMapping requests the mapping of a port and renews it at half of
+// its lifetime until the context is done. When the gateway grants a different
+// external port, the DNAT rule is moved to it.
+func (h *Handler) keepPortMapping(ctx context.Context, logger *slog.Logger, containerIP string, p port, mapping *portMapping) {
+	client := natpmp.NewClient(h.config.NATPMPGateway)
+	suggested := p.external
+	for {
+		wait := natpmpRetryInterval
+		granted, err := client.AddPortMapping(p.protocol, p.port, suggested, h.config.NATPMPLifetime)
+		if err != nil {
+			logger.Error("Failed to request NAT-PMP port mapping", "error", err)
+			h.mu.Lock()
+			mapping.err = err.Error()
+			h.mu.Unlock()
+		} else {
+			suggested = granted.ExternalPort
+			if granted.Lifetime > 0 {
+				wait = granted.Lifetime / 2
+			}
+			var previous uint16
+			h.applyRules(func(tx *iptables.Transaction) {
+				h.mu.Lock()
+				defer h.mu.Unlock()
+				mapping.err = ""
+				previous = mapping.externalPort
+				if previous != granted.ExternalPort {
+					h.movePortMapping(tx, logger, containerIP, p, mapping, granted.ExternalPort)
+				}
+			})
+			if previous != granted.ExternalPort {
+				if previous == 0 {
+					logger.Info("Granted NAT-PMP port mapping", "externalPort", granted.ExternalPort, "lifetime", granted.Lifetime)
+				} else {
+					logger.Warn("NAT-PMP external port changed", "previous", previous, "externalPort", granted.ExternalPort)
+				}
+				h.writeStatus()
+			} else {
+				logger.Debug("Renewed NAT-PMP port mapping", "externalPort", granted.ExternalPort, "lifetime", granted.Lifetime)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			h.applyRules(func(tx *iptables.Transaction) {
+				h.mu.Lock()
+				defer h.mu.Unlock()
+				h.movePortMapping(tx, logger, containerIP, p, mapping, 0)
+			})
+			if err := client.DeletePortMapping(p.protocol, p.port); err != nil {
+				logger.Warn("Failed to delete NAT-PMP port mapping", "error", err)
+			} else {
+				logger.Info("Deleted NAT-PMP port mapping")
+			}
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// movePortMapping replaces the rules of a mapping with the ones for the new
+// external port, or only removes them if the port is 0, deleting the
+// connections of the previous port. Must be called with h.mu held.
+func (h *Handler) movePortMapping(tx *iptables.Transaction, logger *slog.Logger, containerIP string, p port, mapping *portMapping, externalPort uint16) {
+	var rules [][]string
+	if externalPort != 0 {
+		rules = [][]string{
+			{"-t", "nat", "PREROUTING", "-i", h.config.TunnelInterface, "-p", p.protocol, "--dport", fmt.Sprintf("%d", externalPort), "-j", "DNAT", "--to-destination", fmt.Sprintf("%s:%d", containerIP, p.port)},
+			{"-t", "filter", "FORWARD", "-i", h.config.TunnelInterface, "-p", p.protocol, "-d", containerIP, "--dport", fmt.Sprintf("%d", p.port), "-j", "ACCEPT"},
+		}
+		rules = append(rules, h.hairpinRules(containerIP, p, externalPort)...)
+	}
+	for _, rule := range rules {
+		h.queueRule(tx, logger, "NAT-PMP DNAT", "-A", rule)
+	}
+	for _, rule := range mapping.rules {
+		h.queueRule(tx, logger, "NAT-PMP DNAT", "-D", rule)
+	}
+	if previous := mapping.externalPort; previous != 0 {
+		tx.Defer(func() {
+			h.flushConntrack(logger, containerIP, []port{{port: p.port, protocol: p.protocol, external: previous}})
+		})
+	}
+	mapping.externalPort = externalPort
+	mapping.rules = rules
+}
@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"container-network/pkg/netlink"
+)
+
+// planWriter serializes the writes to the plan output.
+type planWriter struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+func (p *planWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.w.Write(b)
+}
+
+// planning returns true in dry run: the rule changes are written to the plan
+// output instead of being applied, and nothing else is changed.
+func (h *Handler) planning() bool {
+	return h.config.Plan != nil
+}
+
+// planNote writes an operation other than a rule change to the plan output,
+// as a comment.
+func (h *Handler) planNote(format string, args ...any) {
+	fmt.Fprintf(h.config.Plan, "# "+format+"\n", args...)
+}
+
+// routingRule adds or deletes a source routing rule, or writes it to the
+// plan output in dry run.
+func (h *Handler) routingRule(rule *netlink.Rule, add bool) error {
+	if h.planning() {
+		action := "del"
+		if add {
+			action = "add"
+		}
+		h.planNote("ip rule %s from %s lookup %d pref %d", action, rule.Src, rule.Table, rule.Priority)
+		return nil
+	}
+	return egressRule(rule, add)
+}
@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"log/slog"
+
+	"container-network/pkg/watcher"
+)
+
+// containerDNATPorts returns the DNAT ports of the container label with their
+// external ports. The external port of "auto:" ports is allocated from the
+// port pool if allocate is set, skipping the static DNAT ports of the known
+// containers, or looked up otherwise; ports without external port are
+// dropped.
+func (h *Handler) containerDNATPorts(logger *slog.Logger, c watcher.ContainerInfo, allocate bool) []port {
+	if h.config.IptablesDnatPortsLabel == "" {
+		return nil
+	}
+	value, ok := c.Labels[h.config.IptablesDnatPortsLabel]
+	if !ok {
+		return nil
+	}
+	var ports []port
+	var reserved map[uint16]bool
+	for _, p := range parsePorts(logger, value) {
+		if !p.auto {
+			if allocate && h.config.PortPool != nil {
+				if a, ok := h.config.PortPool.Allocated(p.external); ok && a.Container != c.Name {
+					logger.Warn("Static DNAT port allocated from the pool to another container, moved when it starts again", "port", p.external, "owner", a.Container)
+				}
+			}
+			ports = append(ports, p)
+			continue
+		}
+		if h.config.PortPool == nil {
+			logger.Warn("No port pool configured, ignoring auto DNAT port", "port", p.port, "protocol", p.protocol)
+			continue
+		}
+		if allocate {
+			if reserved == nil {
+				reserved = h.staticDNATPorts(c)
+			}
+			external, err := h.config.PortPool.Allocate(c.Name, p.port, p.protocol, reserved)
+			if err != nil {
+				logger.Error("Failed to allocate external port", "port", p.port, "protocol", p.protocol, "error", err)
+				continue
+			}
+			p.external = external
+			logger.Info("Allocated external port", "port", p.port, "protocol", p.protocol, "externalPort", external)
+		} else {
+			external, ok := h.config.PortPool.Lookup(c.Name, p.port, p.protocol)
+			if !ok {
+				continue
+			}
+			p.external = external
+		}
+		ports = append(ports, p)
+	}
+	return ports
+}
+
+// staticDNATPorts returns the external ports of the DNAT ports of the known
+// containers and of c that are not allocated from the port pool.
+func (h *Handler) staticDNATPorts(c watcher.ContainerInfo) map[uint16]bool {
+	logger := slog.New(slog.DiscardHandler)
+	h.mu.Lock()
+	containers := make([]watcher.ContainerInfo, 0, len(h.containers)+1)
+	for _, known := range h.containers {
+		containers = append(containers, known)
+	}
+	h.mu.Unlock()
+	containers = append(containers, c)
+	reserved := make(map[uint16]bool)
+	for _, known := range containers {
+		for _, p := range parsePorts(logger, known.Labels[h.config.IptablesDnatPortsLabel]) {
+			if !p.auto {
+				reserved[p.external] = true
+			}
+		}
+	}
+	return reserved
+}
+
+// releasePorts releases the port pool allocations of a removed container.
+func (h *Handler) releasePorts(c watcher.ContainerInfo) {
+	if h.config.PortPool == nil {
+		return
+	}
+	h.config.PortPool.Release(c.Name)
+}
@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"log/slog"
+	"strings"
+
+	"container-network/pkg/iptables"
+	"container-network/pkg/watcher"
+)
+
+// RecheckContainers warms up the reverse path and installs again any missing
+// rule of all the known containers, used when the tunnel recovers.
+func (h *Handler) RecheckContainers() {
+	h.mu.Lock()
+	containers := make([]watcher.ContainerInfo, 0, len(h.containers))
+	for id, c := range h.containers {
+		// failed containers get their rules with their retry, the preparing
+		// ones when they are ready
+		if _, ok := h.failed[id]; !ok && !h.preparing[id] {
+			containers = append(containers, c)
+		}
+	}
+	h.mu.Unlock()
+	slog.Info("Checking rules of known containers", "containers", len(containers))
+	for _, c := range containers {
+		if c.IPAddress != "" {
+			go h.recheckContainer(c)
+		}
+	}
+}
+
+// recheckContainer warms up the reverse path of a container and installs again
+// its missing DNAT, FORWARD, mark, egress, tunnel and peer access rules.
+func (h *Handler) recheckContainer(c watcher.ContainerInfo) {
+	logger := slog.With("container", c.Name, "containerID", c.ID[:12], "ip", c.IPAddress)
+	var cPort uint16
+	var cProtocol string
+	if len(c.Ports) > 0 {
+		cPort = c.Ports[0].ContainerPort
+		cProtocol = c.Ports[0].Protocol
+	}
+	h.warmupReversePath(logger, c.IPAddress, cPort, cProtocol)
+	h.applyRules(func(tx *iptables.Transaction) {
+		for _, r := range h.desiredRules(logger, c) {
+			// peer access rules are restored in order
+			if r.kind != "peer access" {
+				h.ensureRule(tx, logger, r.kind, r.action, r.rule)
+			}
+		}
+		h.recheckAccess(tx, logger, c.ID)
+	})
+}
+
+// desiredRule is a rule installed for a container.
+type desiredRule struct {
+	kind string
+	// action is how the rule is added, -A or -I
+	action string
+	rule   []string
+}
+
+// desiredRules returns the rules installed for a container, from its labels
+// and the handler state.
+func (h *Handler) desiredRules(logger *slog.Logger, c watcher.ContainerInfo) []desiredRule {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.containerRules(logger, c)
+}
+
+// containerRules is desiredRules with h.mu held.
+func (h *Handler) containerRules(logger *slog.Logger, c watcher.ContainerInfo) []desiredRule {
+	var rules []desiredRule
+	add := func(kind, action string, list ...[]string) {
+		for _, rule := range list {
+			rules = append(rules, desiredRule{kind: kind, action: action, rule: rule})
+		}
+	}
+	dnatPorts := h.containerDNATPorts(logger, c, false)
+	// With several tunnels or NAT-PMP the DNAT ports are checked with their rules
+	if !h.multiTunnel() && !h.natpmpEnabled() {
+		for _, p := range dnatPorts {
+			add("DNAT", "-A", dnatRule(p.protocol, p.external, p.port, c.IPAddress))
+			add("FORWARD", "-A", forwardRule(p.protocol, p.port, c.IPAddress))
+		}
+	}
+	if mark := h.publishedPortsMark(logger, c.Labels); mark != "" {
+		for _, p := range filterPublishedPorts(c.Ports, dnatPorts) {
+			add("iptables mark", "-A", markRule(p.protocol, p.port, c.IPAddress, mark))
+		}
+	}
+	if applied, ok := h.egress[c.ID]; ok {
+		add("egress", "-I", applied.rules...)
+		if applied.blocked {
+			add("kill switch", "-I", killSwitchRule(applied.ip))
+		}
+	}
+	if applied, ok := h.tunnels[c.ID]; ok {
+		add("tunnel", "-A", applied.rules...)
+	}
+	add("hairpin", "-A", h.hairpin[c.ID]...)
+	if applied, ok := h.snat[c.ID]; ok {
+		add("SNAT", "-A", applied.rules...)
+	}
+	if d, ok := h.draining[c.ID]; ok {
+		add("drain", "-I", d.rules...)
+	}
+	if mappings, ok := h.mappings[c.ID]; ok {
+		for _, mapping := range mappings.ports {
+			add("NAT-PMP DNAT", "-A", mapping.rules...)
+		}
+	}
+	if applied, ok := h.access[c.ID]; ok {
+		add("peer access", "-I", applied.rules...)
+	}
+	return rules
+}
+
+// ensureRule checks a rule with -C and queues it when it is missing.
+func (h *Handler) ensureRule(tx *iptables.Transaction, logger *slog.Logger, kind, action string, rule []string) {
+	if err := iptablesCheck(logger, rule); err == nil {
+		return
+	}
+	retryKind := kind
+	if kind != "" {
+		kind += " "
+	}
+	h.queueChange(tx, logger, retryKind, action, rule, func(err error) {
+		if err != nil {
+			logger.Error("Failed to restore "+kind+"rule", "rule", strings.Join(rule, " "), "error", err)
+		} else {
+			logger.Warn("Restored missing "+kind+"rule", "rule", strings.Join(rule, " "))
+		}
+	})
+}
@@ -0,0 +1,274 @@
+package handler
+
+import (
+	"log/slog"
+	"strings"
+	"time"
+
+	"container-network/pkg/iptables"
+	"container-network/pkg/netlink"
+	"container-network/pkg/watcher"
+)
+
+const (
+	// retryInitialDelay is the delay before the first retry of a failed
+	// operation, doubled after each failed attempt.
+	retryInitialDelay = 5 * time.Second
+	// retryMaxDelay caps the delay between two attempts.
+	retryMaxDelay = 5 * time.Minute
+	// retryMaxAttempts is the number of retries before a failure is
+	// considered permanent.
+	retryMaxAttempts = 10
+)
+
+// retryDelay returns the delay before a retry after the given number of
+// failed attempts.
+func retryDelay(attempts int) time.Duration {
+	delay := retryInitialDelay
+	for i := 1; i < attempts && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, retryMaxDelay)
+}
+
+// failedContainer is a running container whose rules could not all be
+// applied. Its applied rules were undone and are applied again by a retry.
+type failedContainer struct {
+	event    watcher.ContainerEvent
+	err      error
+	attempts int
+	// retryAt is the time of the next attempt, zero once the failure is
+	// permanent
+	retryAt time.Time
+	// timer is nil once the failure is permanent
+	timer *time.Timer
+}
+
+// ruleRetry is a failed rule change applied again with backoff.
+type ruleRetry struct {
+	logger *slog.Logger
+	kind   string
+	action string
+	rule   []string
+	// routing is set for a routing rule change, rule is then its description
+	routing  *netlink.Rule
+	err      error
+	attempts int
+	// retryAt is the time of the next attempt, zero once the failure is
+	// permanent
+	retryAt time.Time
+	// timer is nil once the failure is permanent
+	timer *time.Timer
+}
+
+// name returns the kind of rule for the logs.
+func (r *ruleRetry) name() string {
+	if r.kind == "" {
+		return "rule"
+	}
+	return r.kind + " rule"
+}
+
+// containerFailed is called when the rules of a started container were
+// rolled back: its state is reset and a retry is queued with backoff. The
+// container stays known, so its stop or death cancels the retry.
+func (h *Handler) containerFailed(logger *slog.Logger, event watcher.ContainerEvent, err error) {
+	c := event.Container
+	h.resetContainer(c)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f := &failedContainer{event: event, err: err, attempts: 1}
+	if previous, ok := h.failed[c.ID]; ok {
+		if previous.timer != nil {
+			previous.timer.Stop()
+		}
+		f.attempts = previous.attempts + 1
+	}
+	h.failed[c.ID] = f
+	if f.attempts > retryMaxAttempts {
+		logger.Error("Failed to apply container rules, rolled back, giving up", "error", err, "attempts", f.attempts)
+		return
+	}
+	delay := retryDelay(f.attempts)
+	logger.Error("Failed to apply container rules, rolled back", "error", err, "attempts", f.attempts, "retryIn", delay)
+	f.retryAt = time.Now().Add(delay)
+	f.timer = time.AfterFunc(delay, func() {
+		h.retryContainer(c.ID, f)
+	})
+}
+
+// resetContainer forgets the applied rules of a container whose unit was
+// rolled back. Unlike removeContainerRules, nothing is queued: the rules were
+// already undone by the transaction. The port pool allocation, the pending
+// rule retries and the routing rules are left alone, the container is still
+// running.
+func (h *Handler) resetContainer(c watcher.ContainerInfo) {
+	h.mu.Lock()
+	delete(h.egress, c.ID)
+	delete(h.tunnels, c.ID)
+	delete(h.access, c.ID)
+	delete(h.hairpin, c.ID)
+	applied, ok := h.snat[c.ID]
+	delete(h.snat, c.ID)
+	h.mu.Unlock()
+	if ok {
+		h.setSNATPorts(c.ID, applied, false)
+	}
+	// the mappings are requested again by the retry
+	h.stopPortMappings(c)
+}
+
+// retryContainer applies again the rules of a failed container, unless it
+// stopped meanwhile.
+func (h *Handler) retryContainer(id string, f *failedContainer) {
+	h.applyRules(func(tx *iptables.Transaction) {
+		h.mu.Lock()
+		current, ok := h.failed[id]
+		h.mu.Unlock()
+		if !ok || current != f {
+			return
+		}
+		eventLogger(f.event).Info("Retrying container rules", "attempt", f.attempts)
+		tx.Defer(func() {
+			// not failed again
+			h.mu.Lock()
+			if h.failed[id] == f {
+				delete(h.failed, id)
+			}
+			h.mu.Unlock()
+		})
+		h.handleContainerStarted(tx, f.event)
+	})
+	h.writeStatus()
+}
+
+// cancelRetry cancels the retry of a failed container. Returns false if the
+// container was not failed.
+func (h *Handler) cancelRetry(id string) bool {
+	h.mu.Lock()
+	f, ok := h.failed[id]
+	delete(h.failed, id)
+	h.mu.Unlock()
+	if ok && f.timer != nil {
+		f.timer.Stop()
+	}
+	return ok
+}
+
+// queueChange adds a rule change to the transaction and calls done with its
+// outcome. A failed change is applied again with backoff, unless it belongs
+// to a unit, which is retried as a whole. A pending retry of the same rule is
+// superseded by the change: if the change is the opposite one, e.g. the
+// removal of the rules of a container going away, both are dropped, unless
+// the rule of a failed removal is gone meanwhile. The removal of a rule that
+// does not exist succeeds.
+func (h *Handler) queueChange(tx *iptables.Transaction, logger *slog.Logger, kind, action string, rule []string, done func(error)) {
+	if h.supersedeRetry(logger, action, rule) {
+		if action == "-D" || !iptablesRuleMissing(iptablesCheck(logger, rule)) {
+			return
+		}
+		// e.g. its table was flushed, the rule is added again
+	}
+	unit := tx.InUnit()
+	tx.Add(action, rule, func(err error) {
+		if err != nil && iptablesRuleGone(logger, action, rule, err) {
+			logger.Debug("Rule already removed", "rule", strings.Join(rule, " "))
+			err = nil
+		}
+		done(err)
+		if err != nil && !unit {
+			h.retryRule(&ruleRetry{logger: logger, kind: kind, action: action, rule: rule}, err)
+		}
+	})
+}
+
+// supersedeRetry drops the pending retry of a rule. Returns true if it was
+// the opposite change, which is then dropped too.
+func (h *Handler) supersedeRetry(logger *slog.Logger, action string, rule []string) bool {
+	key := strings.Join(rule, " ")
+	h.retryMu.Lock()
+	r, ok := h.retries[key]
+	delete(h.retries, key)
+	h.retryMu.Unlock()
+	if !ok {
+		return false
+	}
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	if (r.action == "-D") == (action == "-D") {
+		return false
+	}
+	logger.Info("Cancelled rule retry", "rule", key, "action", r.action, "attempts", r.attempts)
+	return true
+}
+
+// retryRule schedules the next attempt of a failed rule change, or keeps it
+// as a permanent failure after retryMaxAttempts retries.
+func (h *Handler) retryRule(r *ruleRetry, err error) {
+	key := strings.Join(r.rule, " ")
+	h.retryMu.Lock()
+	defer h.retryMu.Unlock()
+	r.err = err
+	r.attempts++
+	if previous, ok := h.retries[key]; ok && previous.timer != nil {
+		previous.timer.Stop()
+	}
+	h.retries[key] = r
+	if r.attempts > retryMaxAttempts {
+		r.logger.Error("Giving up on "+r.name(), "rule", key, "action", r.action, "attempts", r.attempts-1, "error", r.err)
+		r.retryAt = time.Time{}
+		r.timer = nil
+		return
+	}
+	delay := retryDelay(r.attempts)
+	r.retryAt = time.Now().Add(delay)
+	r.timer = time.AfterFunc(delay, func() {
+		if r.routing != nil {
+			h.retryRoutingRule(key, r)
+			h.writeStatus()
+			return
+		}
+		h.applyRules(func(tx *iptables.Transaction) {
+			h.retryMu.Lock()
+			current, ok := h.retries[key]
+			h.retryMu.Unlock()
+			if !ok || current != r {
+				return
+			}
+			tx.Add(r.action, r.rule, func(err error) {
+				if err != nil && !iptablesRuleGone(r.logger, r.action, r.rule, err) {
+					h.retryRule(r, err)
+					return
+				}
+				h.retryMu.Lock()
+				if h.retries[key] == r {
+					delete(h.retries, key)
+				}
+				h.retryMu.Unlock()
+				r.logger.Info("Retried "+r.name(), "rule", key, "action", r.action, "attempts", r.attempts)
+			})
+		})
+		h.writeStatus()
+	})
+}
+
+// retryRoutingRule applies again a failed routing rule change.
+func (h *Handler) retryRoutingRule(key string, r *ruleRetry) {
+	h.retryMu.Lock()
+	current, ok := h.retries[key]
+	h.retryMu.Unlock()
+	if !ok || current != r {
+		return
+	}
+	if err := h.routingRule(r.routing, r.action != "-D"); err != nil && !routingRuleGone(r.action, err) {
+		h.retryRule(r, err)
+		return
+	}
+	h.retryMu.Lock()
+	if h.retries[key] == r {
+		delete(h.retries, key)
+	}
+	h.retryMu.Unlock()
+	r.logger.Info("Retried "+r.name(), "rule", r.routing.String(), "action", r.action, "attempts", r.attempts)
+}
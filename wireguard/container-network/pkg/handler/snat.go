@@ -0,0 +1,200 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"container-network/pkg/iptables"
+	"container-network/pkg/netlink"
+	"container-network/pkg/watcher"
+)
+
+// appliedSNAT is the return path masquerading installed for a container.
+type appliedSNAT struct {
+	containerName string
+	ip            string
+	ports         []port
+	rules         [][]string
+}
+
+// snatEnabled returns true if a container asks for masquerading of its
+// DNATed connections.
+func (h *Handler) snatEnabled(c watcher.ContainerInfo) bool {
+	if h.config.SNATLabel == "" || h.config.InternalInterface == "" {
+		return false
+	}
+	return strings.EqualFold(strings.TrimSpace(c.Labels[h.config.SNATLabel]), "true")
+}
+
+// applyContainerSNAT masquerades the DNATed connections to the DNAT ports of
+// a container on the internal interface, so the replies come back through
+// this container even if it is not the default gateway of the container.
+// The rules match the container port, so they do not depend on the external
+// port granted by NAT-PMP or the tunnel selected.
+func (h *Handler) applyContainerSNAT(tx *iptables.Transaction, logger *slog.Logger, c watcher.ContainerInfo, ports []port) {
+	if !h.snatEnabled(c) || c.IPAddress == "" || len(ports) == 0 {
+		return
+	}
+	applied := &appliedSNAT{containerName: c.Name, ip: c.IPAddress, ports: ports}
+	for _, p := range ports {
+		rule := []string{"-t", "nat", "POSTROUTING", "-o", h.config.InternalInterface, "-d", c.IPAddress, "-p", p.protocol, "--dport", fmt.Sprintf("%d", p.port), "-m", "conntrack", "--ctstate", "DNAT", "-j", "MASQUERADE"}
+		h.queueRule(tx, logger, "SNAT", "-A", rule)
+		applied.rules = append(applied.rules, rule)
+	}
+	h.mu.Lock()
+	h.snat[c.ID] = applied
+	h.mu.Unlock()
+	h.setSNATPorts(c.ID, applied, true)
+}
+
+// removeContainerSNAT removes the return path masquerading of a container.
+func (h *Handler) removeContainerSNAT(tx *iptables.Transaction, logger *slog.Logger, c watcher.ContainerInfo) {
+	h.mu.Lock()
+	applied, ok := h.snat[c.ID]
+	delete(h.snat, c.ID)
+	h.mu.Unlock()
+	if !ok {
+		return
+	}
+	h.setSNATPorts(c.ID, applied, false)
+	for _, rule := range applied.rules {
+		h.queueRule(tx, logger, "SNAT", "-D", rule)
+	}
+}
+
+// snatPort is a masqueraded DNAT port of a container.
+type snatPort struct {
+	ip       string
+	protocol string
+	port     uint16
+}
+
+// snatContainer is the container of a masqueraded DNAT port.
+type snatContainer struct {
+	id   string
+	name string
+}
+
+// setSNATPorts adds or removes the masqueraded DNAT ports of a container
+// read by the conntrack events, and wakes LogSNATConnections when the first
+// one is added or the last one removed.
+func (h *Handler) setSNATPorts(id string, applied *appliedSNAT, add bool) {
+	h.snatMu.Lock()
+	defer h.snatMu.Unlock()
+	active := len(h.snatPorts) > 0
+	for _, p := range applied.ports {
+		key := snatPort{ip: applied.ip, protocol: p.protocol, port: p.port}
+		if add {
+			h.snatPorts[key] = snatContainer{id: id, name: applied.containerName}
+		} else if h.snatPorts[key].id == id {
+			delete(h.snatPorts, key)
+		}
+	}
+	if active != (len(h.snatPorts) > 0) {
+		select {
+		case h.snatChanged <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// snatActive returns true while at least one DNAT port is masqueraded.
+func (h *Handler) snatActive() bool {
+	h.snatMu.RLock()
+	defer h.snatMu.RUnlock()
+	return len(h.snatPorts) > 0
+}
+
+// LogSNATConnections logs the new connections to the masqueraded DNAT ports
+// with the original client address, which the containers do not see, until
+// the context is done. Connections are read from the conntrack events, only
+// while at least one container is masqueraded.
+func (h *Handler) LogSNATConnections(ctx context.Context) {
+	flows := make(chan netlink.ConntrackFlow, 64)
+	for {
+		for !h.snatActive() {
+			select {
+			case <-ctx.Done():
+				return
+			case <-h.snatChanged:
+			}
+		}
+		subscribeCtx, cancel := context.WithCancel(ctx)
+		done := make(chan error, 1)
+		go func() {
+			done <- netlink.ConntrackSubscribe(subscribeCtx, flows)
+		}()
+		slog.Debug("SNAT connection logging started")
+		err := h.logSNATFlows(ctx, flows, done)
+		cancel()
+		if err == nil {
+			err = <-done
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			if errors.Is(err, netlink.ErrNotSupported) {
+				slog.Warn("SNAT connection logging not supported on this platform")
+			} else {
+				slog.Error("SNAT connection logging stopped", "error", err)
+			}
+			return
+		}
+		slog.Debug("SNAT connection logging stopped, no masqueraded container")
+	}
+}
+
+// logSNATFlows logs the flows of a conntrack subscription until the context
+// is done, the last masqueraded container is removed or the subscription
+// ends, with its error.
+func (h *Handler) logSNATFlows(ctx context.Context, flows <-chan netlink.ConntrackFlow, done <-chan error) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-done:
+			if err == nil {
+				err = errors.New("conntrack subscription ended")
+			}
+			return err
+		case <-h.snatChanged:
+			if !h.snatActive() {
+				return nil
+			}
+		case flow := <-flows:
+			h.logSNATConnection(flow)
+		}
+	}
+}
+
+// logSNATConnection logs a connection if its reply comes from a DNAT port
+// of a masqueraded container.
+func (h *Handler) logSNATConnection(flow netlink.ConntrackFlow) {
+	var protocol string
+	switch flow.Protocol {
+	case 6:
+		protocol = "tcp"
+	case 17:
+		protocol = "udp"
+	default:
+		return
+	}
+	ip := flow.Reply.Src.String()
+	h.snatMu.RLock()
+	c, ok := h.snatPorts[snatPort{ip: ip, protocol: protocol, port: flow.Reply.SrcPort}]
+	h.snatMu.RUnlock()
+	if !ok {
+		return
+	}
+	slog.Info("DNAT connection",
+		"container", c.name,
+		"ip", ip,
+		"port", flow.Reply.SrcPort,
+		"protocol", protocol,
+		"client", fmt.Sprintf("%s:%d", flow.Original.Src, flow.Original.SrcPort),
+		"externalPort", flow.Original.DstPort)
+}
@@ -0,0 +1,224 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"container-network/pkg/watcher"
+)
+
+// Status is the state of the managed containers.
+type Status struct {
+	Containers []ContainerStatus `json:"containers"`
+	// Retries are the failed rule changes, pending or given up.
+	Retries []RetryStatus `json:"retries,omitempty"`
+	// Drift is the result of the last drift check.
+	Drift *DriftStatus `json:"drift,omitempty"`
+}
+
+// ContainerStatus is the state of a managed container.
+type ContainerStatus struct {
+	ID    string       `json:"id"`
+	Name  string       `json:"name"`
+	IP    string       `json:"ip"`
+	Ports []PortStatus `json:"ports,omitempty"`
+	// DrainUntil is the end of the drain period of a stopped container.
+	DrainUntil *time.Time `json:"drainUntil,omitempty"`
+	// Error is why the rules of the container were rolled back.
+	Error string `json:"error,omitempty"`
+	// Attempts is the number of failed attempts to apply the rules.
+	Attempts int `json:"attempts,omitempty"`
+	// RetryAt is when the rolled back rules are applied again, unset once
+	// the failure is permanent.
+	RetryAt *time.Time `json:"retryAt,omitempty"`
+	// Rules are the rules of the container, unset while they are rolled
+	// back or not applied yet.
+	Rules []RuleStatus `json:"rules,omitempty"`
+}
+
+// RuleStatus is a rule of a container.
+type RuleStatus struct {
+	Kind string `json:"kind"`
+	// Rule is in the format "-t <table> <chain> <spec>".
+	Rule string `json:"rule"`
+}
+
+// EventStatus is a container event handled.
+type EventStatus struct {
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Container string    `json:"container"`
+	ID        string    `json:"id"`
+	IP        string    `json:"ip,omitempty"`
+	// Error is set if the rules of a started container were rolled back.
+	Error string `json:"error,omitempty"`
+}
+
+// historySize is the number of recent events kept.
+const historySize = 100
+
+// RetryStatus is the state of a failed rule change.
+type RetryStatus struct {
+	Kind string `json:"kind,omitempty"`
+	// Action is -A, -I or -D.
+	Action string `json:"action"`
+	// Rule is in the format "-t <table> <chain> <spec>".
+	Rule     string `json:"rule"`
+	Error    string `json:"error"`
+	Attempts int    `json:"attempts"`
+	// RetryAt is when the change is applied again, unset once the failure
+	// is permanent.
+	RetryAt *time.Time `json:"retryAt,omitempty"`
+}
+
+// PortStatus is the state of a DNAT port of a container.
+type PortStatus struct {
+	Protocol string `json:"protocol"`
+	// Port is the container port.
+	Port uint16 `json:"port"`
+	// ExternalPort is the port reachable through the tunnel, zero while unknown.
+	ExternalPort uint16 `json:"externalPort,omitempty"`
+	// Source is how the external port was obtained: "label", "auto" (port
+	// pool) or "natpmp".
+	Source string `json:"source"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Status returns the state of the managed containers sorted by name.
+func (h *Handler) Status() Status {
+	logger := slog.New(slog.DiscardHandler)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	status := Status{Containers: []ContainerStatus{}, Drift: h.drift}
+	for id, c := range h.containers {
+		cs := ContainerStatus{ID: id, Name: c.Name, IP: c.IPAddress}
+		if d, ok := h.draining[id]; ok {
+			cs.DrainUntil = &d.until
+		}
+		if f, ok := h.failed[id]; ok {
+			cs.Error = f.err.Error()
+			cs.Attempts = f.attempts
+			if !f.retryAt.IsZero() {
+				cs.RetryAt = &f.retryAt
+			}
+		} else if !h.preparing[id] {
+			for _, r := range h.containerRules(logger, c) {
+				cs.Rules = append(cs.Rules, RuleStatus{Kind: r.kind, Rule: strings.Join(r.rule, " ")})
+			}
+		}
+		mappings := h.mappings[id]
+		for _, p := range h.containerDNATPorts(logger, c, false) {
+			ps := PortStatus{Protocol: p.protocol, Port: p.port, ExternalPort: p.external, Source: "label"}
+			if p.auto {
+				ps.Source = "auto"
+			}
+			if mappings != nil {
+				if m, ok := mappings.ports[p]; ok {
+					ps.ExternalPort = m.externalPort
+					ps.Source = "natpmp"
+					ps.Error = m.err
+				}
+			}
+			cs.Ports = append(cs.Ports, ps)
+		}
+		status.Containers = append(status.Containers, cs)
+	}
+	sort.Slice(status.Containers, func(i, j int) bool {
+		return status.Containers[i].Name < status.Containers[j].Name
+	})
+	h.retryMu.Lock()
+	defer h.retryMu.Unlock()
+	for key, r := range h.retries {
+		rs := RetryStatus{Kind: r.kind, Action: r.action, Rule: key, Error: r.err.Error(), Attempts: r.attempts}
+		if !r.retryAt.IsZero() {
+			rs.RetryAt = &r.retryAt
+		}
+		status.Retries = append(status.Retries, rs)
+	}
+	sort.Slice(status.Retries, func(i, j int) bool {
+		return status.Retries[i].Rule < status.Retries[j].Rule
+	})
+	return status
+}
+
+// History returns the recent container events, the oldest first.
+func (h *Handler) History() []EventStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]EventStatus{}, h.history...)
+}
+
+// recordEvents adds handled events to the history.
+func (h *Handler) recordEvents(events []watcher.ContainerEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, event := range events {
+		c := event.Container
+		es := EventStatus{Time: event.Timestamp, Type: event.Type.String(), Container: c.Name, ID: c.ID, IP: c.IPAddress}
+		if f, ok := h.failed[c.ID]; ok && event.Type == watcher.ContainerStarted {
+			es.Error = f.err.Error()
+		}
+		h.history = append(h.history, es)
+	}
+	if len(h.history) > historySize {
+		h.history = append([]EventStatus{}, h.history[len(h.history)-historySize:]...)
+	}
+}
+
+// ReadStatus reads a status file written by a handler.
+func ReadStatus(path string) (*Status, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var status Status
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, fmt.Errorf("invalid status file %s: %w", path, err)
+	}
+	return &status, nil
+}
+
+// writeStatus writes the status as JSON to the status file, if configured.
+// The file is replaced atomically so readers never see partial content.
+func (h *Handler) writeStatus() {
+	if h.config.StatusFile == "" {
+		return
+	}
+	h.statusMu.Lock()
+	defer h.statusMu.Unlock()
+	data, err := json.MarshalIndent(h.Status(), "", "  ")
+	if err != nil {
+		slog.Error("Failed to encode status", "error", err)
+		return
+	}
+	dir := filepath.Dir(h.config.StatusFile)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		slog.Error("Failed to write status file", "path", h.config.StatusFile, "error", err)
+		return
+	}
+	tmp, err := os.CreateTemp(dir, ".status-*")
+	if err != nil {
+		slog.Error("Failed to write status file", "path", h.config.StatusFile, "error", err)
+		return
+	}
+	_, err = tmp.Write(append(data, '\n'))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), h.config.StatusFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		slog.Error("Failed to write status file", "path", h.config.StatusFile, "error", err)
+	}
+}
@@ -0,0 +1,181 @@
+package handler
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+
+	"container-network/pkg/config"
+	"container-network/pkg/iptables"
+	"container-network/pkg/netlink"
+	"container-network/pkg/watcher"
+)
+
+// appliedTunnel is the tunnel selected for a container and the rules binding
+// its DNAT ports and egress to it.
+type appliedTunnel struct {
+	containerName string
+	ip            string
+	ports         []port
+	// preferred is the tunnel selected by label, active the one in use
+	preferred string
+	active    string
+	// egress is set if the tunnel is selected by label: the egress of the
+	// container is then routed through it too, as on a backup tunnel
+	egress bool
+	rule   *netlink.Rule
+	rules  [][]string
+}
+
+// multiTunnel returns true if several tunnels are configured for failover.
+func (h *Handler) multiTunnel() bool {
+	return len(h.config.Tunnels) > 1
+}
+
+// applyContainerTunnel selects the tunnel of a container and installs its DNAT
+// and egress rules for that tunnel.
+func (h *Handler) applyContainerTunnel(tx *iptables.Transaction, logger *slog.Logger, c watcher.ContainerInfo, dnatPorts []port) {
+	if !h.multiTunnel() || c.IPAddress == "" {
+		return
+	}
+	preferred := h.config.Tunnels[0].Interface
+	selected := false
+	if h.config.TunnelLabel != "" {
+		if value, ok := c.Labels[h.config.TunnelLabel]; ok {
+			value = strings.TrimSpace(value)
+			if _, ok := h.tunnel(value); ok {
+				preferred = value
+				selected = true
+			} else {
+				logger.Warn("Unknown tunnel in tunnel label, using default", "label", h.config.TunnelLabel, "value", value, "tunnel", preferred)
+			}
+		}
+	}
+	if len(dnatPorts) == 0 && !selected {
+		return
+	}
+	applied := &appliedTunnel{containerName: c.Name, ip: c.IPAddress, ports: dnatPorts, preferred: preferred, egress: selected}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	applied.active = h.selectTunnel(preferred)
+	if applied.active != preferred {
+		logger.Warn("Preferred tunnel is unhealthy, using backup tunnel", "preferred", preferred, "tunnel", applied.active)
+	}
+	h.installTunnel(tx, logger.With("tunnel", applied.active), applied)
+	h.tunnels[c.ID] = applied
+}
+
+// removeContainerTunnel removes the tunnel rules of a container.
+func (h *Handler) removeContainerTunnel(tx *iptables.Transaction, logger *slog.Logger, c watcher.ContainerInfo) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	applied, ok := h.tunnels[c.ID]
+	if !ok {
+		return
+	}
+	delete(h.tunnels, c.ID)
+	h.uninstallTunnel(tx, logger.With("tunnel", applied.active), applied)
+}
+
+// failoverTunnels moves the containers to the best healthy tunnel of their
+// failover order. Called with the tunnel health updated.
+func (h *Handler) failoverTunnels() {
+	h.applyRules(func(tx *iptables.Transaction) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for _, applied := range h.tunnels {
+			selected := h.selectTunnel(applied.preferred)
+			if selected == applied.active {
+				continue
+			}
+			logger := slog.With("container", applied.containerName, "ip", applied.ip)
+			previous := applied.active
+			h.uninstallTunnel(tx, logger.With("tunnel", previous), applied)
+			applied.active = selected
+			h.installTunnel(tx, logger.With("tunnel", selected), applied)
+			// connections through the previous tunnel keep their translation
+			ip, ports := applied.ip, applied.ports
+			tx.Defer(func() {
+				h.flushConntrack(logger, ip, ports)
+			})
+			if selected == applied.preferred {
+				logger.Info("Moved container back to preferred tunnel", "from", previous, "to", selected)
+			} else {
+				logger.Warn("Moved container to backup tunnel", "from", previous, "to", selected, "preferred", applied.preferred)
+			}
+		}
+	})
+}
+
+// selectTunnel returns the first healthy tunnel, trying the preferred one
+// first and then the failover order. Tunnels without reported state are
+// considered healthy. If none is healthy the preferred one is returned.
+// Must be called with h.mu held.
+func (h *Handler) selectTunnel(preferred string) string {
+	if healthy, ok := h.tunnelHealth[preferred]; !ok || healthy {
+		return preferred
+	}
+	for _, t := range h.config.Tunnels {
+		if healthy, ok := h.tunnelHealth[t.Interface]; !ok || healthy {
+			return t.Interface
+		}
+	}
+	return preferred
+}
+
+// tunnel returns the configured tunnel with the given interface name.
+func (h *Handler) tunnel(name string) (config.Tunnel, bool) {
+	for _, t := range h.config.Tunnels {
+		if t.Interface == name {
+			return t, true
+		}
+	}
+	return config.Tunnel{}, false
+}
+
+// installTunnel builds and installs the rules of a container for its active
+// tunnel: the DNAT ports bound to it and, if selected by label or on a backup
+// tunnel, the egress. The main routing table only goes through the tunnel
+// interface, so on a backup tunnel the replies of the DNAT ports need the
+// table of the tunnel too. Must be called with h.mu held.
+func (h *Handler) installTunnel(tx *iptables.Transaction, logger *slog.Logger, applied *appliedTunnel) {
+	t, _ := h.tunnel(applied.active)
+	applied.rule = nil
+	applied.rules = nil
+	for _, p := range applied.ports {
+		applied.rules = append(applied.rules,
+			[]string{"-t", "nat", "PREROUTING", "-i", t.Interface, "-p", p.protocol, "--dport", fmt.Sprintf("%d", p.external), "-j", "DNAT", "--to-destination", fmt.Sprintf("%s:%d", applied.ip, p.port)},
+			[]string{"-t", "filter", "FORWARD", "-i", t.Interface, "-p", p.protocol, "-d", applied.ip, "--dport", fmt.Sprintf("%d", p.port), "-j", "ACCEPT"},
+		)
+	}
+	if applied.egress || t.Interface != h.config.TunnelInterface {
+		applied.rules = append(applied.rules, []string{"-t", "filter", "FORWARD", "-s", applied.ip, "-o", t.Interface, "-j", "ACCEPT"})
+		if t.Interface != h.config.TunnelInterface {
+			// the base setup only masquerades the internal subnet on the primary tunnel
+			applied.rules = append(applied.rules, []string{"-t", "nat", "POSTROUTING", "-s", applied.ip, "-o", t.Interface, "-j", "MASQUERADE"})
+		}
+		if t.Table > 0 {
+			applied.rule = &netlink.Rule{
+				// after the egress label rules, which take precedence
+				Priority: h.config.EgressRulePriority + 1,
+				Src:      &net.IPNet{IP: net.ParseIP(applied.ip).To4(), Mask: net.CIDRMask(32, 32)},
+				Table:    t.Table,
+			}
+			h.addRoutingRule(tx, logger, "tunnel", applied.rule)
+		}
+	}
+	for _, rule := range applied.rules {
+		h.queueRule(tx, logger, "tunnel", "-A", rule)
+	}
+}
+
+// uninstallTunnel removes the rules of a container for its active tunnel.
+func (h *Handler) uninstallTunnel(tx *iptables.Transaction, logger *slog.Logger, applied *appliedTunnel) {
+	if applied.rule != nil {
+		h.removeRoutingRule(logger, "tunnel", applied.rule)
+	}
+	for _, rule := range applied.rules {
+		h.queueRule(tx, logger, "tunnel", "-D", rule)
+	}
+}
@@ -0,0 +1,393 @@
+// Package iptables applies batches of rule changes with iptables-restore, so
+// all the changes of an event are applied with one process instead of one
+// iptables command per rule.
+package iptables
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// RestoreCommand is the command applying the transactions.
+var RestoreCommand = []string{"iptables-restore", "--noflush", "--wait"}
+
+// ErrNotApplied is the outcome of the changes of a transaction that failed
+// without a failed change identified.
+var ErrNotApplied = errors.New("transaction not applied")
+
+// ErrUnitFailed is the outcome of the changes not applied because another
+// change of their unit failed.
+var ErrUnitFailed = errors.New("another change of the unit failed")
+
+// failedLine matches the line of the failed change in the iptables-restore
+// errors, e.g. "iptables-restore: line 3 failed".
+var failedLine = regexp.MustCompile(`line:? (\d+)`)
+
+// Change is a rule change. Rule is in the format {"-t", table, chain, spec...}
+// and Action is -A, -I or -D.
+type Change struct {
+	Action string
+	Rule   []string
+	// done is called with the outcome of the change on commit
+	done func(error)
+	// unit is the index of the unit of the change plus one, zero if none
+	unit int
+}
+
+// String returns the change as iptables arguments.
+func (c Change) String() string {
+	return strings.Join(c.Args(), " ")
+}
+
+// Args returns the iptables arguments of the change.
+func (c Change) Args() []string {
+	return append([]string{c.Rule[0], c.Rule[1], c.Action, c.Rule[2]}, c.Rule[3:]...)
+}
+
+// inverse returns the change undoing c.
+func (c Change) inverse() Change {
+	action := "-D"
+	if c.Action == "-D" {
+		action = "-A"
+	}
+	return Change{Action: action, Rule: c.Rule, unit: c.unit}
+}
+
+// Transaction groups rule changes to apply them with one iptables-restore
+// run. Each table is committed atomically: either all its changes are
+// applied or none.
+type Transaction struct {
+	changes  []Change
+	deferred []func()
+	units    []unit
+	// unit is the unit of the changes added now, see Unit
+	unit int
+}
+
+// unit is a group of changes applied all or none.
+type unit struct {
+	failed func(error)
+	// err is set by Fail before the commit
+	err error
+	// undo are the operations outside iptables undone if the unit fails
+	undo []func()
+}
+
+// NewTransaction creates an empty transaction.
+func NewTransaction() *Transaction {
+	return &Transaction{}
+}
+
+// Add queues a rule change. done, if not nil, is called with its outcome
+// when the transaction is committed.
+func (t *Transaction) Add(action string, rule []string, done func(error)) {
+	t.changes = append(t.changes, Change{Action: action, Rule: rule, done: done, unit: t.unit})
+}
+
+// Defer registers a function to call after the changes are committed, e.g.
+// to act on the state left by the rules.
+func (t *Transaction) Defer(fn func()) {
+	t.deferred = append(t.deferred, fn)
+}
+
+// Unit groups the changes added by fn: either all of them are applied, or
+// the ones already applied are undone when the transaction is committed and
+// failed is called with the error. Units do not nest.
+func (t *Transaction) Unit(fn func(), failed func(error)) {
+	t.units = append(t.units, unit{failed: failed})
+	t.unit = len(t.units)
+	defer func() { t.unit = 0 }()
+	fn()
+}
+
+// Fail marks the current unit as failed, e.g. when an operation outside
+// iptables belonging to it failed: none of its changes are applied and its
+// failed function is called with err on commit. It returns false outside a
+// unit.
+func (t *Transaction) Fail(err error) bool {
+	if t.unit == 0 {
+		return false
+	}
+	if u := &t.units[t.unit-1]; u.err == nil {
+		u.err = err
+	}
+	return true
+}
+
+// Undo registers a function undoing an operation outside iptables done for
+// the current unit, e.g. a routing rule, called on commit if the unit fails.
+// Outside a unit, fn is never called.
+func (t *Transaction) Undo(fn func()) {
+	if t.unit > 0 {
+		u := &t.units[t.unit-1]
+		u.undo = append(u.undo, fn)
+	}
+}
+
+// InUnit returns true while the changes added are grouped in a unit.
+func (t *Transaction) InUnit() bool {
+	return t.unit > 0
+}
+
+// Changes returns the queued changes.
+func (t *Transaction) Changes() []Change {
+	return t.changes
+}
+
+// Len returns the number of queued changes.
+func (t *Transaction) Len() int {
+	return len(t.changes)
+}
+
+// Commit applies the queued changes and reports the outcome of each one.
+// When a change fails, iptables-restore rejects its table: the failed change
+// is reported and the rest of the changes not applied yet are retried, except
+// the ones of its unit. The applied changes of the failed units are then
+// undone. It returns the number of failed changes.
+func (t *Transaction) Commit() int {
+	changes := t.changes
+	deferred := t.deferred
+	units := t.units
+	t.changes = nil
+	t.deferred = nil
+	t.units = nil
+	defer func() {
+		for _, fn := range deferred {
+			fn()
+		}
+	}()
+	errs := make([]error, len(units))
+	for i, u := range units {
+		errs[i] = u.err
+	}
+	applied := make([][]Change, len(units))
+	failed := apply(changes, func(c Change, err error) {
+		report(c, err)
+		switch {
+		case c.unit == 0:
+		case err != nil:
+			if errs[c.unit-1] == nil {
+				errs[c.unit-1] = err
+			}
+		default:
+			applied[c.unit-1] = append(applied[c.unit-1], c)
+		}
+	}, func(c Change) bool {
+		return c.unit > 0 && errs[c.unit-1] != nil
+	})
+	// undo in reverse order, so inserted rules keep their positions
+	var undo []Change
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		for j := len(applied[i]) - 1; j >= 0; j-- {
+			undo = append(undo, applied[i][j].inverse())
+		}
+	}
+	apply(undo, func(c Change, err error) {
+		if err != nil {
+			errs[c.unit-1] = errors.Join(errs[c.unit-1], fmt.Errorf("undoing %s: %w", c, err))
+		}
+	}, func(Change) bool { return false })
+	for i, u := range units {
+		if errs[i] == nil {
+			continue
+		}
+		for j := len(u.undo) - 1; j >= 0; j-- {
+			u.undo[j]()
+		}
+		if u.failed != nil {
+			u.failed(errs[i])
+		}
+	}
+	return failed
+}
+
+// apply runs iptables-restore with the changes until all of them are
+// reported, retrying the changes of the tables rejected by a failed one.
+// The pending changes selected by skip are reported with ErrUnitFailed
+// before each run. It returns the number of failed changes.
+func apply(changes []Change, result func(Change, error), skip func(Change) bool) int {
+	failed := 0
+	pending := changes
+	for {
+		var run []Change
+		for _, c := range pending {
+			if skip(c) {
+				result(c, ErrUnitFailed)
+				failed++
+			} else {
+				run = append(run, c)
+			}
+		}
+		pending = run
+		if len(pending) == 0 {
+			return failed
+		}
+		payload, l := encode(pending)
+		output, err := restore(payload)
+		if err == nil {
+			for _, c := range pending {
+				result(c, nil)
+			}
+			return failed
+		}
+		line := 0
+		if m := failedLine.FindStringSubmatch(output); m != nil {
+			line, _ = strconv.Atoi(m[1])
+		}
+		index := -1
+		for i, changeLine := range l.lines {
+			if changeLine == line {
+				index = i
+			}
+		}
+		if index < 0 {
+			// unknown failed change, nothing is retried
+			err = fmt.Errorf("%w: %v: %s", ErrNotApplied, err, strings.TrimSpace(output))
+			for _, c := range pending {
+				if l.committed(line, c) {
+					result(c, nil)
+				} else {
+					result(c, err)
+					failed++
+				}
+			}
+			return failed
+		}
+		var retry []Change
+		for i, c := range pending {
+			switch {
+			case i == index:
+				result(c, fmt.Errorf("%v: %s", err, strings.TrimSpace(output)))
+				failed++
+			case l.committed(line, c):
+				result(c, nil)
+			default:
+				retry = append(retry, c)
+			}
+		}
+		pending = retry
+	}
+}
+
+// Plan writes the queued changes as iptables commands instead of applying
+// them (dry run) and reports them as applied.
+func (t *Transaction) Plan(w io.Writer) {
+	changes := t.changes
+	deferred := t.deferred
+	t.changes = nil
+	t.deferred = nil
+	t.units = nil
+	for _, c := range changes {
+		fmt.Fprintln(w, Command(c.Args()))
+	}
+	for _, c := range changes {
+		report(c, nil)
+	}
+	for _, fn := range deferred {
+		fn()
+	}
+}
+
+// Command returns the iptables command line with the arguments.
+func Command(args []string) string {
+	var b strings.Builder
+	b.WriteString("iptables")
+	for _, arg := range args {
+		b.WriteByte(' ')
+		b.WriteString(quote(arg))
+	}
+	return b.String()
+}
+
+// Payload returns the iptables-restore input of the queued changes.
+func (t *Transaction) Payload() string {
+	payload, _ := encode(t.changes)
+	return payload
+}
+
+// layout is the position of the changes in an iptables-restore payload.
+type layout struct {
+	// lines are the payload lines of the changes
+	lines []int
+	// commits are the COMMIT lines of the tables
+	commits map[string]int
+}
+
+// committed returns true if the table of a change was committed before the
+// failed line.
+func (l layout) committed(failed int, c Change) bool {
+	commit, ok := l.commits[c.Rule[1]]
+	return ok && failed > 0 && commit < failed
+}
+
+// encode builds the iptables-restore payload with the changes grouped by
+// table, keeping their order within each table.
+func encode(changes []Change) (string, layout) {
+	var tables []string
+	byTable := make(map[string][]int)
+	for i, c := range changes {
+		table := c.Rule[1]
+		if _, ok := byTable[table]; !ok {
+			tables = append(tables, table)
+		}
+		byTable[table] = append(byTable[table], i)
+	}
+	l := layout{lines: make([]int, len(changes)), commits: make(map[string]int)}
+	var b strings.Builder
+	line := 0
+	for _, table := range tables {
+		line++
+		fmt.Fprintf(&b, "*%s\n", table)
+		for _, i := range byTable[table] {
+			line++
+			l.lines[i] = line
+			args := changes[i].Args()[2:]
+			for j, arg := range args {
+				if j > 0 {
+					b.WriteByte(' ')
+				}
+				b.WriteString(quote(arg))
+			}
+			b.WriteByte('\n')
+		}
+		line++
+		l.commits[table] = line
+		b.WriteString("COMMIT\n")
+	}
+	return b.String(), l
+}
+
+// quote quotes an argument with spaces for iptables-restore.
+func quote(arg string) string {
+	if arg == "" || strings.ContainsAny(arg, " \t\"'") {
+		return strconv.Quote(arg)
+	}
+	return arg
+}
+
+// restore runs iptables-restore with the payload.
+func restore(payload string) (string, error) {
+	cmd := exec.Command(RestoreCommand[0], RestoreCommand[1:]...)
+	cmd.Stdin = strings.NewReader(payload)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Run()
+	return output.String(), err
+}
+
+// report calls the outcome callback of a change.
+func report(c Change, err error) {
+	if c.done != nil {
+		c.done(err)
+	}
+}
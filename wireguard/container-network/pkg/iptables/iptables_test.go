@@ -0,0 +1,244 @@
+package iptables
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	changes := []Change{
+		{Action: "-A", Rule: []string{"-t", "nat", "PREROUTING", "-p", "tcp", "--dport", "80", "-j", "DNAT", "--to-destination", "172.20.0.5:80"}},
+		{Action: "-I", Rule: []string{"-t", "filter", "FORWARD", "-d", "172.20.0.5", "-j", "ACCEPT"}},
+		{Action: "-D", Rule: []string{"-t", "nat", "POSTROUTING", "-m", "comment", "--comment", "web front", "-j", "MASQUERADE"}},
+	}
+	payload, l := encode(changes)
+	want := `*nat
+-A PREROUTING -p tcp --dport 80 -j DNAT --to-destination 172.20.0.5:80
+-D POSTROUTING -m comment --comment "web front" -j MASQUERADE
+COMMIT
+*filter
+-I FORWARD -d 172.20.0.5 -j ACCEPT
+COMMIT
+`
+	if payload != want {
+		t.Errorf("got payload\n%s\nwant\n%s", payload, want)
+	}
+	if want := []int{2, 6, 3}; !reflect.DeepEqual(l.lines, want) {
+		t.Errorf("got lines %v, want %v", l.lines, want)
+	}
+	if want := map[string]int{"nat": 4, "filter": 7}; !reflect.DeepEqual(l.commits, want) {
+		t.Errorf("got commits %v, want %v", l.commits, want)
+	}
+	tests := []struct {
+		failed int
+		change int
+		want   bool
+	}{
+		{failed: 6, change: 0, want: true},
+		{failed: 6, change: 1, want: false},
+		{failed: 2, change: 0, want: false},
+		{failed: 0, change: 0, want: false},
+	}
+	for _, tt := range tests {
+		if got := l.committed(tt.failed, changes[tt.change]); got != tt.want {
+			t.Errorf("committed(%d, change %d) = %v, want %v", tt.failed, tt.change, got, tt.want)
+		}
+	}
+}
+
+// fakeRestore replaces RestoreCommand with a script logging its payloads
+// and rejecting the first added rule containing reject, as iptables-restore
+// reports it. It returns the log file.
+func fakeRestore(t *testing.T, reject string) string {
+	t.Helper()
+	log := filepath.Join(t.TempDir(), "payloads")
+	command := RestoreCommand
+	t.Cleanup(func() { RestoreCommand = command })
+	RestoreCommand = []string{"awk", "-v", "out=" + log, "-v", "reject=" + reject, `
+{ print >> out }
+reject != "" && !bad && /^-[AI] / && index($0, reject) { print "iptables-restore: line " NR " failed"; bad = 1 }
+END { print "--" >> out; exit bad }`}
+	return log
+}
+
+func TestCommit(t *testing.T) {
+	rules := map[string][]string{
+		"dnat":    {"-t", "nat", "PREROUTING", "-p", "tcp", "--dport", "80", "-j", "DNAT", "--to-destination", "172.20.0.5:80"},
+		"forward": {"-t", "filter", "FORWARD", "-d", "172.20.0.5", "-j", "ACCEPT"},
+		"reject":  {"-t", "filter", "FORWARD", "-s", "172.20.0.6", "-j", "REJECT"},
+		"mark":    {"-t", "mangle", "PREROUTING", "-s", "172.20.0.6", "-j", "MARK", "--set-mark", "2"},
+	}
+	errFail := errors.New("routing rule failed")
+
+	tests := []struct {
+		name string
+		// build queues the changes with add, the ones of the unit in fn,
+		// and records the undo operations with undo
+		build    func(tx *Transaction, add func(action, name string), unit func(fn func()), undo func(name string))
+		reject   string
+		failed   int
+		outcomes map[string]error
+		// unitErr is the error reported to the failed function of the unit
+		unitErr  error
+		undone   []string
+		payloads string
+	}{
+		{
+			name: "applied",
+			build: func(tx *Transaction, add func(string, string), unit func(func()), undo func(string)) {
+				add("-A", "dnat")
+				add("-I", "forward")
+			},
+			outcomes: map[string]error{"dnat": nil, "forward": nil},
+			payloads: `*nat
+-A PREROUTING -p tcp --dport 80 -j DNAT --to-destination 172.20.0.5:80
+COMMIT
+*filter
+-I FORWARD -d 172.20.0.5 -j ACCEPT
+COMMIT
+--
+`,
+		},
+		{
+			name: "failed change without unit",
+			build: func(tx *Transaction, add func(string, string), unit func(func()), undo func(string)) {
+				add("-A", "dnat")
+				add("-A", "reject")
+				add("-I", "forward")
+			},
+			reject:   "REJECT",
+			failed:   1,
+			outcomes: map[string]error{"dnat": nil, "reject": errors.New("exit status 1"), "forward": nil},
+			payloads: `*nat
+-A PREROUTING -p tcp --dport 80 -j DNAT --to-destination 172.20.0.5:80
+COMMIT
+*filter
+-A FORWARD -s 172.20.0.6 -j REJECT
+-I FORWARD -d 172.20.0.5 -j ACCEPT
+COMMIT
+--
+*filter
+-I FORWARD -d 172.20.0.5 -j ACCEPT
+COMMIT
+--
+`,
+		},
+		{
+			name: "failed change of a unit",
+			build: func(tx *Transaction, add func(string, string), unit func(func()), undo func(string)) {
+				add("-A", "dnat")
+				unit(func() {
+					add("-A", "mark")
+					add("-A", "reject")
+				})
+			},
+			reject:   "REJECT",
+			failed:   1,
+			outcomes: map[string]error{"dnat": nil, "mark": nil, "reject": errors.New("exit status 1")},
+			unitErr:  errors.New("exit status 1"),
+			payloads: `*nat
+-A PREROUTING -p tcp --dport 80 -j DNAT --to-destination 172.20.0.5:80
+COMMIT
+*mangle
+-A PREROUTING -s 172.20.0.6 -j MARK --set-mark 2
+COMMIT
+*filter
+-A FORWARD -s 172.20.0.6 -j REJECT
+COMMIT
+--
+*mangle
+-D PREROUTING -s 172.20.0.6 -j MARK --set-mark 2
+COMMIT
+--
+`,
+		},
+		{
+			name: "unit failed outside iptables",
+			build: func(tx *Transaction, add func(string, string), unit func(func()), undo func(string)) {
+				add("-A", "dnat")
+				unit(func() {
+					add("-A", "mark")
+					tx.Undo(func() { undo("first") })
+					tx.Undo(func() { undo("second") })
+					tx.Fail(errFail)
+				})
+			},
+			failed:   1,
+			outcomes: map[string]error{"dnat": nil, "mark": ErrUnitFailed},
+			unitErr:  errFail,
+			undone:   []string{"second", "first"},
+			payloads: `*nat
+-A PREROUTING -p tcp --dport 80 -j DNAT --to-destination 172.20.0.5:80
+COMMIT
+--
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := fakeRestore(t, tt.reject)
+			outcomes := make(map[string]error)
+			var unitErr error
+			var undone []string
+			tx := NewTransaction()
+			tt.build(tx, func(action, name string) {
+				tx.Add(action, rules[name], func(err error) { outcomes[name] = err })
+			}, func(fn func()) {
+				tx.Unit(fn, func(err error) { unitErr = err })
+			}, func(name string) {
+				undone = append(undone, name)
+			})
+			if got := tx.Commit(); got != tt.failed {
+				t.Errorf("got %d failed changes, want %d", got, tt.failed)
+			}
+			if len(outcomes) != len(tt.outcomes) {
+				t.Errorf("got outcomes %v, want %v", outcomes, tt.outcomes)
+			}
+			for name, want := range tt.outcomes {
+				if got, ok := outcomes[name]; !ok || !sameError(got, want) {
+					t.Errorf("got outcome %v for %s, want %v", got, name, want)
+				}
+			}
+			if !sameError(unitErr, tt.unitErr) {
+				t.Errorf("got unit error %v, want %v", unitErr, tt.unitErr)
+			}
+			if !reflect.DeepEqual(undone, tt.undone) {
+				t.Errorf("got undone %v, want %v", undone, tt.undone)
+			}
+			payloads, err := os.ReadFile(log)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(payloads) != tt.payloads {
+				t.Errorf("got payloads\n%s\nwant\n%s", payloads, tt.payloads)
+			}
+		})
+	}
+}
+
+// sameError returns true if both errors are nil, got wraps want or their
+// messages start the same way.
+func sameError(got, want error) bool {
+	if got == nil || want == nil {
+		return got == want
+	}
+	return errors.Is(got, want) || strings.HasPrefix(got.Error(), want.Error())
+}
+
+func TestFailOutsideUnit(t *testing.T) {
+	tx := NewTransaction()
+	called := false
+	tx.Undo(func() { called = true })
+	if tx.Fail(errors.New("failed")) {
+		t.Error("Fail returned true outside a unit")
+	}
+	fakeRestore(t, "")
+	tx.Add("-A", []string{"-t", "filter", "FORWARD", "-j", "ACCEPT"}, nil)
+	if failed := tx.Commit(); failed != 0 || called {
+		t.Errorf("got %d failed changes and undo called %v, want none", failed, called)
+	}
+}
@@ -0,0 +1,134 @@
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// SaveCommand is the command listing the rules of a table.
+var SaveCommand = []string{"iptables-save"}
+
+// Save returns the rules of a table as listed by iptables-save, in the
+// format {"-t", table, chain, spec...}.
+func Save(table string) ([][]string, error) {
+	args := append(append([]string{}, SaveCommand[1:]...), "-t", table)
+	cmd := exec.Command(SaveCommand[0], args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	var rules [][]string
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		args := split(line)
+		if len(args) < 2 || args[0] != "-A" {
+			continue
+		}
+		rules = append(rules, append([]string{"-t", table}, args[1:]...))
+	}
+	return rules, nil
+}
+
+// split splits an iptables-save line into arguments, unquoting the quoted
+// ones (e.g. comments).
+func split(line string) []string {
+	var args []string
+	for line = strings.TrimSpace(line); line != ""; line = strings.TrimSpace(line) {
+		if line[0] == '"' {
+			if value, err := strconv.QuotedPrefix(line); err == nil {
+				arg, _ := strconv.Unquote(value)
+				args = append(args, arg)
+				line = line[len(value):]
+				continue
+			}
+		}
+		end := strings.IndexAny(line, " \t")
+		if end < 0 {
+			end = len(line)
+		}
+		args = append(args, line[:end])
+		line = line[end:]
+	}
+	return args
+}
+
+// builtinOptions are the options iptables-save lists first, in this order.
+var builtinOptions = []string{"-s", "-d", "-i", "-o", "-p"}
+
+// Canonical returns a rule in the format {"-t", table, chain, spec...} as
+// iptables-save lists it, so it can be compared with the rules of Save:
+// addresses get their prefix length, the implicit protocol match of the
+// ports is loaded explicitly and the target options get their defaults. Only
+// the options of the rules of this daemon are handled.
+func Canonical(rule []string) []string {
+	builtin := make(map[string]string)
+	var matches, target []string
+	loaded := make(map[string]bool)
+	spec := rule[3:]
+	for i := 0; i < len(spec); i++ {
+		arg := spec[i]
+		switch {
+		case arg == "-j":
+			target = spec[i:]
+			i = len(spec)
+		case isBuiltin(arg) && i+1 < len(spec):
+			i++
+			value := spec[i]
+			if (arg == "-s" || arg == "-d") && !strings.Contains(value, "/") {
+				value += "/32"
+			}
+			builtin[arg] = value
+		case arg == "-m" && i+1 < len(spec):
+			i++
+			loaded[spec[i]] = true
+			matches = append(matches, arg, spec[i])
+		case (arg == "--dport" || arg == "--sport") && builtin["-p"] != "" && !loaded[builtin["-p"]]:
+			loaded[builtin["-p"]] = true
+			matches = append(matches, "-m", builtin["-p"], arg)
+		default:
+			matches = append(matches, arg)
+		}
+	}
+	canonical := []string{rule[0], rule[1], rule[2]}
+	for _, option := range builtinOptions {
+		if value, ok := builtin[option]; ok {
+			canonical = append(canonical, option, value)
+		}
+	}
+	canonical = append(canonical, matches...)
+	return append(canonical, canonicalTarget(target)...)
+}
+
+// isBuiltin returns true for the options listed first by iptables-save.
+func isBuiltin(arg string) bool {
+	for _, option := range builtinOptions {
+		if arg == option {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalTarget returns the target options as listed by iptables-save.
+func canonicalTarget(target []string) []string {
+	if len(target) < 2 {
+		return target
+	}
+	switch target[1] {
+	case "MARK":
+		if len(target) == 4 && target[2] == "--set-mark" {
+			if mark, err := strconv.ParseUint(target[3], 0, 32); err == nil {
+				return []string{"-j", "MARK", "--set-xmark", fmt.Sprintf("0x%x/0xffffffff", mark)}
+			}
+		}
+	case "REJECT":
+		if len(target) == 2 {
+			return []string{"-j", "REJECT", "--reject-with", "icmp-port-unreachable"}
+		}
+	}
+	return target
+}
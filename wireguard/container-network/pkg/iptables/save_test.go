@@ -0,0 +1,105 @@
+package iptables
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCanonical(t *testing.T) {
+	tests := []struct {
+		name string
+		rule string
+		want string
+	}{
+		{
+			name: "DNAT with implicit protocol match",
+			rule: "-t nat PREROUTING -i wg0 -p tcp --dport 80 -j DNAT --to-destination 172.20.0.5:80",
+			want: "-t nat PREROUTING -i wg0 -p tcp -m tcp --dport 80 -j DNAT --to-destination 172.20.0.5:80",
+		},
+		{
+			name: "builtin options reordered and host prefixes",
+			rule: "-t filter FORWARD -p udp -d 172.20.0.5 --dport 53 -s 10.0.0.0/8 -j ACCEPT",
+			want: "-t filter FORWARD -s 10.0.0.0/8 -d 172.20.0.5/32 -p udp -m udp --dport 53 -j ACCEPT",
+		},
+		{
+			name: "protocol match already loaded",
+			rule: "-t filter FORWARD -p tcp -m tcp --sport 80 -j ACCEPT",
+			want: "-t filter FORWARD -p tcp -m tcp --sport 80 -j ACCEPT",
+		},
+		{
+			name: "other matches kept in order",
+			rule: "-t nat POSTROUTING -o eth1 -d 172.20.0.5 -p tcp --dport 443 -m conntrack --ctstate DNAT -j MASQUERADE",
+			want: "-t nat POSTROUTING -d 172.20.0.5/32 -o eth1 -p tcp -m tcp --dport 443 -m conntrack --ctstate DNAT -j MASQUERADE",
+		},
+		{
+			name: "mark target",
+			rule: "-t mangle PREROUTING -s 172.20.0.5 -p tcp --sport 80 -j MARK --set-mark 2",
+			want: "-t mangle PREROUTING -s 172.20.0.5/32 -p tcp -m tcp --sport 80 -j MARK --set-xmark 0x2/0xffffffff",
+		},
+		{
+			name: "reject target",
+			rule: "-t filter FORWARD -s 172.20.0.5 -m conntrack --ctstate NEW -j REJECT",
+			want: "-t filter FORWARD -s 172.20.0.5/32 -m conntrack --ctstate NEW -j REJECT --reject-with icmp-port-unreachable",
+		},
+		{
+			name: "reject target with option",
+			rule: "-t filter FORWARD -s 172.20.0.5 -j REJECT --reject-with tcp-reset",
+			want: "-t filter FORWARD -s 172.20.0.5/32 -j REJECT --reject-with tcp-reset",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := strings.Join(Canonical(strings.Fields(tt.rule)), " ")
+			if got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{line: "", want: nil},
+		{line: "  -A FORWARD  -j ACCEPT ", want: []string{"-A", "FORWARD", "-j", "ACCEPT"}},
+		{line: "-A FORWARD\t-j ACCEPT", want: []string{"-A", "FORWARD", "-j", "ACCEPT"}},
+		{
+			line: `-A FORWARD -m comment --comment "container web \"front\"" -j ACCEPT`,
+			want: []string{"-A", "FORWARD", "-m", "comment", "--comment", `container web "front"`, "-j", "ACCEPT"},
+		},
+		{line: `-A FORWARD --comment "" -j ACCEPT`, want: []string{"-A", "FORWARD", "--comment", "", "-j", "ACCEPT"}},
+		{line: `-A FORWARD --comment "unterminated`, want: []string{"-A", "FORWARD", "--comment", `"unterminated`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			if got := split(tt.line); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSave(t *testing.T) {
+	defer func(command []string) { SaveCommand = command }(SaveCommand)
+	SaveCommand = []string{"printf", `# Generated by iptables-save
+*nat
+:PREROUTING ACCEPT [0:0]
+-A PREROUTING -p tcp -m tcp --dport 80 -j DNAT --to-destination 172.20.0.5:80
+-A POSTROUTING -m comment --comment "a b" -j MASQUERADE
+COMMIT
+`}
+	rules, err := Save("nat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"-t", "nat", "PREROUTING", "-p", "tcp", "-m", "tcp", "--dport", "80", "-j", "DNAT", "--to-destination", "172.20.0.5:80"},
+		{"-t", "nat", "POSTROUTING", "-m", "comment", "--comment", "a b", "-j", "MASQUERADE"},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("got %q, want %q", rules, want)
+	}
+}
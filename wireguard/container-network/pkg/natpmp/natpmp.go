@@ -0,0 +1,163 @@
+// Package natpmp implements a NAT-PMP client (RFC 6886) to request port
+// mappings from the VPN gateway.
+package natpmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// DefaultPort is the NAT-PMP server port of the gateway.
+const DefaultPort = 5351
+
+const (
+	version         = 0
+	opExternal      = 0
+	opMapUDP        = 1
+	opMapTCP        = 2
+	opResponse      = 128
+	initialTimeout  = 250 * time.Millisecond
+	defaultAttempts = 5
+)
+
+// resultCodes are the NAT-PMP result codes (RFC 6886, section 3.5).
+var resultCodes = map[uint16]string{
+	1: "unsupported version",
+	2: "not authorized or refused",
+	3: "network failure",
+	4: "out of resources",
+	5: "unsupported opcode",
+}
+
+// Client sends NAT-PMP requests to a gateway.
+type Client struct {
+	// Gateway is the NAT-PMP server address.
+	Gateway net.IP
+	// Port is the NAT-PMP server port, DefaultPort if zero.
+	Port int
+	// Attempts is the number of requests sent before failing, each one
+	// doubling the timeout of the previous one starting with 250ms.
+	Attempts int
+}
+
+// Mapping is a port mapping granted by the gateway.
+type Mapping struct {
+	Protocol     string
+	InternalPort uint16
+	ExternalPort uint16
+	Lifetime     time.Duration
+}
+
+// NewClient creates a new NAT-PMP client for the gateway.
+func NewClient(gateway net.IP) *Client {
+	return &Client{Gateway: gateway, Port: DefaultPort, Attempts: defaultAttempts}
+}
+
+// ExternalAddress returns the public address of the gateway.
+func (c *Client) ExternalAddress() (net.IP, error) {
+	response, err := c.request([]byte{version, opExternal}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IPv4(response[8], response[9], response[10], response[11]), nil
+}
+
+// AddPortMapping requests a mapping of the internal port, suggesting the
+// external port (0 lets the gateway choose). A zero lifetime deletes the
+// mapping. The granted external port may differ from the suggested one.
+func (c *Client) AddPortMapping(protocol string, internalPort, externalPort uint16, lifetime time.Duration) (*Mapping, error) {
+	var op byte
+	switch protocol {
+	case "udp":
+		op = opMapUDP
+	case "tcp":
+		op = opMapTCP
+	default:
+		return nil, fmt.Errorf("unsupported protocol %q", protocol)
+	}
+	msg := make([]byte, 12)
+	msg[0] = version
+	msg[1] = op
+	binary.BigEndian.PutUint16(msg[4:6], internalPort)
+	binary.BigEndian.PutUint16(msg[6:8], externalPort)
+	binary.BigEndian.PutUint32(msg[8:12], uint32(lifetime/time.Second))
+	response, err := c.request(msg, 16)
+	if err != nil {
+		return nil, err
+	}
+	return &Mapping{
+		Protocol:     protocol,
+		InternalPort: binary.BigEndian.Uint16(response[8:10]),
+		ExternalPort: binary.BigEndian.Uint16(response[10:12]),
+		Lifetime:     time.Duration(binary.BigEndian.Uint32(response[12:16])) * time.Second,
+	}, nil
+}
+
+// DeletePortMapping removes the mapping of the internal port.
+func (c *Client) DeletePortMapping(protocol string, internalPort uint16) error {
+	_, err := c.AddPortMapping(protocol, internalPort, 0, 0)
+	return err
+}
+
+// request sends a request retrying with exponential backoff and returns the
+// response, checking its opcode and result code.
+func (c *Client) request(msg []byte, size int) ([]byte, error) {
+	port := c.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+	conn, err := net.Dial("udp4", net.JoinHostPort(c.Gateway.String(), strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	attempts := c.Attempts
+	if attempts <= 0 {
+		attempts = defaultAttempts
+	}
+	buf := make([]byte, 16)
+	timeout := initialTimeout
+	var lastErr error
+	for i := 0; i < attempts; i++ {
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(timeout)
+		timeout *= 2
+		for {
+			if err := conn.SetReadDeadline(deadline); err != nil {
+				return nil, err
+			}
+			n, err := conn.Read(buf)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			if err != nil {
+				// e.g. connection refused while the gateway is not ready
+				lastErr = err
+				time.Sleep(time.Until(deadline))
+				break
+			}
+			// ignore unrelated or truncated packets
+			if n < size || buf[0] != version || buf[1] != opResponse+msg[1] {
+				continue
+			}
+			if code := binary.BigEndian.Uint16(buf[2:4]); code != 0 {
+				if reason, ok := resultCodes[code]; ok {
+					return nil, fmt.Errorf("gateway %s: %s", c.Gateway, reason)
+				}
+				return nil, fmt.Errorf("gateway %s: result code %d", c.Gateway, code)
+			}
+			return buf[:n], nil
+		}
+	}
+	if lastErr != nil {
+		return nil, fmt.Errorf("gateway %s: no response after %d attempts: %w", c.Gateway, attempts, lastErr)
+	}
+	return nil, fmt.Errorf("gateway %s: no response after %d attempts", c.Gateway, attempts)
+}
@@ -0,0 +1,193 @@
+package natpmp
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// responder serves NAT-PMP requests on 127.0.0.1 with the responses
+// returned by respond, which may send none or several, until the test ends.
+func responder(t *testing.T, respond func(request []byte) [][]byte) *Client {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			for _, response := range respond(append([]byte(nil), buf[:n]...)) {
+				conn.WriteToUDP(response, addr)
+			}
+		}
+	}()
+	client := NewClient(net.IPv4(127, 0, 0, 1))
+	client.Port = conn.LocalAddr().(*net.UDPAddr).Port
+	client.Attempts = 2
+	return client
+}
+
+// mapResponse returns the response to a mapping request granting the
+// external port and lifetime.
+func mapResponse(request []byte, code uint16, external uint16, lifetime uint32) []byte {
+	response := make([]byte, 16)
+	response[1] = opResponse + request[1]
+	binary.BigEndian.PutUint16(response[2:4], code)
+	binary.BigEndian.PutUint32(response[4:8], 1000)
+	copy(response[8:10], request[4:6])
+	binary.BigEndian.PutUint16(response[10:12], external)
+	binary.BigEndian.PutUint32(response[12:16], lifetime)
+	return response
+}
+
+func TestExternalAddress(t *testing.T) {
+	client := responder(t, func(request []byte) [][]byte {
+		if len(request) != 2 || request[1] != opExternal {
+			t.Errorf("unexpected request %v", request)
+			return nil
+		}
+		return [][]byte{{0, opResponse, 0, 0, 0, 0, 3, 232, 198, 51, 100, 7}}
+	})
+	ip, err := client.ExternalAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.Equal(net.IPv4(198, 51, 100, 7)) {
+		t.Errorf("got %s, want 198.51.100.7", ip)
+	}
+}
+
+func TestAddPortMapping(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol string
+		respond  func(request []byte) [][]byte
+		want     Mapping
+		err      string
+	}{
+		{
+			name:     "tcp granted another port",
+			protocol: "tcp",
+			respond: func(request []byte) [][]byte {
+				return [][]byte{mapResponse(request, 0, 40123, 60)}
+			},
+			want: Mapping{Protocol: "tcp", InternalPort: 8080, ExternalPort: 40123, Lifetime: time.Minute},
+		},
+		{
+			name:     "udp",
+			protocol: "udp",
+			respond: func(request []byte) [][]byte {
+				return [][]byte{mapResponse(request, 0, 8080, 60)}
+			},
+			want: Mapping{Protocol: "udp", InternalPort: 8080, ExternalPort: 8080, Lifetime: time.Minute},
+		},
+		{
+			name:     "unrelated and truncated packets ignored",
+			protocol: "tcp",
+			respond: func(request []byte) [][]byte {
+				return [][]byte{
+					{0, opResponse + opExternal, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4},
+					{0, opResponse + opMapTCP, 0, 0},
+					mapResponse(request, 0, 40000, 30),
+				}
+			},
+			want: Mapping{Protocol: "tcp", InternalPort: 8080, ExternalPort: 40000, Lifetime: 30 * time.Second},
+		},
+		{
+			name:     "request lost once",
+			protocol: "tcp",
+			respond: func() func(request []byte) [][]byte {
+				requests := 0
+				return func(request []byte) [][]byte {
+					if requests++; requests == 1 {
+						return nil
+					}
+					return [][]byte{mapResponse(request, 0, 8080, 60)}
+				}
+			}(),
+			want: Mapping{Protocol: "tcp", InternalPort: 8080, ExternalPort: 8080, Lifetime: time.Minute},
+		},
+		{
+			name:     "refused",
+			protocol: "tcp",
+			respond: func(request []byte) [][]byte {
+				return [][]byte{mapResponse(request, 2, 0, 0)}
+			},
+			err: "not authorized or refused",
+		},
+		{
+			name:     "unknown result code",
+			protocol: "tcp",
+			respond: func(request []byte) [][]byte {
+				return [][]byte{mapResponse(request, 42, 0, 0)}
+			},
+			err: "result code 42",
+		},
+		{
+			name:     "no response",
+			protocol: "tcp",
+			respond: func(request []byte) [][]byte {
+				return nil
+			},
+			err: "no response after 2 attempts",
+		},
+		{
+			name:     "unsupported protocol",
+			protocol: "sctp",
+			err:      `unsupported protocol "sctp"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := responder(t, func(request []byte) [][]byte {
+				if len(request) != 12 {
+					t.Errorf("got a request of %d bytes, want 12", len(request))
+					return nil
+				}
+				if port := binary.BigEndian.Uint16(request[4:6]); port != 8080 {
+					t.Errorf("got internal port %d, want 8080", port)
+				}
+				if lifetime := binary.BigEndian.Uint32(request[8:12]); lifetime != 60 {
+					t.Errorf("got lifetime %d, want 60", lifetime)
+				}
+				return tt.respond(request)
+			})
+			mapping, err := client.AddPortMapping(tt.protocol, 8080, 8080, time.Minute)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *mapping != tt.want {
+				t.Errorf("got %+v, want %+v", *mapping, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeletePortMapping(t *testing.T) {
+	client := responder(t, func(request []byte) [][]byte {
+		if request[1] != opMapUDP {
+			t.Errorf("got opcode %d, want %d", request[1], opMapUDP)
+		}
+		if external, lifetime := binary.BigEndian.Uint16(request[6:8]), binary.BigEndian.Uint32(request[8:12]); external != 0 || lifetime != 0 {
+			t.Errorf("got external port %d and lifetime %d, want 0 and 0", external, lifetime)
+		}
+		return [][]byte{mapResponse(request, 0, 0, 0)}
+	})
+	if err := client.DeletePortMapping("udp", 8080); err != nil {
+		t.Fatal(err)
+	}
+}
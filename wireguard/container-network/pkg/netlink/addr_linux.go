@@ -0,0 +1,33 @@
+package netlink
+
+import (
+	"net"
+	"syscall"
+)
+
+// AddrList returns the IPv4 addresses of all network interfaces.
+func (h *Handle) AddrList() ([]Addr, error) {
+	req := make([]byte, syscall.SizeofIfAddrmsg)
+	req[0] = syscall.AF_INET
+	msgs, err := h.execute(syscall.RTM_GETADDR, syscall.NLM_F_DUMP, req)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []Addr
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWADDR || len(m.Data) < syscall.SizeofIfAddrmsg {
+			continue
+		}
+		prefixLen := int(m.Data[1])
+		addr := Addr{LinkIndex: int(nativeEndian.Uint32(m.Data[4:8]))}
+		for _, a := range decodeAttributes(m.Data[syscall.SizeofIfAddrmsg:]) {
+			if a.Type == syscall.IFA_LOCAL || (a.Type == syscall.IFA_ADDRESS && addr.IPNet == nil) {
+				addr.IPNet = &net.IPNet{IP: net.IP(a.Value), Mask: net.CIDRMask(prefixLen, 8*len(a.Value))}
+			}
+		}
+		if addr.IPNet != nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
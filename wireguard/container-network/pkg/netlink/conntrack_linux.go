@@ -0,0 +1,179 @@
+package netlink
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// ctnetlink constants (linux/netfilter/nfnetlink_conntrack.h).
+const (
+	nfnlSubsysCtnetlink = 1
+	ipctnlMsgCtNew      = 0
+	ipctnlMsgCtGet      = 1
+	ipctnlMsgCtDelete   = 2
+	nfnlgrpConntrackNew = 1
+	sizeofNfgenmsg      = 4
+	ctaTupleOrig        = 1
+	ctaTupleReply       = 2
+	ctaTupleIP          = 1
+	ctaTupleProto       = 2
+	ctaIPv4Src          = 1
+	ctaIPv4Dst          = 2
+	ctaProtoNum         = 1
+	ctaProtoSrcPort     = 2
+	ctaProtoDstPort     = 3
+)
+
+// ConntrackSubscribe sends the new IPv4 conntrack entries to the channel
+// until the context is done.
+func ConntrackSubscribe(ctx context.Context, ch chan<- ConntrackFlow) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_NETFILTER)
+	if err != nil {
+		return fmt.Errorf("opening netlink socket: %w", err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: 1 << (nfnlgrpConntrackNew - 1)}); err != nil {
+		return fmt.Errorf("binding netlink socket: %w", err)
+	}
+	// Wake up periodically to check the context
+	tv := syscall.NsecToTimeval(time.Second.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return fmt.Errorf("setting netlink socket timeout: %w", err)
+	}
+	buf := make([]byte, 64*1024)
+	for ctx.Err() == nil {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			// ENOBUFS: events were lost under load, keep receiving
+			if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.ENOBUFS) {
+				continue
+			}
+			return fmt.Errorf("receiving conntrack event: %w", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		for _, m := range msgs {
+			if m.Header.Type != nfnlSubsysCtnetlink<<8|ipctnlMsgCtNew {
+				continue
+			}
+			flow, ok := decodeConntrackFlow(m.Data)
+			if !ok {
+				continue
+			}
+			select {
+			case ch <- flow:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// ConntrackDelete deletes the IPv4 conntrack entries selected by match and
+// returns how many were deleted. Entries that expire meanwhile are ignored.
+func ConntrackDelete(match func(ConntrackFlow) bool) (int, error) {
+	h, err := newHandle(syscall.NETLINK_NETFILTER)
+	if err != nil {
+		return 0, err
+	}
+	defer h.Close()
+	msgs, err := h.execute(nfnlSubsysCtnetlink<<8|ipctnlMsgCtGet, syscall.NLM_F_DUMP, []byte{syscall.AF_INET, 0, 0, 0})
+	if err != nil {
+		return 0, fmt.Errorf("listing conntrack entries: %w", err)
+	}
+	deleted := 0
+	for _, m := range msgs {
+		flow, ok := decodeConntrackFlow(m.Data)
+		if !ok || !match(flow) {
+			continue
+		}
+		req := []byte{syscall.AF_INET, 0, 0, 0}
+		req = append(req, encodeAttributes([]attribute{encodeConntrackTuple(ctaTupleOrig, flow.Protocol, flow.Original)})...)
+		if _, err := h.execute(nfnlSubsysCtnetlink<<8|ipctnlMsgCtDelete, 0, req); err != nil {
+			if errors.Is(err, syscall.ENOENT) {
+				continue
+			}
+			return deleted, fmt.Errorf("deleting conntrack entry %s: %w", flow, err)
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// encodeConntrackTuple encodes a nested CTA_TUPLE_* attribute.
+func encodeConntrackTuple(t uint16, protocol uint8, tuple ConntrackTuple) attribute {
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports[0:2], tuple.SrcPort)
+	binary.BigEndian.PutUint16(ports[2:4], tuple.DstPort)
+	ip := encodeAttributes([]attribute{
+		{Type: ctaIPv4Src, Value: tuple.Src.To4()},
+		{Type: ctaIPv4Dst, Value: tuple.Dst.To4()},
+	})
+	proto := encodeAttributes([]attribute{
+		{Type: ctaProtoNum, Value: []byte{protocol}},
+		{Type: ctaProtoSrcPort, Value: ports[0:2]},
+		{Type: ctaProtoDstPort, Value: ports[2:4]},
+	})
+	return attribute{Type: t | syscall.NLA_F_NESTED, Value: encodeAttributes([]attribute{
+		{Type: ctaTupleIP | syscall.NLA_F_NESTED, Value: ip},
+		{Type: ctaTupleProto | syscall.NLA_F_NESTED, Value: proto},
+	})}
+}
+
+// decodeConntrackFlow decodes an IPv4 conntrack entry (nfgenmsg + attributes).
+func decodeConntrackFlow(b []byte) (ConntrackFlow, bool) {
+	var flow ConntrackFlow
+	if len(b) < sizeofNfgenmsg || b[0] != syscall.AF_INET {
+		return flow, false
+	}
+	var orig, reply bool
+	for _, a := range decodeAttributes(b[sizeofNfgenmsg:]) {
+		switch a.Type {
+		case ctaTupleOrig:
+			orig = decodeConntrackTuple(a.Value, &flow.Original, &flow.Protocol)
+		case ctaTupleReply:
+			reply = decodeConntrackTuple(a.Value, &flow.Reply, &flow.Protocol)
+		}
+	}
+	return flow, orig && reply
+}
+
+// decodeConntrackTuple decodes a nested CTA_TUPLE_* attribute.
+func decodeConntrackTuple(b []byte, tuple *ConntrackTuple, protocol *uint8) bool {
+	for _, a := range decodeAttributes(b) {
+		switch a.Type {
+		case ctaTupleIP:
+			for _, ip := range decodeAttributes(a.Value) {
+				if len(ip.Value) != 4 {
+					continue
+				}
+				switch ip.Type {
+				case ctaIPv4Src:
+					tuple.Src = net.IP(append([]byte(nil), ip.Value...))
+				case ctaIPv4Dst:
+					tuple.Dst = net.IP(append([]byte(nil), ip.Value...))
+				}
+			}
+		case ctaTupleProto:
+			for _, p := range decodeAttributes(a.Value) {
+				switch {
+				case p.Type == ctaProtoNum && len(p.Value) == 1:
+					*protocol = p.Value[0]
+				case p.Type == ctaProtoSrcPort && len(p.Value) == 2:
+					tuple.SrcPort = binary.BigEndian.Uint16(p.Value)
+				case p.Type == ctaProtoDstPort && len(p.Value) == 2:
+					tuple.DstPort = binary.BigEndian.Uint16(p.Value)
+				}
+			}
+		}
+	}
+	return tuple.Src != nil && tuple.Dst != nil
+}
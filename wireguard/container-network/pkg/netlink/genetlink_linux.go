@@ -0,0 +1,33 @@
+package netlink
+
+import "fmt"
+
+// Generic netlink controller (linux/genetlink.h).
+const (
+	genlIDCtrl         = 0x10
+	ctrlCmdGetFamily   = 3
+	ctrlAttrFamilyID   = 1
+	ctrlAttrFamilyName = 2
+	sizeofGenlMsghdr   = 4
+)
+
+// genlFamily resolves the id of a generic netlink family.
+func (h *Handle) genlFamily(name string) (uint16, error) {
+	req := []byte{ctrlCmdGetFamily, 1, 0, 0}
+	req = append(req, encodeAttributes([]attribute{{Type: ctrlAttrFamilyName, Value: append([]byte(name), 0)}})...)
+	msgs, err := h.execute(genlIDCtrl, 0, req)
+	if err != nil {
+		return 0, fmt.Errorf("resolving generic netlink family %s: %w", name, err)
+	}
+	for _, m := range msgs {
+		if len(m.Data) < sizeofGenlMsghdr {
+			continue
+		}
+		for _, a := range decodeAttributes(m.Data[sizeofGenlMsghdr:]) {
+			if a.Type == ctrlAttrFamilyID && len(a.Value) >= 2 {
+				return nativeEndian.Uint16(a.Value), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("generic netlink family %s not found", name)
+}
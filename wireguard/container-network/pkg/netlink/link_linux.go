@@ -0,0 +1,72 @@
+package netlink
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Attributes of IFLA_LINKINFO (linux/if_link.h).
+const iflaInfoKind = 1
+
+// LinkList returns all network interfaces.
+func (h *Handle) LinkList() ([]Link, error) {
+	req := make([]byte, syscall.SizeofIfInfomsg)
+	req[0] = syscall.AF_UNSPEC
+	msgs, err := h.execute(syscall.RTM_GETLINK, syscall.NLM_F_DUMP, req)
+	if err != nil {
+		return nil, err
+	}
+	var links []Link
+	for _, m := range msgs {
+		if link, ok := decodeLink(m); ok {
+			links = append(links, link)
+		}
+	}
+	return links, nil
+}
+
+// LinkByName returns the network interface with the given name.
+func (h *Handle) LinkByName(name string) (*Link, error) {
+	links, err := h.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	for _, link := range links {
+		if link.Name == name {
+			return &link, nil
+		}
+	}
+	return nil, fmt.Errorf("link %q not found", name)
+}
+
+func decodeLink(m syscall.NetlinkMessage) (Link, bool) {
+	if m.Header.Type != syscall.RTM_NEWLINK || len(m.Data) < syscall.SizeofIfInfomsg {
+		return Link{}, false
+	}
+	link := Link{
+		Index: int(int32(nativeEndian.Uint32(m.Data[4:8]))),
+		Up:    nativeEndian.Uint32(m.Data[8:12])&syscall.IFF_UP != 0,
+	}
+	for _, a := range decodeAttributes(m.Data[syscall.SizeofIfInfomsg:]) {
+		switch a.Type {
+		case syscall.IFLA_IFNAME:
+			link.Name = string(trimNull(a.Value))
+		case syscall.IFLA_LINKINFO:
+			for _, info := range decodeAttributes(a.Value) {
+				if info.Type == iflaInfoKind {
+					link.Kind = string(trimNull(info.Value))
+				}
+			}
+		}
+	}
+	return link, true
+}
+
+func trimNull(b []byte) []byte {
+	for i, c := range b {
+		if c == 0 {
+			return b[:i]
+		}
+	}
+	return b
+}
@@ -0,0 +1,122 @@
+// Package netlink provides a minimal rtnetlink client to manage policy
+// routing rules and routes without depending on the iproute2 tools.
+package netlink
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ErrNotSupported is returned on platforms without netlink support.
+var ErrNotSupported = errors.New("netlink not supported on this platform")
+
+// Rule represents a policy routing rule (ip rule).
+type Rule struct {
+	Priority int
+	Mark     uint32
+	Table    int
+	Src      *net.IPNet
+}
+
+func (r Rule) String() string {
+	s := "from all"
+	if r.Src != nil {
+		s = "from " + r.Src.String()
+	}
+	if r.Mark != 0 {
+		s += fmt.Sprintf(" fwmark %#x", r.Mark)
+	}
+	s += fmt.Sprintf(" lookup %d", r.Table)
+	if r.Priority > 0 {
+		s = fmt.Sprintf("%d: %s", r.Priority, s)
+	}
+	return s
+}
+
+// Route represents a route in a routing table (ip route).
+// A nil Dst means the default route.
+type Route struct {
+	Dst       *net.IPNet
+	Gateway   net.IP
+	LinkIndex int
+	Table     int
+}
+
+func (r Route) String() string {
+	s := "default"
+	if r.Dst != nil {
+		s = r.Dst.String()
+	}
+	if r.Gateway != nil {
+		s += " via " + r.Gateway.String()
+	}
+	if r.LinkIndex > 0 {
+		s += fmt.Sprintf(" dev %d", r.LinkIndex)
+	}
+	return s + fmt.Sprintf(" table %d", r.Table)
+}
+
+// Link represents a network interface. Kind is the link type for virtual
+// interfaces (e.g. "wireguard", "bridge", "veth").
+type Link struct {
+	Index int
+	Name  string
+	Kind  string
+	Up    bool
+}
+
+// Addr represents an IP address assigned to a network interface.
+type Addr struct {
+	LinkIndex int
+	IPNet     *net.IPNet
+}
+
+// Device represents a WireGuard interface and its peers.
+type Device struct {
+	Name  string
+	Peers []Peer
+}
+
+// Peer represents a WireGuard peer. LastHandshake is zero if there was no handshake yet.
+type Peer struct {
+	PublicKey     string
+	Endpoint      *net.UDPAddr
+	LastHandshake time.Time
+	AllowedIPs    []net.IPNet
+}
+
+// LatestHandshake returns the most recent handshake time of all the peers.
+func (d *Device) LatestHandshake() time.Time {
+	var latest time.Time
+	for _, p := range d.Peers {
+		if p.LastHandshake.After(latest) {
+			latest = p.LastHandshake
+		}
+	}
+	return latest
+}
+
+// ConntrackTuple is a connection tuple of a conntrack entry.
+type ConntrackTuple struct {
+	Src     net.IP
+	Dst     net.IP
+	SrcPort uint16
+	DstPort uint16
+}
+
+// ConntrackFlow represents a conntrack entry. Original is the tuple of the
+// first packet (the client address for DNATed connections) and Reply the
+// expected tuple of the replies (the translated addresses).
+type ConntrackFlow struct {
+	Protocol uint8
+	Original ConntrackTuple
+	Reply    ConntrackTuple
+}
+
+func (f ConntrackFlow) String() string {
+	return fmt.Sprintf("proto %d src %s:%d dst %s:%d reply src %s:%d dst %s:%d", f.Protocol,
+		f.Original.Src, f.Original.SrcPort, f.Original.Dst, f.Original.DstPort,
+		f.Reply.Src, f.Reply.SrcPort, f.Reply.Dst, f.Reply.DstPort)
+}
@@ -0,0 +1,139 @@
+package netlink
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"syscall"
+)
+
+var nativeEndian = binary.NativeEndian
+
+// Handle is a netlink socket bound to a protocol.
+type Handle struct {
+	fd  int
+	seq atomic.Uint32
+}
+
+// NewHandle opens a rtnetlink socket.
+func NewHandle() (*Handle, error) {
+	return newHandle(syscall.NETLINK_ROUTE)
+}
+
+// newHandle opens a netlink socket for the given protocol.
+func newHandle(protocol int) (*Handle, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, protocol)
+	if err != nil {
+		return nil, fmt.Errorf("opening netlink socket: %w", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("binding netlink socket: %w", err)
+	}
+	return &Handle{fd: fd}, nil
+}
+
+// Close closes the netlink socket.
+func (h *Handle) Close() error {
+	return syscall.Close(h.fd)
+}
+
+// execute sends a request and waits for its answer. For dump requests all
+// received messages are returned, otherwise the kernel acknowledgement is checked.
+func (h *Handle) execute(msgType, flags uint16, payload []byte) ([]syscall.NetlinkMessage, error) {
+	seq := h.seq.Add(1)
+	msg := make([]byte, syscall.SizeofNlMsghdr, syscall.SizeofNlMsghdr+len(payload))
+	msg = append(msg, payload...)
+	nativeEndian.PutUint32(msg[0:4], uint32(len(msg)))
+	nativeEndian.PutUint16(msg[4:6], msgType)
+	nativeEndian.PutUint16(msg[6:8], flags|syscall.NLM_F_REQUEST|syscall.NLM_F_ACK)
+	nativeEndian.PutUint32(msg[8:12], seq)
+	if err := syscall.Sendto(h.fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, fmt.Errorf("sending netlink request: %w", err)
+	}
+	var result []syscall.NetlinkMessage
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := syscall.Recvfrom(h.fd, buf, 0)
+		if err != nil {
+			return nil, fmt.Errorf("receiving netlink response: %w", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, fmt.Errorf("parsing netlink response: %w", err)
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq {
+				continue
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return result, nil
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return nil, fmt.Errorf("short netlink error message")
+				}
+				if errno := int32(nativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+					return nil, syscall.Errno(-errno)
+				}
+				return result, nil
+			default:
+				// the buffer is reused by the next datagram of a dump
+				m.Data = append([]byte(nil), m.Data...)
+				result = append(result, m)
+			}
+		}
+	}
+}
+
+// attribute is a netlink attribute (struct nlattr / struct rtattr).
+type attribute struct {
+	Type  uint16
+	Value []byte
+}
+
+// encodeAttributes serializes attributes with the netlink alignment.
+func encodeAttributes(attrs []attribute) []byte {
+	var b []byte
+	for _, a := range attrs {
+		l := 4 + len(a.Value)
+		hdr := make([]byte, 4)
+		nativeEndian.PutUint16(hdr[0:2], uint16(l))
+		nativeEndian.PutUint16(hdr[2:4], a.Type)
+		b = append(b, hdr...)
+		b = append(b, a.Value...)
+		b = append(b, make([]byte, align(l)-l)...)
+	}
+	return b
+}
+
+// decodeAttributes parses a sequence of netlink attributes.
+// Nested and byte-order flags are stripped from the attribute types.
+func decodeAttributes(b []byte) []attribute {
+	var attrs []attribute
+	for len(b) >= 4 {
+		l := int(nativeEndian.Uint16(b[0:2]))
+		if l < 4 || l > len(b) {
+			break
+		}
+		attrs = append(attrs, attribute{
+			Type:  nativeEndian.Uint16(b[2:4]) & 0x3fff,
+			Value: b[4:l],
+		})
+		if align(l) > len(b) {
+			break
+		}
+		b = b[align(l):]
+	}
+	return attrs
+}
+
+func align(l int) int {
+	return (l + syscall.NLMSG_ALIGNTO - 1) & ^(syscall.NLMSG_ALIGNTO - 1)
+}
+
+func uint32Attr(t uint16, v uint32) attribute {
+	b := make([]byte, 4)
+	nativeEndian.PutUint32(b, v)
+	return attribute{Type: t, Value: b}
+}
@@ -0,0 +1,66 @@
+//go:build !linux
+
+package netlink
+
+import "context"
+
+// Handle is a netlink socket bound to a protocol.
+type Handle struct{}
+
+// NewHandle opens a rtnetlink socket.
+func NewHandle() (*Handle, error) { return nil, ErrNotSupported }
+
+// Close closes the netlink socket.
+func (h *Handle) Close() error { return ErrNotSupported }
+
+// RuleAdd adds a policy routing rule.
+func (h *Handle) RuleAdd(rule *Rule) error { return ErrNotSupported }
+
+// RuleDel deletes a policy routing rule.
+func (h *Handle) RuleDel(rule *Rule) error { return ErrNotSupported }
+
+// RuleList returns all IPv4 policy routing rules.
+func (h *Handle) RuleList() ([]Rule, error) { return nil, ErrNotSupported }
+
+// RouteAdd adds a route.
+func (h *Handle) RouteAdd(route *Route) error { return ErrNotSupported }
+
+// RouteReplace adds a route or replaces an existing route with the same destination.
+func (h *Handle) RouteReplace(route *Route) error { return ErrNotSupported }
+
+// RouteDel deletes a route.
+func (h *Handle) RouteDel(route *Route) error { return ErrNotSupported }
+
+// RouteList returns the IPv4 routes of a routing table.
+func (h *Handle) RouteList(table int) ([]Route, error) { return nil, ErrNotSupported }
+
+// LinkList returns all network interfaces.
+func (h *Handle) LinkList() ([]Link, error) { return nil, ErrNotSupported }
+
+// LinkByName returns the network interface with the given name.
+func (h *Handle) LinkByName(name string) (*Link, error) { return nil, ErrNotSupported }
+
+// AddrList returns the IPv4 addresses of all network interfaces.
+func (h *Handle) AddrList() ([]Addr, error) { return nil, ErrNotSupported }
+
+// NewHandleAt opens a rtnetlink socket inside the network namespace at nsPath.
+func NewHandleAt(nsPath string) (*Handle, error) { return nil, ErrNotSupported }
+
+// LinkUpdate is a link change notification.
+type LinkUpdate struct {
+	Link
+	Deleted bool
+}
+
+// LinkSubscribe sends link changes to the channel until the context is done.
+func LinkSubscribe(ctx context.Context, ch chan<- LinkUpdate) error { return ErrNotSupported }
+
+// WireGuardDevice returns the peers of a WireGuard interface.
+func WireGuardDevice(name string) (*Device, error) { return nil, ErrNotSupported }
+
+// ConntrackSubscribe sends the new IPv4 conntrack entries to the channel
+// until the context is done.
+func ConntrackSubscribe(ctx context.Context, ch chan<- ConntrackFlow) error { return ErrNotSupported }
+
+// ConntrackDelete deletes the IPv4 conntrack entries selected by match.
+func ConntrackDelete(match func(ConntrackFlow) bool) (int, error) { return 0, ErrNotSupported }
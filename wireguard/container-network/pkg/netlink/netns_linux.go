@@ -0,0 +1,47 @@
+package netlink
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// NewHandleAt opens a rtnetlink socket inside the network namespace at nsPath
+// (e.g. /proc/<pid>/ns/net). The socket keeps operating on that namespace
+// after the calling thread returns to its original namespace.
+func NewHandleAt(nsPath string) (*Handle, error) {
+	target, err := os.Open(nsPath)
+	if err != nil {
+		return nil, fmt.Errorf("opening network namespace: %w", err)
+	}
+	defer target.Close()
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origin, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", syscall.Gettid()))
+	if err != nil {
+		return nil, fmt.Errorf("opening current network namespace: %w", err)
+	}
+	defer origin.Close()
+	if err := setns(int(target.Fd())); err != nil {
+		return nil, fmt.Errorf("entering network namespace %s: %w", nsPath, err)
+	}
+	handle, handleErr := newHandle(syscall.NETLINK_ROUTE)
+	if err := setns(int(origin.Fd())); err != nil {
+		// The thread is left in the wrong namespace, never unlock it
+		// so the runtime terminates it instead of reusing it.
+		runtime.LockOSThread()
+		if handle != nil {
+			handle.Close()
+		}
+		return nil, fmt.Errorf("returning to original network namespace: %w", err)
+	}
+	return handle, handleErr
+}
+
+func setns(fd int) error {
+	if _, _, errno := syscall.RawSyscall(sysSetns, uintptr(fd), uintptr(syscall.CLONE_NEWNET), 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package netlink
+
+import (
+	"net"
+	"syscall"
+)
+
+// Attributes and values of struct rtmsg messages (linux/rtnetlink.h).
+const (
+	rtaDst        = 1
+	rtaOif        = 4
+	rtaGateway    = 5
+	rtaTable      = 15
+	rtprotStatic  = 4
+	rtScopeLink   = 253
+	rtScopeNone   = 255
+	rtnUnicast    = 1
+	sizeofRtMsg   = 12
+	rtTableUnspec = 0
+)
+
+// RouteAdd adds a route.
+func (h *Handle) RouteAdd(route *Route) error {
+	_, err := h.execute(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, encodeRoute(route, false))
+	return err
+}
+
+// RouteReplace adds a route or replaces an existing route with the same destination.
+func (h *Handle) RouteReplace(route *Route) error {
+	_, err := h.execute(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, encodeRoute(route, false))
+	return err
+}
+
+// RouteDel deletes a route.
+func (h *Handle) RouteDel(route *Route) error {
+	_, err := h.execute(syscall.RTM_DELROUTE, 0, encodeRoute(route, true))
+	return err
+}
+
+// RouteList returns the IPv4 routes of a routing table.
+func (h *Handle) RouteList(table int) ([]Route, error) {
+	req := make([]byte, sizeofRtMsg)
+	req[0] = syscall.AF_INET
+	msgs, err := h.execute(syscall.RTM_GETROUTE, syscall.NLM_F_DUMP, req)
+	if err != nil {
+		return nil, err
+	}
+	var routes []Route
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWROUTE || len(m.Data) < sizeofRtMsg {
+			continue
+		}
+		route := Route{Table: int(m.Data[4])}
+		dstLen := int(m.Data[1])
+		for _, a := range decodeAttributes(m.Data[sizeofRtMsg:]) {
+			switch a.Type {
+			case rtaDst:
+				route.Dst = &net.IPNet{IP: net.IP(a.Value), Mask: net.CIDRMask(dstLen, 8*len(a.Value))}
+			case rtaGateway:
+				route.Gateway = net.IP(a.Value)
+			case rtaOif:
+				route.LinkIndex = int(nativeEndian.Uint32(a.Value))
+			case rtaTable:
+				route.Table = int(nativeEndian.Uint32(a.Value))
+			}
+		}
+		if route.Table == table {
+			routes = append(routes, route)
+		}
+	}
+	return routes, nil
+}
+
+// encodeRoute builds a rtmsg request. Delete requests match any route scope,
+// type and protocol, like "ip route del" does.
+func encodeRoute(route *Route, del bool) []byte {
+	b := make([]byte, sizeofRtMsg)
+	b[0] = syscall.AF_INET
+	b[4] = rtTableUnspec
+	if route.Table < 256 {
+		b[4] = byte(route.Table)
+	}
+	if del {
+		b[6] = rtScopeNone
+	} else {
+		b[5] = rtprotStatic
+		b[7] = rtnUnicast
+	}
+	attrs := []attribute{uint32Attr(rtaTable, uint32(route.Table))}
+	if route.Dst != nil {
+		ones, _ := route.Dst.Mask.Size()
+		b[1] = byte(ones)
+		attrs = append(attrs, attribute{Type: rtaDst, Value: route.Dst.IP.To4()})
+	}
+	if route.Gateway != nil {
+		attrs = append(attrs, attribute{Type: rtaGateway, Value: route.Gateway.To4()})
+	} else if route.LinkIndex > 0 && !del {
+		b[6] = rtScopeLink
+	}
+	if route.LinkIndex > 0 {
+		attrs = append(attrs, uint32Attr(rtaOif, uint32(route.LinkIndex)))
+	}
+	return append(b, encodeAttributes(attrs)...)
+}
@@ -0,0 +1,83 @@
+package netlink
+
+import (
+	"net"
+	"syscall"
+)
+
+// Attributes and actions of struct fib_rule_hdr messages (linux/fib_rules.h).
+const (
+	fraSrc      = 2
+	fraPriority = 6
+	fraFwmark   = 10
+	fraTable    = 15
+	fraFwmask   = 16
+	frActToTbl  = 1
+	sizeofRule  = 12
+)
+
+// RuleAdd adds a policy routing rule.
+func (h *Handle) RuleAdd(rule *Rule) error {
+	_, err := h.execute(syscall.RTM_NEWRULE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, encodeRule(rule))
+	return err
+}
+
+// RuleDel deletes a policy routing rule.
+func (h *Handle) RuleDel(rule *Rule) error {
+	_, err := h.execute(syscall.RTM_DELRULE, 0, encodeRule(rule))
+	return err
+}
+
+// RuleList returns all IPv4 policy routing rules.
+func (h *Handle) RuleList() ([]Rule, error) {
+	req := make([]byte, sizeofRule)
+	req[0] = syscall.AF_INET
+	msgs, err := h.execute(syscall.RTM_GETRULE, syscall.NLM_F_DUMP, req)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWRULE || len(m.Data) < sizeofRule {
+			continue
+		}
+		rule := Rule{Table: int(m.Data[4])}
+		srcLen := int(m.Data[2])
+		for _, a := range decodeAttributes(m.Data[sizeofRule:]) {
+			switch a.Type {
+			case fraPriority:
+				rule.Priority = int(nativeEndian.Uint32(a.Value))
+			case fraFwmark:
+				rule.Mark = nativeEndian.Uint32(a.Value)
+			case fraTable:
+				rule.Table = int(nativeEndian.Uint32(a.Value))
+			case fraSrc:
+				rule.Src = &net.IPNet{IP: net.IP(a.Value), Mask: net.CIDRMask(srcLen, 8*len(a.Value))}
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func encodeRule(rule *Rule) []byte {
+	b := make([]byte, sizeofRule)
+	b[0] = syscall.AF_INET
+	if rule.Table < 256 {
+		b[4] = byte(rule.Table)
+	}
+	b[7] = frActToTbl
+	attrs := []attribute{uint32Attr(fraTable, uint32(rule.Table))}
+	if rule.Priority > 0 {
+		attrs = append(attrs, uint32Attr(fraPriority, uint32(rule.Priority)))
+	}
+	if rule.Mark != 0 {
+		attrs = append(attrs, uint32Attr(fraFwmark, rule.Mark), uint32Attr(fraFwmask, 0xffffffff))
+	}
+	if rule.Src != nil {
+		ones, _ := rule.Src.Mask.Size()
+		b[2] = byte(ones)
+		attrs = append(attrs, attribute{Type: fraSrc, Value: rule.Src.IP.To4()})
+	}
+	return append(b, encodeAttributes(attrs)...)
+}
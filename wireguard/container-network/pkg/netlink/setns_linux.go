@@ -0,0 +1,7 @@
+//go:build linux && !amd64 && !386
+
+package netlink
+
+import "syscall"
+
+const sysSetns = syscall.SYS_SETNS
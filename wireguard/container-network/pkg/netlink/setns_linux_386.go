@@ -0,0 +1,4 @@
+package netlink
+
+// sysSetns is missing in the syscall package for 386.
+const sysSetns = 346
@@ -0,0 +1,4 @@
+package netlink
+
+// sysSetns is missing in the syscall package for amd64.
+const sysSetns = 308
@@ -0,0 +1,66 @@
+package netlink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// rtmgrpLink is the rtnetlink multicast group of link notifications.
+const rtmgrpLink = 0x1
+
+// LinkUpdate is a link change notification.
+type LinkUpdate struct {
+	Link
+	Deleted bool
+}
+
+// LinkSubscribe sends link changes to the channel until the context is done.
+func LinkSubscribe(ctx context.Context, ch chan<- LinkUpdate) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("opening netlink socket: %w", err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: rtmgrpLink}); err != nil {
+		return fmt.Errorf("binding netlink socket: %w", err)
+	}
+	// Wake up periodically to check the context
+	tv := syscall.NsecToTimeval(time.Second.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return fmt.Errorf("setting netlink socket timeout: %w", err)
+	}
+	buf := make([]byte, 64*1024)
+	for ctx.Err() == nil {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) {
+				continue
+			}
+			return fmt.Errorf("receiving netlink notification: %w", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		for _, m := range msgs {
+			deleted := m.Header.Type == syscall.RTM_DELLINK
+			if deleted {
+				// Decode the message as a RTM_NEWLINK one
+				m.Header.Type = syscall.RTM_NEWLINK
+			}
+			link, ok := decodeLink(m)
+			if !ok {
+				continue
+			}
+			select {
+			case ch <- LinkUpdate{Link: link, Deleted: deleted}:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+	return nil
+}
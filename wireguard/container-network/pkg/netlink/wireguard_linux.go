@@ -0,0 +1,114 @@
+package netlink
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// WireGuard generic netlink commands and attributes (linux/wireguard.h).
+const (
+	wgCmdGetDevice           = 0
+	wgDeviceAIfname          = 2
+	wgDeviceAPeers           = 8
+	wgPeerAPublicKey         = 1
+	wgPeerAEndpoint          = 4
+	wgPeerALastHandshakeTime = 6
+	wgPeerAAllowedIPs        = 9
+	wgAllowedIPAFamily       = 1
+	wgAllowedIPAIPAddr       = 2
+	wgAllowedIPACidrMask     = 3
+)
+
+// WireGuardDevice returns the peers of a WireGuard interface.
+func WireGuardDevice(name string) (*Device, error) {
+	h, err := newHandle(syscall.NETLINK_GENERIC)
+	if err != nil {
+		return nil, err
+	}
+	defer h.Close()
+	family, err := h.genlFamily("wireguard")
+	if err != nil {
+		return nil, err
+	}
+	req := []byte{wgCmdGetDevice, 1, 0, 0}
+	req = append(req, encodeAttributes([]attribute{{Type: wgDeviceAIfname, Value: append([]byte(name), 0)}})...)
+	msgs, err := h.execute(family, syscall.NLM_F_DUMP, req)
+	if err != nil {
+		return nil, fmt.Errorf("getting wireguard device %s: %w", name, err)
+	}
+	device := &Device{Name: name}
+	// Large devices are split in several messages, each one with a subset of the peers
+	for _, m := range msgs {
+		if len(m.Data) < sizeofGenlMsghdr {
+			continue
+		}
+		for _, a := range decodeAttributes(m.Data[sizeofGenlMsghdr:]) {
+			if a.Type != wgDeviceAPeers {
+				continue
+			}
+			for _, p := range decodeAttributes(a.Value) {
+				peer := decodePeer(p.Value)
+				// A peer split across messages continues with the same public key
+				if n := len(device.Peers); n > 0 && device.Peers[n-1].PublicKey == peer.PublicKey {
+					device.Peers[n-1].AllowedIPs = append(device.Peers[n-1].AllowedIPs, peer.AllowedIPs...)
+					continue
+				}
+				device.Peers = append(device.Peers, peer)
+			}
+		}
+	}
+	return device, nil
+}
+
+func decodePeer(b []byte) Peer {
+	var peer Peer
+	for _, a := range decodeAttributes(b) {
+		switch a.Type {
+		case wgPeerAPublicKey:
+			peer.PublicKey = base64.StdEncoding.EncodeToString(a.Value)
+		case wgPeerAEndpoint:
+			// struct sockaddr_in: family (2), port (2, big endian), address (4)
+			if len(a.Value) >= 8 && nativeEndian.Uint16(a.Value[0:2]) == 2 {
+				peer.Endpoint = &net.UDPAddr{IP: net.IP(a.Value[4:8]), Port: int(a.Value[2])<<8 | int(a.Value[3])}
+			}
+		case wgPeerALastHandshakeTime:
+			// struct __kernel_timespec: seconds and nanoseconds (int64)
+			if len(a.Value) >= 16 {
+				sec := int64(nativeEndian.Uint64(a.Value[0:8]))
+				nsec := int64(nativeEndian.Uint64(a.Value[8:16]))
+				if sec != 0 || nsec != 0 {
+					peer.LastHandshake = time.Unix(sec, nsec)
+				}
+			}
+		case wgPeerAAllowedIPs:
+			for _, ipAttr := range decodeAttributes(a.Value) {
+				if ipNet := decodeAllowedIP(ipAttr.Value); ipNet != nil {
+					peer.AllowedIPs = append(peer.AllowedIPs, *ipNet)
+				}
+			}
+		}
+	}
+	return peer
+}
+
+func decodeAllowedIP(b []byte) *net.IPNet {
+	var ip net.IP
+	var ones int
+	for _, a := range decodeAttributes(b) {
+		switch a.Type {
+		case wgAllowedIPAIPAddr:
+			ip = net.IP(a.Value)
+		case wgAllowedIPACidrMask:
+			if len(a.Value) > 0 {
+				ones = int(a.Value[0])
+			}
+		}
+	}
+	if ip == nil {
+		return nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, 8*len(ip))}
+}
@@ -0,0 +1,220 @@
+// Package peers reads the peers of the WireGuard server configuration and
+// watches it for changes.
+package peers
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Peer is a peer of the WireGuard server configuration.
+type Peer struct {
+	// Name is the peer name given in WG_PEERS, from the "# peer_<name>" (or
+	// "# peer<number>") comment of the peer section.
+	Name      string
+	PublicKey string
+	// AllowedIPs are the tunnel address of the peer and the networks routed
+	// through it.
+	AllowedIPs []*net.IPNet
+}
+
+// Config contains peers watcher configuration.
+type Config struct {
+	// Path is the WireGuard server configuration file.
+	Path string
+	// CheckInterval is the interval to check the file for changes.
+	CheckInterval time.Duration
+}
+
+// Watcher reloads the peers when the server configuration file changes,
+// notifying the registered listeners.
+type Watcher struct {
+	config    Config
+	listeners []func([]Peer)
+	peers     []Peer
+	modTime   time.Time
+	size      int64
+	missing   bool
+	mu        sync.Mutex
+}
+
+// NewWatcher creates a new peers watcher.
+func NewWatcher(config Config) *Watcher {
+	return &Watcher{config: config}
+}
+
+// OnChange registers a listener called with the peers every time they are
+// loaded. Listeners must be registered before calling Start.
+func (w *Watcher) OnChange(fn func([]Peer)) {
+	w.listeners = append(w.listeners, fn)
+}
+
+// Peers returns the last loaded peers.
+func (w *Watcher) Peers() []Peer {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.peers
+}
+
+// Start loads the peers and reloads them on changes until the context is done.
+func (w *Watcher) Start(ctx context.Context) {
+	w.check()
+	if w.config.CheckInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(w.config.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.check()
+		}
+	}
+}
+
+// check reloads the peers if the modification time or size of the file changed.
+func (w *Watcher) check() {
+	info, err := os.Stat(w.config.Path)
+	if err != nil {
+		if !w.missing {
+			slog.Warn("Failed to read WireGuard server configuration", "path", w.config.Path, "error", err)
+			w.missing = true
+		}
+		return
+	}
+	w.missing = false
+	if info.ModTime().Equal(w.modTime) && info.Size() == w.size {
+		return
+	}
+	peers, err := Load(w.config.Path)
+	if err != nil {
+		slog.Error("Failed to load WireGuard peers", "path", w.config.Path, "error", err)
+		return
+	}
+	w.mu.Lock()
+	w.peers = peers
+	w.modTime = info.ModTime()
+	w.size = info.Size()
+	w.mu.Unlock()
+	names := make([]string, 0, len(peers))
+	for _, p := range peers {
+		names = append(names, p.Name)
+	}
+	slog.Info("Loaded WireGuard peers", "path", w.config.Path, "peers", strings.Join(names, ","))
+	for _, fn := range w.listeners {
+		fn(peers)
+	}
+}
+
+// Load reads the peers of a WireGuard server configuration file.
+func Load(path string) ([]Peer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// Parse parses the [Peer] sections of a WireGuard configuration. Peers are
+// named after the comment following the section header, as written by the
+// image, or after their public key otherwise.
+func Parse(r io.Reader) ([]Peer, error) {
+	var peers []Peer
+	var current *Peer
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "["):
+			peers = appendPeer(peers, current)
+			current = nil
+			if strings.EqualFold(line, "[Peer]") {
+				current = &Peer{}
+			}
+		case current == nil:
+			continue
+		case strings.HasPrefix(line, "#"):
+			if current.Name == "" {
+				current.Name = peerName(strings.TrimSpace(strings.TrimPrefix(line, "#")))
+			}
+		default:
+			key, value, ok := strings.Cut(line, "=")
+			if !ok {
+				return nil, fmt.Errorf("line %d: invalid line %q", n, line)
+			}
+			key = strings.TrimSpace(key)
+			value = strings.TrimSpace(value)
+			switch strings.ToLower(key) {
+			case "publickey":
+				current.PublicKey = value
+			case "allowedips":
+				for _, cidr := range strings.Split(value, ",") {
+					cidr = strings.TrimSpace(cidr)
+					if cidr == "" {
+						continue
+					}
+					_, ipNet, err := net.ParseCIDR(cidr)
+					if err != nil {
+						return nil, fmt.Errorf("line %d: invalid allowed IP %q", n, cidr)
+					}
+					current.AllowedIPs = append(current.AllowedIPs, ipNet)
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return appendPeer(peers, current), nil
+}
+
+// Match returns the peers whose name matches any of the shell patterns
+// (e.g. "laptop", "ops-*").
+func Match(peers []Peer, patterns []string) []Peer {
+	var matched []Peer
+	for _, p := range peers {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, p.Name); ok {
+				matched = append(matched, p)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// peerName returns the peer name from a peer id: "peer_laptop" -> "laptop",
+// "peer1" -> "1".
+func peerName(id string) string {
+	if name, ok := strings.CutPrefix(id, "peer_"); ok && name != "" {
+		return name
+	}
+	if name, ok := strings.CutPrefix(id, "peer"); ok && name != "" && strings.Trim(name, "0123456789") == "" {
+		return name
+	}
+	return id
+}
+
+func appendPeer(peers []Peer, p *Peer) []Peer {
+	if p == nil {
+		return peers
+	}
+	if p.Name == "" {
+		p.Name = p.PublicKey
+	}
+	return append(peers, *p)
+}
@@ -0,0 +1,266 @@
+// Package portpool allocates external ports from a pool, keeping the
+// allocations stable per container name in a state file.
+package portpool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrExhausted is returned when all the ports of the pool are allocated.
+var ErrExhausted = errors.New("port pool exhausted")
+
+// Config contains port pool configuration.
+type Config struct {
+	// Min and Max are the first and last port of the pool.
+	Min uint16
+	Max uint16
+	// Path is the state file with the allocations. If empty, allocations are
+	// only kept in memory.
+	Path string
+	// ReadOnly loads the allocations of the state file but never writes it
+	// (dry run).
+	ReadOnly bool
+	// Expiry is how long the allocations of a stopped container are kept
+	// before their port is given to another container. Zero keeps them
+	// forever.
+	Expiry time.Duration
+}
+
+// Allocation is an external port allocated to a container port.
+type Allocation struct {
+	Container    string    `json:"container"`
+	Port         uint16    `json:"port"`
+	Protocol     string    `json:"protocol"`
+	ExternalPort uint16    `json:"externalPort"`
+	LastUsed     time.Time `json:"lastUsed"`
+	// Released is set once the container stopped, LastUsed is then the time
+	// it stopped.
+	Released bool `json:"released,omitempty"`
+}
+
+// Pool allocates external ports. A container gets the same port every time it
+// starts; the allocations of a container stopped for longer than the expiry
+// are removed and their port given to other containers.
+type Pool struct {
+	config      Config
+	allocations []Allocation
+	mu          sync.Mutex
+}
+
+// ParseRange parses a port range in the format "min-max".
+func ParseRange(value string) (uint16, uint16, error) {
+	minValue, maxValue, ok := strings.Cut(strings.TrimSpace(value), "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid port range %q: expected min-max", value)
+	}
+	first, err := strconv.ParseUint(strings.TrimSpace(minValue), 10, 16)
+	if err != nil || first == 0 {
+		return 0, 0, fmt.Errorf("invalid port range %q: invalid first port", value)
+	}
+	last, err := strconv.ParseUint(strings.TrimSpace(maxValue), 10, 16)
+	if err != nil || last < first {
+		return 0, 0, fmt.Errorf("invalid port range %q: invalid last port", value)
+	}
+	return uint16(first), uint16(last), nil
+}
+
+// NewPool creates a port pool, loading the allocations of the state file.
+// Allocations outside of the pool range are dropped. The loaded allocations
+// count as released until their container starts, e.g. it was removed while
+// the daemon was stopped.
+func NewPool(config Config) (*Pool, error) {
+	p := &Pool{config: config}
+	if config.Path == "" {
+		return p, nil
+	}
+	data, err := os.ReadFile(config.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var allocations []Allocation
+	if err := json.Unmarshal(data, &allocations); err != nil {
+		return nil, fmt.Errorf("invalid port allocations file %s: %w", config.Path, err)
+	}
+	for _, a := range allocations {
+		if a.ExternalPort < config.Min || a.ExternalPort > config.Max {
+			slog.Warn("Dropping port allocation out of the pool", "container", a.Container, "port", a.Port, "externalPort", a.ExternalPort)
+			continue
+		}
+		if !a.Released {
+			a.Released = true
+			a.LastUsed = time.Now()
+		}
+		p.allocations = append(p.allocations, a)
+	}
+	return p, nil
+}
+
+// Allocate returns the external port of a container port, allocating a free
+// one from the pool the first time. The reserved ports, e.g. the static DNAT
+// ports of the containers, are not allocated: an allocated port reserved
+// meanwhile is replaced.
+func (p *Pool) Allocate(container string, port uint16, protocol string, reserved map[uint16]bool) (uint16, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if i := p.find(container, port, protocol); i >= 0 {
+		a := &p.allocations[i]
+		if !reserved[a.ExternalPort] {
+			a.LastUsed = now
+			a.Released = false
+			p.save()
+			return a.ExternalPort, nil
+		}
+		slog.Warn("Allocated external port is a static DNAT port, allocating another", "container", container, "port", port, "protocol", protocol, "externalPort", a.ExternalPort)
+		p.allocations = append(p.allocations[:i], p.allocations[i+1:]...)
+	}
+	p.expire(now)
+	allocation := Allocation{Container: container, Port: port, Protocol: protocol, LastUsed: now}
+	used := make(map[uint16]bool, len(p.allocations))
+	for _, a := range p.allocations {
+		used[a.ExternalPort] = true
+	}
+	for external := int(p.config.Min); external <= int(p.config.Max); external++ {
+		if !used[uint16(external)] && !reserved[uint16(external)] {
+			allocation.ExternalPort = uint16(external)
+			p.allocations = append(p.allocations, allocation)
+			p.save()
+			return allocation.ExternalPort, nil
+		}
+	}
+	return 0, ErrExhausted
+}
+
+// Release marks the allocations of a stopped container as released: they
+// expire after the expiry unless the container starts again.
+func (p *Pool) Release(container string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	changed := false
+	for i := range p.allocations {
+		if a := &p.allocations[i]; a.Container == container && !a.Released {
+			a.Released = true
+			a.LastUsed = now
+			changed = true
+		}
+	}
+	if changed {
+		p.save()
+	}
+}
+
+// Lookup returns the external port allocated to a container port.
+func (p *Pool) Lookup(container string, port uint16, protocol string) (uint16, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if i := p.find(container, port, protocol); i >= 0 {
+		return p.allocations[i].ExternalPort, true
+	}
+	return 0, false
+}
+
+// Allocated returns the allocation of an external port.
+func (p *Pool) Allocated(external uint16) (Allocation, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, a := range p.allocations {
+		if a.ExternalPort == external {
+			return a, true
+		}
+	}
+	return Allocation{}, false
+}
+
+// Allocations returns all the allocations sorted by external port.
+func (p *Pool) Allocations() []Allocation {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	allocations := append([]Allocation(nil), p.allocations...)
+	sort.Slice(allocations, func(i, j int) bool {
+		return allocations[i].ExternalPort < allocations[j].ExternalPort
+	})
+	return allocations
+}
+
+// expire removes the released allocations older than the expiry. Must be
+// called with p.mu held.
+func (p *Pool) expire(now time.Time) {
+	if p.config.Expiry <= 0 {
+		return
+	}
+	kept := p.allocations[:0]
+	for _, a := range p.allocations {
+		if a.Released && now.Sub(a.LastUsed) > p.config.Expiry {
+			slog.Info("Removed expired port allocation", "container", a.Container, "port", a.Port, "protocol", a.Protocol, "externalPort", a.ExternalPort, "lastUsed", a.LastUsed)
+			continue
+		}
+		kept = append(kept, a)
+	}
+	p.allocations = kept
+}
+
+// find returns the index of the allocation of a container port, or -1.
+// Must be called with p.mu held.
+func (p *Pool) find(container string, port uint16, protocol string) int {
+	for i, a := range p.allocations {
+		if a.Container == container && a.Port == port && a.Protocol == protocol {
+			return i
+		}
+	}
+	return -1
+}
+
+// save writes the allocations to the state file, replacing it atomically.
+// Must be called with p.mu held.
+func (p *Pool) save() {
+	if p.config.Path == "" || p.config.ReadOnly {
+		return
+	}
+	data, err := json.MarshalIndent(p.allocations, "", "  ")
+	if err == nil {
+		err = writeFile(p.config.Path, append(data, '\n'))
+	}
+	if err != nil {
+		slog.Error("Failed to save port allocations", "path", p.config.Path, "error", err)
+	}
+}
+
+// writeFile writes data to a temporary file and renames it to path.
+func writeFile(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
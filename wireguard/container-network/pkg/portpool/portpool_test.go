@@ -0,0 +1,212 @@
+package portpool
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		value       string
+		first, last uint16
+		err         bool
+	}{
+		{value: "40000-40010", first: 40000, last: 40010},
+		{value: " 40000 - 40000 ", first: 40000, last: 40000},
+		{value: "40000", err: true},
+		{value: "0-10", err: true},
+		{value: "40010-40000", err: true},
+		{value: "40000-70000", err: true},
+		{value: "a-b", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			first, last, err := ParseRange(tt.value)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("got %d-%d, want an error", first, last)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first != tt.first || last != tt.last {
+				t.Errorf("got %d-%d, want %d-%d", first, last, tt.first, tt.last)
+			}
+		})
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	type allocate struct {
+		container string
+		port      uint16
+		protocol  string
+		want      uint16
+		err       error
+	}
+	tests := []struct {
+		name      string
+		allocates []allocate
+	}{
+		{
+			name: "stable per container port",
+			allocates: []allocate{
+				{container: "web", port: 80, protocol: "tcp", want: 40000},
+				{container: "web", port: 80, protocol: "udp", want: 40001},
+				{container: "db", port: 80, protocol: "tcp", want: 40002},
+				{container: "web", port: 80, protocol: "tcp", want: 40000},
+			},
+		},
+		{
+			name: "exhausted without reuse",
+			allocates: []allocate{
+				{container: "web", port: 80, protocol: "tcp", want: 40000},
+				{container: "web", port: 443, protocol: "tcp", want: 40001},
+				{container: "web", port: 444, protocol: "tcp", want: 40002},
+				{container: "db", port: 5432, protocol: "tcp", err: ErrExhausted},
+				{container: "web", port: 443, protocol: "tcp", want: 40001},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, err := NewPool(Config{Min: 40000, Max: 40002})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, a := range tt.allocates {
+				got, err := pool.Allocate(a.container, a.port, a.protocol, nil)
+				if !errors.Is(err, a.err) {
+					t.Fatalf("%s %d/%s: got error %v, want %v", a.container, a.port, a.protocol, err, a.err)
+				}
+				if got != a.want {
+					t.Errorf("%s %d/%s: got %d, want %d", a.container, a.port, a.protocol, got, a.want)
+				}
+			}
+		})
+	}
+}
+
+func TestAllocateReserved(t *testing.T) {
+	pool, err := NewPool(Config{Min: 40000, Max: 40002})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := pool.Allocate("web", 80, "tcp", map[uint16]bool{40000: true}); err != nil || got != 40001 {
+		t.Errorf("got %d, %v, want 40001", got, err)
+	}
+	// reserved meanwhile, e.g. a static DNAT port of another container
+	if got, err := pool.Allocate("web", 80, "tcp", map[uint16]bool{40001: true}); err != nil || got != 40000 {
+		t.Errorf("got %d, %v, want 40000", got, err)
+	}
+	if a, ok := pool.Allocated(40001); ok {
+		t.Errorf("reserved port still allocated to %+v", a)
+	}
+	if _, err := pool.Allocate("db", 5432, "tcp", map[uint16]bool{40001: true, 40002: true}); !errors.Is(err, ErrExhausted) {
+		t.Errorf("got error %v, want %v", err, ErrExhausted)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ports.json")
+	state := `[
+  {"container": "old", "port": 80, "protocol": "tcp", "externalPort": 40000, "lastUsed": "2020-01-01T00:00:00Z", "released": true},
+  {"container": "web", "port": 80, "protocol": "tcp", "externalPort": 40001, "lastUsed": "2020-01-01T00:00:00Z"}
+]`
+	if err := os.WriteFile(path, []byte(state), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	pool, err := NewPool(Config{Min: 40000, Max: 40001, Path: path, Expiry: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the allocation of "web" counts as released since the pool was loaded
+	if got, err := pool.Allocate("db", 5432, "tcp", nil); err != nil || got != 40000 {
+		t.Errorf("got %d, %v, want the expired 40000", got, err)
+	}
+	if _, ok := pool.Lookup("old", 80, "tcp"); ok {
+		t.Error("expired allocation kept")
+	}
+	if got, ok := pool.Lookup("web", 80, "tcp"); !ok || got != 40001 {
+		t.Errorf("got %d, %v, want 40001", got, ok)
+	}
+
+	pool.Release("db")
+	allocations := pool.Allocations()
+	if len(allocations) != 2 || !allocations[0].Released || time.Since(allocations[0].LastUsed) > time.Minute {
+		t.Errorf("got allocations %+v, want db released now", allocations)
+	}
+	if got, err := pool.Allocate("db", 5432, "tcp", nil); err != nil || got != 40000 {
+		t.Errorf("got %d, %v, want 40000", got, err)
+	}
+	if a, _ := pool.Allocated(40000); a.Released {
+		t.Error("allocation of a started container still released")
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "ports.json")
+	pool, err := NewPool(Config{Min: 40000, Max: 40010, Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, port := range []uint16{80, 443} {
+		if _, err := pool.Allocate("web", port, "tcp", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a smaller range drops the allocations out of it
+	pool, err = NewPool(Config{Min: 40001, Max: 40010, Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pool.Lookup("web", 80, "tcp"); ok {
+		t.Error("allocation out of the range kept")
+	}
+	if got, ok := pool.Lookup("web", 443, "tcp"); !ok || got != 40001 {
+		t.Errorf("got %d, %v, want 40001", got, ok)
+	}
+	if got, err := pool.Allocate("db", 5432, "tcp", nil); err != nil || got != 40002 {
+		t.Errorf("got %d, %v, want 40002", got, err)
+	}
+
+	// read only pools do not write the state file
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err = NewPool(Config{Min: 40000, Max: 40010, Path: path, ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := pool.Allocate("cache", 6379, "tcp", nil); err != nil || got != 40000 {
+		t.Errorf("got %d, %v, want 40000", got, err)
+	}
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(before) {
+		t.Errorf("read only pool wrote the state file:\n%s", after)
+	}
+	allocations := pool.Allocations()
+	if len(allocations) != 3 || allocations[0].Container != "cache" || allocations[2].Container != "db" {
+		t.Errorf("got allocations %+v, sorted by external port", allocations)
+	}
+}
+
+func TestInvalidStateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ports.json")
+	if err := os.WriteFile(path, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPool(Config{Min: 40000, Max: 40010, Path: path}); err == nil {
+		t.Error("got no error for an invalid state file")
+	}
+}
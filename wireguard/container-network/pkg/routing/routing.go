@@ -0,0 +1,239 @@
+// Package routing manages the policy routing rules and routes of the egress routes.
+package routing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"container-network/pkg/config"
+	"container-network/pkg/netlink"
+)
+
+// Config contains routing manager configuration.
+type Config struct {
+	// Routes are the egress routes, routes without mark only get their
+	// routing table default route managed (e.g. tunnel tables).
+	Routes        []config.EgressRoute
+	CheckInterval time.Duration
+}
+
+// Manager creates, verifies and removes the "ip rule" and "ip route" entries
+// of the configured egress routes.
+type Manager struct {
+	config Config
+	handle *netlink.Handle
+	// owned rules and routes were created by the manager and are removed on cleanup
+	ownedRules  []netlink.Rule
+	ownedRoutes []netlink.Route
+	mu          sync.Mutex
+}
+
+// NewManager creates a new routing manager.
+func NewManager(config Config) (*Manager, error) {
+	handle, err := netlink.NewHandle()
+	if err != nil {
+		return nil, err
+	}
+	return &Manager{
+		config: config,
+		handle: handle,
+	}, nil
+}
+
+// Setup creates the missing rules and routes of all egress routes.
+func (m *Manager) Setup() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.handle == nil {
+		return errors.New("routing manager is closed")
+	}
+	var errs []error
+	for _, route := range m.config.Routes {
+		logger := slog.With("egress", route.Name, "mark", route.Mark, "table", route.Table)
+		if route.Mark != 0 {
+			if err := m.ensureRule(logger, route); err != nil {
+				errs = append(errs, fmt.Errorf("egress %s: %w", route.Name, err))
+			}
+		}
+		if err := m.ensureRoute(logger, route); err != nil {
+			errs = append(errs, fmt.Errorf("egress %s: %w", route.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Start periodically verifies the rules and routes, restoring the missing ones.
+func (m *Manager) Start(ctx context.Context) {
+	if m.config.CheckInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(m.config.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.Setup(); err != nil {
+				slog.Error("Failed to verify egress routing", "error", err)
+			}
+		}
+	}
+}
+
+// Cleanup removes the rules and routes created by the manager.
+func (m *Manager) Cleanup() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.handle == nil {
+		return nil
+	}
+	var errs []error
+	for _, rule := range m.ownedRules {
+		if err := m.handle.RuleDel(&rule); err != nil {
+			errs = append(errs, fmt.Errorf("deleting rule %s: %w", rule, err))
+		} else {
+			slog.Info("Removed routing rule", "rule", rule.String())
+		}
+	}
+	for _, route := range m.ownedRoutes {
+		if err := m.handle.RouteDel(&route); err != nil {
+			errs = append(errs, fmt.Errorf("deleting route %s: %w", route, err))
+		} else {
+			slog.Info("Removed route", "route", route.String())
+		}
+	}
+	m.ownedRules = nil
+	m.ownedRoutes = nil
+	m.handle.Close()
+	m.handle = nil
+	return errors.Join(errs...)
+}
+
+// Close releases the netlink handle of the manager without removing the
+// rules and routes.
+func (m *Manager) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.handle != nil {
+		m.handle.Close()
+		m.handle = nil
+	}
+}
+
+// Installed returns the rules and routes of the egress routes that are
+// present, created by the manager or not (e.g. left behind by a crash).
+func (m *Manager) Installed() ([]netlink.Rule, []netlink.Route, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.handle == nil {
+		return nil, nil, errors.New("routing manager is closed")
+	}
+	rules, err := m.handle.RuleList()
+	if err != nil {
+		return nil, nil, fmt.Errorf("listing rules: %w", err)
+	}
+	var installedRules []netlink.Rule
+	var installedRoutes []netlink.Route
+	for _, route := range m.config.Routes {
+		for _, r := range rules {
+			if route.Mark != 0 && r.Mark == route.Mark && r.Table == route.Table && r.Src == nil {
+				installedRules = append(installedRules, r)
+			}
+		}
+		if route.Gateway == nil && route.Device == "" {
+			continue
+		}
+		routes, err := m.handle.RouteList(route.Table)
+		if err != nil {
+			return nil, nil, fmt.Errorf("listing routes: %w", err)
+		}
+		for _, r := range routes {
+			if r.Dst == nil {
+				installedRoutes = append(installedRoutes, r)
+			}
+		}
+	}
+	return installedRules, installedRoutes, nil
+}
+
+// ensureRule adds the "ip rule fwmark <mark> table <table>" of an egress route if missing.
+func (m *Manager) ensureRule(logger *slog.Logger, route config.EgressRoute) error {
+	rules, err := m.handle.RuleList()
+	if err != nil {
+		return fmt.Errorf("listing rules: %w", err)
+	}
+	for _, r := range rules {
+		if r.Mark == route.Mark && r.Table == route.Table && r.Src == nil {
+			return nil
+		}
+	}
+	rule := netlink.Rule{Mark: route.Mark, Table: route.Table}
+	if err := m.handle.RuleAdd(&rule); err != nil {
+		return fmt.Errorf("adding rule %s: %w", rule, err)
+	}
+	if !containsRule(m.ownedRules, rule) {
+		m.ownedRules = append(m.ownedRules, rule)
+	} else {
+		logger.Warn("Routing rule was missing and has been restored")
+	}
+	logger.Info("Added routing rule", "rule", rule.String())
+	return nil
+}
+
+// ensureRoute sets the default route of the egress routing table if a gateway
+// and/or device are configured.
+func (m *Manager) ensureRoute(logger *slog.Logger, route config.EgressRoute) error {
+	if route.Gateway == nil && route.Device == "" {
+		return nil
+	}
+	desired := netlink.Route{Gateway: route.Gateway, Table: route.Table}
+	if route.Device != "" {
+		link, err := m.handle.LinkByName(route.Device)
+		if err != nil {
+			return err
+		}
+		desired.LinkIndex = link.Index
+	}
+	routes, err := m.handle.RouteList(route.Table)
+	if err != nil {
+		return fmt.Errorf("listing routes: %w", err)
+	}
+	for _, r := range routes {
+		if r.Dst == nil && r.Gateway.Equal(desired.Gateway) && (desired.LinkIndex == 0 || r.LinkIndex == desired.LinkIndex) {
+			return nil
+		}
+	}
+	if err := m.handle.RouteReplace(&desired); err != nil {
+		return fmt.Errorf("adding route %s: %w", desired, err)
+	}
+	if !containsRoute(m.ownedRoutes, desired) {
+		m.ownedRoutes = append(m.ownedRoutes, desired)
+	} else {
+		logger.Warn("Route was missing and has been restored")
+	}
+	logger.Info("Added route", "route", desired.String())
+	return nil
+}
+
+func containsRule(rules []netlink.Rule, rule netlink.Rule) bool {
+	for _, r := range rules {
+		if r.Mark == rule.Mark && r.Table == rule.Table {
+			return true
+		}
+	}
+	return false
+}
+
+func containsRoute(routes []netlink.Route, route netlink.Route) bool {
+	for _, r := range routes {
+		if r.Table == route.Table {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package setup
+
+import (
+	"fmt"
+	"net"
+
+	"container-network/pkg/netlink"
+)
+
+// DefaultTunnelInterface is used when no WireGuard interface is found.
+const DefaultTunnelInterface = "wg0"
+
+// Interfaces contains the local interfaces facing the watched network and the tunnel.
+type Interfaces struct {
+	// Internal is the interface holding an address in the watched network subnet.
+	Internal string
+	// InternalAddress is the address of the Internal interface.
+	InternalAddress net.IP
+	// Tunnel is the WireGuard interface.
+	Tunnel string
+}
+
+// DetectInterfaces finds the interface with an address in the given subnet and
+// the first WireGuard interface of the current network namespace.
+func DetectInterfaces(subnet string) (*Interfaces, error) {
+	handle, err := netlink.NewHandle()
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+	links, err := handle.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("listing links: %w", err)
+	}
+	names := make(map[int]string, len(links))
+	ifaces := &Interfaces{}
+	for _, link := range links {
+		names[link.Index] = link.Name
+		if link.Kind == "wireguard" && ifaces.Tunnel == "" {
+			ifaces.Tunnel = link.Name
+		}
+	}
+	if subnet == "" {
+		return ifaces, nil
+	}
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet: %w", err)
+	}
+	addrs, err := handle.AddrList()
+	if err != nil {
+		return nil, fmt.Errorf("listing addresses: %w", err)
+	}
+	for _, addr := range addrs {
+		if ipNet.Contains(addr.IPNet.IP) {
+			ifaces.Internal = names[addr.LinkIndex]
+			ifaces.InternalAddress = addr.IPNet.IP
+			break
+		}
+	}
+	return ifaces, nil
+}
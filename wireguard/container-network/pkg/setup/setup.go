@@ -0,0 +1,285 @@
+// Package setup implements the base network setup of the daemon: the sysctls
+// and iptables rules connecting the internal network with the tunnel.
+package setup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Config contains base setup configuration.
+type Config struct {
+	InternalSubnet    string
+	InternalInterface string
+	TunnelInterface   string
+}
+
+// sysctl is a kernel parameter with its desired and previous values.
+type sysctl struct {
+	key      string
+	value    string
+	previous string
+	// iface is the interface of a per-interface parameter
+	iface string
+}
+
+// Base manages the base network setup.
+type Base struct {
+	config  Config
+	mu      sync.Mutex
+	sysctls []sysctl
+	// pending are the per-interface sysctls of interfaces missing when
+	// Apply ran, written by InterfaceUp
+	pending []sysctl
+	// rules added by Apply, removed by Restore
+	rules [][]string
+}
+
+// NewBase creates a new base setup.
+func NewBase(config Config) *Base {
+	return &Base{config: config}
+}
+
+// desiredSysctls returns the kernel parameters required for asymmetric routing and forwarding.
+func (b *Base) desiredSysctls() []sysctl {
+	sysctls := []sysctl{{key: "net.ipv4.ip_forward", value: "1"}}
+	for _, iface := range []string{b.config.TunnelInterface, b.config.InternalInterface} {
+		if iface != "" {
+			sysctls = append(sysctls, sysctl{key: "net.ipv4.conf." + iface + ".rp_filter", value: "0", iface: iface})
+		}
+	}
+	return sysctls
+}
+
+// desiredRules returns the iptables rules (without action) allowing the internal
+// subnet to leave through the tunnel.
+func (b *Base) desiredRules() [][]string {
+	subnet, tunnel := b.config.InternalSubnet, b.config.TunnelInterface
+	if subnet == "" || tunnel == "" {
+		return nil
+	}
+	return [][]string{
+		{"-t", "filter", "FORWARD", "-s", subnet, "-o", tunnel, "-j", "ACCEPT"},
+		{"-t", "filter", "FORWARD", "-d", subnet, "-i", tunnel, "-m", "state", "--state", "ESTABLISHED,RELATED", "-j", "ACCEPT"},
+		{"-t", "nat", "POSTROUTING", "-s", subnet, "-o", tunnel, "-j", "MASQUERADE"},
+	}
+}
+
+// Apply writes the sysctls and inserts the missing iptables rules, remembering
+// the previous sysctl values and the added rules. The sysctls of a missing
+// interface, e.g. a tunnel not up yet, are written by InterfaceUp.
+func (b *Base) Apply() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var errs []error
+	for _, s := range b.desiredSysctls() {
+		if err := b.applySysctl(s); errors.Is(err, fs.ErrNotExist) && s.iface != "" {
+			slog.Warn("Interface missing, sysctl set when it appears", "key", s.key, "interface", s.iface)
+			b.pending = append(b.pending, s)
+		} else if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if b.config.InternalSubnet == "" {
+		slog.Warn("Internal subnet not defined, skipping base forwarding and masquerade rules")
+	}
+	for _, rule := range b.desiredRules() {
+		if iptables("-C", rule) == nil {
+			slog.Debug("Base rule already present", "rule", strings.Join(rule, " "))
+			continue
+		}
+		if err := iptables("-I", rule); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		slog.Info("Added base rule", "rule", strings.Join(rule, " "))
+		b.rules = append(b.rules, rule)
+	}
+	return errors.Join(errs...)
+}
+
+// InterfaceUp writes the sysctls of an interface coming up: the pending ones
+// of an interface missing when Apply ran, and the ones reset because the
+// interface was created again.
+func (b *Base) InterfaceUp(iface string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var errs []error
+	for _, s := range b.sysctls {
+		if s.iface != iface {
+			continue
+		}
+		if value, err := readSysctl(s.key); err == nil && value != s.value {
+			if err := writeSysctl(s.key, s.value); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			slog.Info("Set sysctl again", "key", s.key, "value", s.value, "previous", value)
+		}
+	}
+	pending := b.pending[:0]
+	for _, s := range b.pending {
+		if s.iface != iface {
+			pending = append(pending, s)
+			continue
+		}
+		if err := b.applySysctl(s); err != nil {
+			errs = append(errs, err)
+			pending = append(pending, s)
+		}
+	}
+	b.pending = pending
+	return errors.Join(errs...)
+}
+
+// applySysctl writes a sysctl, remembering its previous value. Must be called
+// with b.mu held.
+func (b *Base) applySysctl(s sysctl) error {
+	previous, err := readSysctl(s.key)
+	if err != nil {
+		return err
+	}
+	if previous != s.value {
+		if err := writeSysctl(s.key, s.value); err != nil {
+			return err
+		}
+		slog.Info("Set sysctl", "key", s.key, "value", s.value, "previous", previous)
+	}
+	s.previous = previous
+	b.sysctls = append(b.sysctls, s)
+	return nil
+}
+
+// Rules returns the iptables rules of the base setup, in the format
+// {"-t", table, chain, spec...}.
+func (b *Base) Rules() [][]string {
+	return b.desiredRules()
+}
+
+// Plan writes the sysctls and the iptables rules Apply would insert if missing
+// (dry run), without reading or changing anything.
+func (b *Base) Plan(w io.Writer) {
+	for _, s := range b.desiredSysctls() {
+		fmt.Fprintf(w, "# sysctl -w %s=%s\n", s.key, s.value)
+	}
+	for _, rule := range b.desiredRules() {
+		args := append([]string{rule[0], rule[1], "-I", rule[2]}, rule[3:]...)
+		fmt.Fprintf(w, "# if missing: iptables %s\n", strings.Join(args, " "))
+	}
+}
+
+// Verify checks that the sysctls have the desired values and the rules are
+// present. The sysctls of missing interfaces are not checked.
+func (b *Base) Verify() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var errs []error
+	for _, s := range b.desiredSysctls() {
+		value, err := readSysctl(s.key)
+		if errors.Is(err, fs.ErrNotExist) && b.isPending(s.key) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+		} else if value != s.value {
+			errs = append(errs, fmt.Errorf("sysctl %s is %s, expected %s", s.key, value, s.value))
+		}
+	}
+	// The effective rp_filter is the maximum of "all" and the interface value
+	if value, err := readSysctl("net.ipv4.conf.all.rp_filter"); err == nil && value != "0" {
+		slog.Warn("Reverse path filtering enabled for all interfaces, it may still drop asymmetric traffic", "key", "net.ipv4.conf.all.rp_filter", "value", value)
+	}
+	for _, rule := range b.desiredRules() {
+		if err := iptables("-C", rule); err != nil {
+			errs = append(errs, fmt.Errorf("base rule missing: %s", strings.Join(rule, " ")))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// isPending returns true if a sysctl waits for its interface. Must be called
+// with b.mu held.
+func (b *Base) isPending(key string) bool {
+	for _, s := range b.pending {
+		if s.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Restore removes the rules added by Apply and restores the previous sysctl values.
+func (b *Base) Restore() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var errs []error
+	for _, rule := range b.rules {
+		if err := iptables("-D", rule); err != nil {
+			errs = append(errs, err)
+		} else {
+			slog.Info("Removed base rule", "rule", strings.Join(rule, " "))
+		}
+	}
+	b.rules = nil
+	for i := len(b.sysctls) - 1; i >= 0; i-- {
+		s := b.sysctls[i]
+		if s.previous == s.value {
+			continue
+		}
+		if err := writeSysctl(s.key, s.previous); err != nil {
+			errs = append(errs, err)
+		} else {
+			slog.Info("Restored sysctl", "key", s.key, "value", s.previous)
+		}
+	}
+	b.sysctls = nil
+	b.pending = nil
+	return errors.Join(errs...)
+}
+
+// sysctlPath returns the /proc/sys path of a kernel parameter. Interface names
+// may contain dots, so only the fixed prefix is split.
+func sysctlPath(key string) string {
+	if rest, ok := strings.CutPrefix(key, "net.ipv4.conf."); ok {
+		if i := strings.LastIndex(rest, "."); i > 0 {
+			return filepath.Join("/proc/sys/net/ipv4/conf", rest[:i], rest[i+1:])
+		}
+	}
+	return filepath.Join("/proc/sys", strings.ReplaceAll(key, ".", "/"))
+}
+
+func readSysctl(key string) (string, error) {
+	data, err := os.ReadFile(sysctlPath(key))
+	if err != nil {
+		return "", fmt.Errorf("reading sysctl %s: %w", key, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func writeSysctl(key, value string) error {
+	if err := os.WriteFile(sysctlPath(key), []byte(value), 0o644); err != nil {
+		return fmt.Errorf("writing sysctl %s: %w", key, err)
+	}
+	return nil
+}
+
+// iptables executes an iptables command with the given action (-C, -I, -D)
+// for a rule in the format {"-t", table, chain, spec...}.
+func iptables(action string, rule []string) error {
+	args := append([]string{rule[0], rule[1], action, rule[2]}, rule[3:]...)
+	slog.Debug("Executing iptables", "args", strings.Join(args, " "))
+	cmd := exec.Command("iptables", args...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("iptables %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+// Package tunnel monitors the state and health of the WireGuard tunnel interface.
+package tunnel
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"container-network/pkg/netlink"
+)
+
+// Config contains tunnel monitor configuration.
+type Config struct {
+	Interface string
+	// HandshakeTimeout is the maximum age of the latest peer handshake for a
+	// healthy tunnel. Zero disables the handshake check.
+	HandshakeTimeout time.Duration
+	// CheckInterval is the interval to check the peer handshakes.
+	CheckInterval time.Duration
+}
+
+// State is the state of the tunnel interface.
+type State struct {
+	Interface string `json:"interface"`
+	// Up is set if the interface exists and is up.
+	Up bool `json:"up"`
+	// Healthy is set if the interface is up and the latest handshake is recent.
+	Healthy bool `json:"healthy"`
+	// LatestHandshake is the most recent handshake of all the peers.
+	LatestHandshake time.Time `json:"latestHandshake"`
+	// Since is the time of the last health change.
+	Since time.Time `json:"since"`
+}
+
+// Monitor watches the link state of the tunnel interface over netlink and the
+// latest peer handshake over the WireGuard netlink interface, notifying the
+// registered listeners when the state changes.
+type Monitor struct {
+	config    Config
+	listeners []func(previous, current State)
+	state     State
+	known     bool
+	mu        sync.Mutex
+}
+
+// NewMonitor creates a new tunnel monitor.
+func NewMonitor(config Config) *Monitor {
+	return &Monitor{
+		config: config,
+		state:  State{Interface: config.Interface},
+	}
+}
+
+// OnChange registers a listener called on every change of the tunnel up or
+// health state. Listeners must be registered before calling Start.
+func (m *Monitor) OnChange(fn func(previous, current State)) {
+	m.listeners = append(m.listeners, fn)
+}
+
+// State returns the current tunnel state.
+func (m *Monitor) State() State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// Start reports the current tunnel state and watches link changes and peer
+// handshakes until the context is done.
+func (m *Monitor) Start(ctx context.Context) {
+	m.check()
+	updates := make(chan netlink.LinkUpdate, 16)
+	go func() {
+		for ctx.Err() == nil {
+			if err := netlink.LinkSubscribe(ctx, updates); err != nil {
+				slog.Error("Error watching tunnel interface", "interface", m.config.Interface, "error", err)
+				time.Sleep(2 * time.Second)
+			}
+		}
+	}()
+	var tick <-chan time.Time
+	if m.config.HandshakeTimeout > 0 && m.config.CheckInterval > 0 {
+		ticker := time.NewTicker(m.config.CheckInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case update := <-updates:
+			if update.Name == m.config.Interface {
+				m.check()
+			}
+		case <-tick:
+			m.check()
+		}
+	}
+}
+
+// check gets the current link state and latest handshake of the tunnel and
+// updates the state.
+func (m *Monitor) check() {
+	current := State{Interface: m.config.Interface}
+	handle, err := netlink.NewHandle()
+	if err != nil {
+		slog.Error("Failed to get tunnel interface state", "interface", m.config.Interface, "error", err)
+	} else {
+		if link, err := handle.LinkByName(m.config.Interface); err == nil {
+			current.Up = link.Up
+		}
+		handle.Close()
+	}
+	current.Healthy = current.Up
+	if current.Up && m.config.HandshakeTimeout > 0 {
+		device, err := netlink.WireGuardDevice(m.config.Interface)
+		if err != nil {
+			slog.Debug("Failed to get tunnel peers", "interface", m.config.Interface, "error", err)
+			current.Healthy = false
+		} else {
+			current.LatestHandshake = device.LatestHandshake()
+			current.Healthy = time.Since(current.LatestHandshake) <= m.config.HandshakeTimeout
+		}
+	}
+	m.setState(current)
+}
+
+// setState updates the tunnel state, notifying the listeners if it changed.
+func (m *Monitor) setState(current State) {
+	m.mu.Lock()
+	previous := m.state
+	changed := !m.known || previous.Up != current.Up || previous.Healthy != current.Healthy
+	if changed {
+		current.Since = time.Now()
+	} else {
+		current.Since = previous.Since
+	}
+	m.state = current
+	m.known = true
+	m.mu.Unlock()
+	if !changed {
+		return
+	}
+	logger := slog.With("interface", current.Interface, "up", current.Up, "healthy", current.Healthy)
+	if !current.LatestHandshake.IsZero() {
+		logger = logger.With("handshakeAge", time.Since(current.LatestHandshake).Round(time.Second).String())
+	}
+	switch {
+	case current.Healthy:
+		logger.Info("Tunnel is healthy")
+	case current.Up:
+		logger.Warn("Tunnel is up but unhealthy, no recent handshake")
+	default:
+		logger.Warn("Tunnel interface is down or missing")
+	}
+	for _, fn := range m.listeners {
+		fn(previous, current)
+	}
+}
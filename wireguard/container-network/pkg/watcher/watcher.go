@@ -18,8 +18,11 @@ type ContainerEventType int
 const (
 	// ContainerStarted indicates a container has started.
 	ContainerStarted ContainerEventType = iota
-	// ContainerStopped indicates a container has stopped (died or crashed)
+	// ContainerStopped indicates a container is stopping (stop or kill), its
+	// process may still be running.
 	ContainerStopped
+	// ContainerDied indicates the process of a container has exited.
+	ContainerDied
 )
 
 func (t ContainerEventType) String() string {
@@ -28,6 +31,8 @@ func (t ContainerEventType) String() string {
 		return "started"
 	case ContainerStopped:
 		return "stopped"
+	case ContainerDied:
+		return "died"
 	default:
 		return "unknown"
 	}
@@ -49,6 +54,8 @@ type ContainerInfo struct {
 	NetworkName string
 	Ports       []PortMapping
 	Labels      map[string]string
+	// Pid is the main process of the container, used to enter its namespaces.
+	Pid int
 }
 
 // ContainerEvent represents an event about a container.
@@ -56,6 +63,9 @@ type ContainerEvent struct {
 	Type      ContainerEventType
 	Container ContainerInfo
 	Timestamp time.Time
+	// Pending is the number of events of the same batch sent after this one,
+	// e.g. the containers found by the initial discovery.
+	Pending int
 }
 
 // Config contains watcher configuration.
@@ -78,16 +88,19 @@ type Watcher struct {
 	config          Config
 	events          chan ContainerEvent
 	knownContainers map[string]ContainerInfo
-	mu              sync.RWMutex
+	// stoppingContainers are the containers stopped but not dead yet
+	stoppingContainers map[string]ContainerInfo
+	mu                 sync.RWMutex
 }
 
 // NewWatcher creates a new container watcher.
 func NewWatcher(c *client.Client, config Config) *Watcher {
 	return &Watcher{
-		client:          c,
-		config:          config,
-		events:          make(chan ContainerEvent, 200),
-		knownContainers: make(map[string]ContainerInfo),
+		client:             c,
+		config:             config,
+		events:             make(chan ContainerEvent, 200),
+		knownContainers:    make(map[string]ContainerInfo),
+		stoppingContainers: make(map[string]ContainerInfo),
 	}
 }
 
@@ -95,19 +108,48 @@ func NewWatcher(c *client.Client, config Config) *Watcher {
 func (w *Watcher) addKnownContainer(id string, info ContainerInfo) {
 	w.mu.Lock()
 	w.knownContainers[id] = info
+	delete(w.stoppingContainers, id)
 	w.mu.Unlock()
 }
 
-// removeKnownContainer removes a container from the known containers map
-// and returns the container info if it was previously known.
-func (w *Watcher) removeKnownContainer(id string) (ContainerInfo, bool) {
+// stopKnownContainer moves a known container to the stopping containers and
+// returns the container info if it was previously known.
+func (w *Watcher) stopKnownContainer(id string) (ContainerInfo, bool) {
 	w.mu.Lock()
+	defer w.mu.Unlock()
 	info, wasKnown := w.knownContainers[id]
+	if wasKnown {
+		delete(w.knownContainers, id)
+		w.stoppingContainers[id] = info
+	}
+	return info, wasKnown
+}
+
+// removeDeadContainer removes a known or stopping container and returns the
+// container info if it was previously known.
+func (w *Watcher) removeDeadContainer(id string) (ContainerInfo, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	info, wasKnown := w.knownContainers[id]
+	if !wasKnown {
+		info, wasKnown = w.stoppingContainers[id]
+	}
 	delete(w.knownContainers, id)
-	w.mu.Unlock()
+	delete(w.stoppingContainers, id)
 	return info, wasKnown
 }
 
+// KnownContainers returns the running watched containers.
+func (w *Watcher) KnownContainers() []ContainerInfo {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	containers := make([]ContainerInfo, 0, len(w.knownContainers))
+	for _, info := range w.knownContainers {
+		containers = append(containers, info)
+	}
+	return containers
+}
+
 // Events returns the channel that receives container events.
 func (w *Watcher) Events() <-chan ContainerEvent {
 	return w.events
@@ -133,30 +175,53 @@ func (w *Watcher) discoverExistingContainers(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("listing containers: %w", err)
 	}
+	return w.processContainers(ctx, containers)
+}
+
+// processContainers sends the started events of the watched containers as
+// one batch.
+func (w *Watcher) processContainers(ctx context.Context, containers []client.Container) error {
+	var infos []ContainerInfo
 	for _, container := range containers {
-		if err := w.processContainer(ctx, &container); err != nil {
-			return err
+		if !w.shouldWatch(&container) {
+			continue
 		}
+		info := w.extractContainerInfo(&container)
+		if inspect, err := w.client.InspectContainer(ctx, container.ID); err != nil {
+			slog.Warn("Error inspecting container", "containerID", container.ID, "error", err)
+		} else {
+			info.Pid = inspect.State.Pid
+		}
+		w.addKnownContainer(container.ID, info)
+		infos = append(infos, info)
 	}
-	return err
+	now := time.Now()
+	for i, info := range infos {
+		select {
+		case w.events <- ContainerEvent{
+			Type:      ContainerStarted,
+			Container: info,
+			Timestamp: now,
+			Pending:   len(infos) - i - 1,
+		}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
 }
 
-func (w *Watcher) processContainer(ctx context.Context, container *client.Container) error {
-	if !w.shouldWatch(container) {
-		return nil
-	}
-	info := w.extractContainerInfo(container)
-	w.addKnownContainer(container.ID, info)
-	select {
-	case w.events <- ContainerEvent{
-		Type:      ContainerStarted,
-		Container: info,
-		Timestamp: time.Now(),
-	}:
-	case <-ctx.Done():
-		return ctx.Err()
+// Infos returns the information of the watched containers among the given
+// ones, as sent in their started events. Used to plan the rules of
+// containers not running.
+func (w *Watcher) Infos(containers []client.Container) []ContainerInfo {
+	var infos []ContainerInfo
+	for _, container := range containers {
+		if w.shouldWatch(&container) {
+			infos = append(infos, w.extractContainerInfo(&container))
+		}
 	}
-	return nil
+	return infos
 }
 
 func (w *Watcher) shouldWatch(container *client.Container) bool {
@@ -246,15 +311,21 @@ func (w *Watcher) handleEvent(ctx context.Context, event client.Event) {
 	switch {
 	case strings.HasPrefix(action, "start"):
 		eventType = ContainerStarted
-	case strings.HasPrefix(action, "stop"):
-		eventType = ContainerStopped
-	case strings.HasPrefix(action, "die"), strings.HasPrefix(action, "kill"):
+	case strings.HasPrefix(action, "stop"), strings.HasPrefix(action, "kill"):
 		eventType = ContainerStopped
+	case strings.HasPrefix(action, "die"):
+		eventType = ContainerDied
 	default:
 		return
 	}
-	if eventType == ContainerStopped {
-		info, wasKnown := w.removeKnownContainer(containerID)
+	if eventType != ContainerStarted {
+		var info ContainerInfo
+		var wasKnown bool
+		if eventType == ContainerStopped {
+			info, wasKnown = w.stopKnownContainer(containerID)
+		} else {
+			info, wasKnown = w.removeDeadContainer(containerID)
+		}
 		if wasKnown {
 			select {
 			case w.events <- ContainerEvent{
@@ -275,8 +346,6 @@ func (w *Watcher) handleEvent(ctx context.Context, event client.Event) {
 			slog.Error("Error retrieving container", "containerID", containerID, "error", err)
 			return
 		}
-		for _, container := range containers {
-			w.processContainer(ctx, &container)
-		}
+		w.processContainers(ctx, containers)
 	}
 }
@@ -28,5 +28,13 @@ then
     exit 1
 fi
 
+# Container-Network serves its admin API on a unix socket while enabled
+ADMIN_SOCKET="${ADMIN_LISTEN:-/run/container-network/admin.sock}"
+if [[ -S "${ADMIN_SOCKET}" ]] && ! curl -fsS -o /dev/null --max-time 5 --unix-socket "${ADMIN_SOCKET}" http://localhost/readyz
+then
+    echo "* HEALTHCHECK: Container-Network is not ready" >&2
+    exit 1
+fi
+
 echo "* HEALTHCHECK: WireGuard interface ${INTERFACE} is healthy"
 exit 0
\ No newline at end of file